@@ -0,0 +1,263 @@
+package geograph
+
+import (
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/tidwall/sjson"
+	"io"
+	"math"
+	"slices"
+)
+
+// metersPerDegree is the length of a degree of latitude, and of longitude at
+// the equator.
+const metersPerDegree = earthRadiusMeters * math.Pi / 180
+
+var ErrInvalidLine = errors.New("invalid line")
+
+const (
+	// maxAlongMeters is the longest route AlongLine accepts.
+	maxAlongMeters = 1_000_000
+	// alongStepMeters is the longest part of a segment searched at once, so
+	// that the box searched around a long diagonal segment stays close to it.
+	alongStepMeters = 1_000
+)
+
+// AlongLine returns the first maxItems pictures within bufferMeters of route
+// ordered by how far along the route they are, and whether there are more.
+// The route is made up of lines followed one after another, without joining
+// the end of one to the start of the next. If spacingMeters is positive
+// pictures are thinned to at most one every spacingMeters along the route.
+//
+// Distances from the route are measured in a local equirectangular
+// projection, which is accurate for the short segments and buffers of routes.
+func (s *Store) AlongLine(route [][][2]float32, bufferMeters float64, index IndexType, spacingMeters float64, maxItems int) (bool, []*Picture, error) {
+	if maxItems < 1 {
+		return false, nil, ErrInvalidPageSize
+	}
+	if len(route) == 0 {
+		return false, nil, fmt.Errorf("%w: need at least one line", ErrInvalidLine)
+	}
+	var length float64
+	for _, line := range route {
+		if len(line) < 2 {
+			return false, nil, fmt.Errorf("%w: need at least two points", ErrInvalidLine)
+		}
+		for i := 1; i < len(line); i++ {
+			length += newLocalSegment(line[i-1], line[i]).length
+		}
+	}
+	if length > maxAlongMeters {
+		return false, nil, fmt.Errorf("%w: longer than %dkm", ErrInvalidLine, maxAlongMeters/1000)
+	}
+
+	type match struct {
+		id       int32
+		along    float64
+		fromLine float64
+	}
+	matches := make(map[int32]match)
+
+	var segmentStart float64
+	for _, line := range route {
+		for i := 1; i < len(line); i++ {
+			a, b := line[i-1], line[i]
+			segment := newLocalSegment(a, b)
+
+			steps := max(1, int(math.Ceil(segment.length/alongStepMeters)))
+			for step := range steps {
+				stepA := lerpPoint(a, b, float32(step)/float32(steps))
+				stepB := lerpPoint(a, b, float32(step+1)/float32(steps))
+				minPt, maxPt := bufferBox(stepA, stepB, bufferMeters)
+				s.index.each(minPt, maxPt, index, func(id int32, point [2]float32) bool {
+					along, fromLine := segment.project(point)
+					if fromLine > bufferMeters {
+						return true
+					}
+					m := match{id: id, along: segmentStart + along, fromLine: fromLine}
+					if prev, ok := matches[id]; !ok || m.fromLine < prev.fromLine {
+						matches[id] = m
+					}
+					return true
+				})
+			}
+
+			segmentStart += segment.length
+		}
+	}
+
+	sorted := make([]match, 0, len(matches))
+	for _, m := range matches {
+		sorted = append(sorted, m)
+	}
+	slices.SortFunc(sorted, func(a, b match) int {
+		return cmp.Or(cmp.Compare(a.along, b.along), cmp.Compare(a.id, b.id))
+	})
+
+	out := make([]*Picture, 0, pageAlloc(maxItems))
+	hasMore := false
+	lastAlong := math.Inf(-1)
+	for _, m := range sorted {
+		if spacingMeters > 0 && m.along-lastAlong < spacingMeters {
+			continue
+		}
+
+		// Stop if past max
+		if len(out) == maxItems {
+			hasMore = true
+			break
+		}
+
+		pic, err := s.Get(m.id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return false, nil, err
+		}
+
+		pic.MetersAlongLine = int32(math.Round(m.along))
+		pic.MetersFromLine = int32(math.Round(m.fromLine))
+		pic.raw, err = sjson.SetBytes(pic.raw, "meters_along_line", pic.MetersAlongLine)
+		if err != nil {
+			return false, nil, err
+		}
+		pic.raw, err = sjson.SetBytes(pic.raw, "meters_from_line", pic.MetersFromLine)
+		if err != nil {
+			return false, nil, err
+		}
+
+		out = append(out, pic)
+		lastAlong = m.along
+	}
+	return hasMore, out, nil
+}
+
+// lerpPoint is the point t of the way from a to b.
+func lerpPoint(a, b [2]float32, t float32) [2]float32 {
+	return Point(a[0]+(b[0]-a[0])*t, a[1]+(b[1]-a[1])*t)
+}
+
+// localSegment is a segment projected into meters around its start.
+type localSegment struct {
+	origin [2]float32
+	cosLat float64
+	dx, dy float64
+	length float64
+}
+
+func newLocalSegment(a, b [2]float32) localSegment {
+	s := localSegment{origin: a, cosLat: math.Cos(degreesToRadians(float64(a[1])))}
+	s.dx, s.dy = s.local(b)
+	s.length = math.Hypot(s.dx, s.dy)
+	return s
+}
+
+func (s localSegment) local(p [2]float32) (float64, float64) {
+	return float64(p[0]-s.origin[0]) * s.cosLat * metersPerDegree, float64(p[1]-s.origin[1]) * metersPerDegree
+}
+
+// project returns how far along the segment the closest point to p is and
+// how far p is from it.
+func (s localSegment) project(p [2]float32) (along float64, fromLine float64) {
+	x, y := s.local(p)
+	var t float64
+	if s.length > 0 {
+		t = math.Max(0, math.Min(1, (x*s.dx+y*s.dy)/(s.length*s.length)))
+	}
+	return t * s.length, math.Hypot(x-t*s.dx, y-t*s.dy)
+}
+
+// bufferBox is the bounding box of the segment from a to b expanded by
+// bufferMeters.
+func bufferBox(a, b [2]float32, bufferMeters float64) (min, max [2]float32) {
+	maxAbsLat := math.Max(math.Abs(float64(a[1])), math.Abs(float64(b[1])))
+	dLat := bufferMeters / metersPerDegree
+	dLng := bufferMeters / (metersPerDegree * math.Max(math.Cos(degreesToRadians(maxAbsLat+dLat)), 0.01))
+	min = Point(float32(math.Min(float64(a[0]), float64(b[0]))-dLng), float32(math.Min(float64(a[1]), float64(b[1]))-dLat))
+	max = Point(float32(math.Max(float64(a[0]), float64(b[0]))+dLng), float32(math.Max(float64(a[1]), float64(b[1]))+dLat))
+	return min, max
+}
+
+// ParseGPX returns the points of each track segment and route in a GPX file
+// as a separate line. Lines with fewer than two points are left out.
+func ParseGPX(r io.Reader) ([][][2]float32, error) {
+	type gpxPoint struct {
+		Lat float32 `xml:"lat,attr"`
+		Lon float32 `xml:"lon,attr"`
+	}
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []gpxPoint `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+		Routes []struct {
+			Points []gpxPoint `xml:"rtept"`
+		} `xml:"rte"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLine, err)
+	}
+
+	var lines [][][2]float32
+	addLine := func(points []gpxPoint) {
+		if len(points) < 2 {
+			return
+		}
+		line := make([][2]float32, 0, len(points))
+		for _, p := range points {
+			line = append(line, Point(p.Lon, p.Lat))
+		}
+		lines = append(lines, line)
+	}
+	for _, track := range doc.Tracks {
+		for _, segment := range track.Segments {
+			addLine(segment.Points)
+		}
+	}
+	for _, route := range doc.Routes {
+		addLine(route.Points)
+	}
+	return lines, nil
+}
+
+// ParseGeoJSONLine parses a GeoJSON LineString geometry, or a Feature with
+// one as its geometry.
+func ParseGeoJSONLine(data []byte) ([][2]float32, error) {
+	return parseGeoJSONLine(data, true)
+}
+
+// parseGeoJSONLine is ParseGeoJSONLine, accepting a Feature only if
+// allowFeature so that Features can't be nested.
+func parseGeoJSONLine(data []byte, allowFeature bool) ([][2]float32, error) {
+	var doc struct {
+		Type        string          `json:"type"`
+		Coordinates [][]float64     `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLine, err)
+	}
+	if doc.Type == "Feature" {
+		if !allowFeature {
+			return nil, fmt.Errorf("%w: Feature nested in a Feature", ErrInvalidLine)
+		}
+		return parseGeoJSONLine(doc.Geometry, false)
+	}
+	if doc.Type != "LineString" {
+		return nil, fmt.Errorf("%w: expected LineString, got %q", ErrInvalidLine, doc.Type)
+	}
+
+	line := make([][2]float32, 0, len(doc.Coordinates))
+	for _, c := range doc.Coordinates {
+		if len(c) < 2 {
+			return nil, fmt.Errorf("%w: position must have at least two values", ErrInvalidLine)
+		}
+		line = append(line, Point(float32(c[0]), float32(c[1])))
+	}
+	return line, nil
+}
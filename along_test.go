@@ -0,0 +1,91 @@
+package geograph
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestAlongLine(t *testing.T) {
+	// A line heading east from -3.3,56 for about 12km, with pictures either
+	// side of it
+	subject := openTestStore(t, writeTestDump(t,
+		testRecord(1, -3.1, 56.0005),  // ~55m north, ~12km along
+		testRecord(2, -3.29, 55.9995), // ~55m south, ~620m along
+		testRecord(3, -3.2, 56.01),    // ~1.1km north
+		testRecord(4, -3.289, 56),     // on the line, ~690m along
+		testRecord(5, -3.31, 56),      // before the start
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	line := [][2]float32{Point(-3.3, 56), Point(-3.2, 56), Point(-3.1, 56)}
+	route := [][][2]float32{line}
+
+	hasMore, got, err := subject.AlongLine(route, 100, SubjectIndex, 0, 10)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	var ids []int32
+	for _, pic := range got {
+		ids = append(ids, pic.ID)
+	}
+	assert.Equal(t, []int32{2, 4, 1}, ids)
+	assert.InDelta(t, 622, got[0].MetersAlongLine, 5)
+	assert.InDelta(t, 56, got[0].MetersFromLine, 2)
+	assert.InDelta(t, 12_437, got[2].MetersAlongLine, 20)
+
+	_, got, err = subject.AlongLine(route, 100, SubjectIndex, 500, 10)
+	require.NoError(t, err)
+	ids = nil
+	for _, pic := range got {
+		ids = append(ids, pic.ID)
+	}
+	assert.Equal(t, []int32{2, 1}, ids, "should thin pictures closer than spacing")
+
+	hasMore, got, err = subject.AlongLine(route, 100, SubjectIndex, 0, 2)
+	require.NoError(t, err)
+	assert.True(t, hasMore)
+	assert.Len(t, got, 2)
+
+	// Separate lines aren't joined, so nothing between them matches
+	_, got, err = subject.AlongLine([][][2]float32{line[:2], {Point(-3.1, 55.99), Point(-3.1, 56.01)}}, 100, SubjectIndex, 0, 10)
+	require.NoError(t, err)
+	ids = nil
+	for _, pic := range got {
+		ids = append(ids, pic.ID)
+	}
+	assert.Equal(t, []int32{2, 4, 1}, ids)
+	assert.InDelta(t, 6_218+1_167, got[2].MetersAlongLine, 20)
+
+	_, _, err = subject.AlongLine([][][2]float32{line[:1]}, 100, SubjectIndex, 0, 10)
+	assert.ErrorIs(t, err, ErrInvalidLine)
+	_, _, err = subject.AlongLine([][][2]float32{{Point(-10, 50), Point(10, 60)}}, 100, SubjectIndex, 0, 10)
+	assert.ErrorIs(t, err, ErrInvalidLine, "should reject routes that are too long")
+}
+
+func TestParseLine(t *testing.T) {
+	gpx := `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><trkseg>
+    <trkpt lat="56.0" lon="-3.3"></trkpt>
+    <trkpt lat="56.1" lon="-3.2"></trkpt>
+  </trkseg><trkseg>
+    <trkpt lat="57.0" lon="-4.3"></trkpt>
+    <trkpt lat="57.1" lon="-4.2"></trkpt>
+  </trkseg></trk>
+</gpx>`
+	route, err := ParseGPX(strings.NewReader(gpx))
+	require.NoError(t, err)
+	assert.Equal(t, [][][2]float32{
+		{Point(-3.3, 56), Point(-3.2, 56.1)},
+		{Point(-4.3, 57), Point(-4.2, 57.1)},
+	}, route)
+
+	line, err := ParseGeoJSONLine([]byte(`{"type":"Feature","geometry":{"type":"LineString","coordinates":[[-3.3,56],[-3.2,56.1,100]]}}`))
+	require.NoError(t, err)
+	assert.Equal(t, [][2]float32{Point(-3.3, 56), Point(-3.2, 56.1)}, line)
+
+	_, err = ParseGeoJSONLine([]byte(`{"type":"Point","coordinates":[-3.3,56]}`))
+	assert.ErrorIs(t, err, ErrInvalidLine)
+	_, err = ParseGeoJSONLine([]byte(`{"type":"Feature","geometry":{"type":"Feature","geometry":{"type":"LineString","coordinates":[[-3.3,56],[-3.2,56.1]]}}}`))
+	assert.ErrorIs(t, err, ErrInvalidLine, "should reject nested Features")
+}
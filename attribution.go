@@ -0,0 +1,45 @@
+package geograph
+
+import (
+	"fmt"
+	"html"
+)
+
+const (
+	geographHost = "https://www.geograph.org.uk"
+	licenceName  = "CC BY-SA 2.0"
+	licenceURL   = "https://creativecommons.org/licenses/by-sa/2.0/"
+)
+
+// ImageAttribution is the credit Geograph's licence requires wherever a
+// picture is shown.
+type ImageAttribution struct {
+	Photographer string `json:"photographer"`
+	ProfileURL   string `json:"profile_url"`
+	PhotoURL     string `json:"photo_url"`
+	LicenceName  string `json:"licence_name"`
+	LicenceURL   string `json:"licence_url"`
+	// Text and HTML are ready-to-render credits
+	Text string `json:"text"`
+	HTML string `json:"html"`
+}
+
+// Attribution returns the credit for pic. Geograph pictures are licensed
+// under CC BY-SA 2.0 to the photographer.
+func Attribution(pic *Picture) ImageAttribution {
+	profileURL := fmt.Sprintf("%s/profile/%d", geographHost, pic.UserID)
+	photoURL := fmt.Sprintf("%s/photo/%d", geographHost, pic.ID)
+	return ImageAttribution{
+		Photographer: pic.Realname,
+		ProfileURL:   profileURL,
+		PhotoURL:     photoURL,
+		LicenceName:  licenceName,
+		LicenceURL:   licenceURL,
+		Text: fmt.Sprintf("%s © %s (%s), %s %s",
+			pic.Title, pic.Realname, photoURL, licenceName, licenceURL),
+		HTML: fmt.Sprintf(`<a href="%s">%s</a> &copy; <a href="%s">%s</a>, <a href="%s" rel="license">%s</a>`,
+			photoURL, html.EscapeString(pic.Title),
+			profileURL, html.EscapeString(pic.Realname),
+			licenceURL, licenceName),
+	}
+}
@@ -0,0 +1,16 @@
+package geograph
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAttribution(t *testing.T) {
+	got := Attribution(&Picture{ID: 1234, UserID: 56, Realname: "A & B", Title: "<Loch>"})
+	assert.Equal(t, "A & B", got.Photographer)
+	assert.Equal(t, "https://www.geograph.org.uk/profile/56", got.ProfileURL)
+	assert.Equal(t, "https://www.geograph.org.uk/photo/1234", got.PhotoURL)
+	assert.Equal(t, "CC BY-SA 2.0", got.LicenceName)
+	assert.Equal(t, "<Loch> © A & B (https://www.geograph.org.uk/photo/1234), CC BY-SA 2.0 https://creativecommons.org/licenses/by-sa/2.0/", got.Text)
+	assert.Equal(t, `<a href="https://www.geograph.org.uk/photo/1234">&lt;Loch&gt;</a> &copy; <a href="https://www.geograph.org.uk/profile/56">A &amp; B</a>, <a href="https://creativecommons.org/licenses/by-sa/2.0/" rel="license">CC BY-SA 2.0</a>`, got.HTML)
+}
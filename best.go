@@ -0,0 +1,127 @@
+package geograph
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	// bestCandidates is how many of the nearest pictures in each index are
+	// scored by Best
+	bestCandidates = 32
+	// bestMaxMeters is how far from the target a picture can be and still be
+	// returned by Best
+	bestMaxMeters = 10_000
+	// bestDistanceScale is the distance at which a picture scores half as
+	// well for distance as one at the target
+	bestDistanceScale = 250
+)
+
+// Weights of each part of the score. Distance dominates so that a nearby
+// picture beats a better one further away.
+const (
+	bestDistanceWeight   = 4
+	bestModerationWeight = 2
+	bestResolutionWeight = 1
+	bestRecencyWeight    = 1
+	bestTagWeight        = 0.5
+)
+
+// Best returns the picture that best shows target, scoring the nearest
+// pictures by subject and by viewpoint. It returns ErrNotFound if there are
+// no suitable pictures near target.
+func (s *Store) Best(target [2]float32) (*Picture, error) {
+	now := time.Now()
+
+	seen := make(map[int32]bool)
+	var best *Picture
+	var bestScore float64
+	for _, ty := range []IndexType{SubjectIndex, ViewpointIndex} {
+		page, err := s.index.near(target, ty, bestCandidates, nil, bestMaxMeters)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range page.items {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			pic, err := s.Get(id)
+			if errors.Is(err, ErrNotFound) {
+				// Deleted by a delta applied since the index was read
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			score, ok := scorePicture(pic, target, now)
+			if !ok {
+				continue
+			}
+			if best == nil || score > bestScore || (score == bestScore && pic.ID < best.ID) {
+				best, bestScore = pic, score
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNotFound
+	}
+	return best, nil
+}
+
+// scorePicture scores how well pic shows target, reporting false if it
+// shouldn't be shown at all.
+func scorePicture(pic *Picture, target [2]float32, now time.Time) (float64, bool) {
+	var moderation float64
+	switch pic.ModerationStatus {
+	case "geograph":
+		moderation = 1
+	case "accepted":
+		// Shown on Geograph as "supplemental"
+		moderation = 0.5
+	default:
+		return 0, false
+	}
+
+	meters := haversineDistanceMeters(pic.Subject(), target)
+	if viewpoint, ok := pic.Viewpoint(); ok {
+		meters = min(meters, haversineDistanceMeters(viewpoint, target))
+	}
+	if meters > bestMaxMeters {
+		return 0, false
+	}
+	distance := 1 / (1 + float64(meters)/bestDistanceScale)
+
+	size := pic.OriginalSize()
+	if size == 0 {
+		size = max(pic.Width, pic.Height)
+	}
+	resolution := math.Min(float64(size)/2048, 1)
+
+	var recency float64
+	if taken, ok := pic.TakenAt(); ok {
+		years := now.Sub(taken).Hours() / 24 / 365
+		recency = 1 - math.Min(math.Max(years/30, 0), 1)
+	}
+
+	// Pictures tagged with a geographical context are usually of the
+	// landscape rather than of a detail
+	var tag float64
+	for _, t := range pic.Tags {
+		if t.Prefix == "top" {
+			tag = 1
+			break
+		}
+	}
+
+	score := bestDistanceWeight*distance +
+		bestModerationWeight*moderation +
+		bestResolutionWeight*resolution +
+		bestRecencyWeight*recency +
+		bestTagWeight*tag
+	return score, true
+}
@@ -0,0 +1,50 @@
+package geograph
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func bestTestRecord(id int32, lng, lat float32, status string, originalSize int32, taken string) string {
+	return fmt.Sprintf(`{"gridimage_id":%d,"user_id":1,"realname":"Test User","title":"Picture %d","moderation_status":%q,"imagetaken":%q,"wgs84_long":%f,"wgs84_lat":%f,"width":640,"height":480,"original_width":%d,"original_height":0,"tags":[]}`,
+		id, id, status, taken, lng, lat, originalSize)
+}
+
+func TestBest(t *testing.T) {
+	metaFile := writeTestDump(t,
+		bestTestRecord(1, -3.2, 55.9, "accepted", 0, "2005-01-01"),
+		bestTestRecord(2, -3.2001, 55.9, "geograph", 3000, "2020-06-01"),
+		bestTestRecord(3, -3.2, 55.9, "rejected", 3000, "2023-01-01"),
+		bestTestRecord(4, -3.25, 55.9, "geograph", 3000, "2023-01-01"),
+	)
+	subject := openTestStore(t, metaFile, OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	got, err := subject.Best(Point(-3.2, 55.9))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), got.ID)
+
+	_, err = subject.Best(Point(0, 51))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestScorePicture(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := Point(-3.2, 55.9)
+	score := func(record string) float64 {
+		pic, err := parsePicture([]byte(record))
+		require.NoError(t, err)
+		s, ok := scorePicture(pic, target, now)
+		require.True(t, ok)
+		return s
+	}
+
+	base := score(bestTestRecord(1, -3.2, 55.9, "accepted", 0, ""))
+	assert.Greater(t, score(bestTestRecord(1, -3.2, 55.9, "geograph", 0, "")), base)
+	assert.Greater(t, score(bestTestRecord(1, -3.2, 55.9, "accepted", 2048, "")), base)
+	assert.Greater(t, score(bestTestRecord(1, -3.2, 55.9, "accepted", 0, "2023-01-01")), base)
+	assert.Less(t, score(bestTestRecord(1, -3.21, 55.9, "accepted", 0, "")), base)
+}
@@ -0,0 +1,133 @@
+package geograph
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+var (
+	ErrTooManyClusters = errors.New("too many clusters")
+	ErrInvalidZoom     = errors.New("invalid zoom")
+)
+
+const (
+	// clusterCellsPerTile is how many cells along each side of a tile at the
+	// requested zoom Clusters groups pictures into
+	clusterCellsPerTile = 4
+	// maxClusterCells limits how many cells a request to Clusters can span
+	maxClusterCells = 16_384
+)
+
+// Cluster is a group of pictures near each other.
+type Cluster struct {
+	// Center is the mean position of the pictures.
+	Center [2]float32 `json:"center"`
+	Count  int        `json:"count"`
+	// ID is the picture with the lowest id, to represent the cluster.
+	ID int32 `json:"id"`
+}
+
+// Count returns the number of pictures in [min, max]. It only reads the
+// index, and counts whole nodes of the index within [min, max] at once.
+func (s *Store) Count(min, max [2]float32, index IndexType) int {
+	return s.index.count(min, max, index)
+}
+
+// Clusters groups the pictures in [min, max] into cells of a grid of
+// clusterCellsPerTile cells along each side of a Web Mercator tile at zoom,
+// ordered by cell from the north-west. It only reads the index.
+func (s *Store) Clusters(min, max [2]float32, index IndexType, zoom int) ([]Cluster, error) {
+	if zoom < 0 || zoom > MaxTileZoom {
+		return nil, fmt.Errorf("%w: zoom must be between 0 and %d", ErrInvalidZoom, MaxTileZoom)
+	}
+	minX, maxY := mercatorXY(min, zoom)
+	maxX, minY := mercatorXY(max, zoom)
+	if cells := (maxX - minX) * (maxY - minY) * clusterCellsPerTile * clusterCellsPerTile; cells > maxClusterCells {
+		return nil, fmt.Errorf("%w: zoom out or request a smaller area", ErrTooManyClusters)
+	}
+
+	var out []Cluster
+	s.index.clusters(min, max, index, zoom, clusterCellsPerTile, func(c pointCluster) {
+		out = append(out, Cluster{Center: mercatorLngLat(c.x, c.y, zoom), Count: c.count, ID: c.id})
+	})
+	return out, nil
+}
+
+// pointCluster is a cluster in Web Mercator tile coordinates.
+type pointCluster struct {
+	x, y  float64
+	count int
+	id    int32
+}
+
+// clusters calls fn with the items in [min, max] grouped into cells of a grid
+// of cellsPerTile cells along each side of a tile at zoom z, in order of cell
+// from the north-west. Nodes of the index within a single cell are counted
+// from their summaries, so low zooms don't visit every item.
+func (d *inMemoryIndex) clusters(min, max [2]float32, index IndexType, z int, cellsPerTile int, fn func(pointCluster)) {
+	type cell struct {
+		sumX, sumY float64
+		count      int
+		id         int32
+	}
+	cells := make(map[[2]int64]*cell)
+	scale := math.Exp2(float64(z))
+	cellOf := func(x, y float64) [2]int64 {
+		return [2]int64{int64(math.Floor(x * float64(cellsPerTile))), int64(math.Floor(y * float64(cellsPerTile)))}
+	}
+	add := func(key [2]int64, count int, sumX, sumY float64, id int32) {
+		c, ok := cells[key]
+		if !ok {
+			c = &cell{id: id}
+			cells[key] = c
+		}
+		c.sumX += sumX
+		c.sumY += sumY
+		c.count += count
+		if id < c.id {
+			c.id = id
+		}
+	}
+	addItem := func(id int32, point [2]float32) {
+		x, y := mercatorXY(point, z)
+		add(cellOf(x, y), 1, x, y, id)
+	}
+
+	// Whole nodes of the index within a cell are added without visiting
+	// their items, unless the overlay hides some of them
+	overlay := d.overlay.Load()
+	hidden := overlay.hiddenOf(index)
+	d.of(index).summarize(min, max, func(nodeMin, nodeMax [2]float32, s nodeSummary) bool {
+		minX, maxY := mercatorXY(nodeMin, z)
+		maxX, minY := mercatorXY(nodeMax, z)
+		key := cellOf(minX, minY)
+		if key != cellOf(maxX, maxY) || hidden.count(nodeMin, nodeMax) > 0 {
+			return false
+		}
+		add(key, s.count, s.sumX*scale, s.sumY*scale, s.minID)
+		return true
+	}, func(id int32, point [2]float32) {
+		if !overlay.hides(id) {
+			addItem(id, point)
+		}
+	})
+	overlay.of(index).search(min, max, 0, func(_ int, id int32, point [2]float32) bool {
+		addItem(id, point)
+		return true
+	})
+
+	keys := make([][2]int64, 0, len(cells))
+	for key := range cells {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [2]int64) int {
+		return cmp.Or(cmp.Compare(a[1], b[1]), cmp.Compare(a[0], b[0]))
+	})
+	for _, key := range keys {
+		c := cells[key]
+		fn(pointCluster{x: c.sumX / float64(c.count), y: c.sumY / float64(c.count), count: c.count, id: c.id})
+	}
+}
@@ -0,0 +1,127 @@
+package geograph
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestPackedCount(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var ids []int32
+	var points []float32
+	for i := range 5000 {
+		ids = append(ids, int32(i))
+		points = append(points, rng.Float32()*10-5, rng.Float32()*10+50)
+	}
+	tree := bulkLoad(ids, points)
+
+	for range 100 {
+		a := Point(rng.Float32()*12-6, rng.Float32()*12+49)
+		b := Point(rng.Float32()*12-6, rng.Float32()*12+49)
+		minPt := Point(min(a[0], b[0]), min(a[1], b[1]))
+		maxPt := Point(max(a[0], b[0]), max(a[1], b[1]))
+
+		want := 0
+		tree.search(minPt, maxPt, 0, func(int, int32, [2]float32) bool {
+			want++
+			return true
+		})
+		assert.Equal(t, want, tree.count(minPt, maxPt))
+	}
+	assert.Equal(t, 5000, tree.count(Point(-180, -90), Point(180, 90)))
+}
+
+func TestClustersSummarizeNodes(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var ids []int32
+	var points []float32
+	for i := range 5000 {
+		ids = append(ids, int32(i))
+		points = append(points, rng.Float32()*10-5, rng.Float32()*10+50)
+	}
+	tree := bulkLoad(ids, points)
+	index := newInMemoryIndex(tree, tree)
+	entries := make(map[int32]overlayEntry)
+	for i := range 100 {
+		entries[int32(i*7)] = overlayEntry{deleted: i%2 == 0, subject: Point(rng.Float32()*10-5, rng.Float32()*10+50)}
+	}
+	index.loadOverlay(entries)
+
+	for _, z := range []int{0, 4, 8} {
+		minPt, maxPt := Point(-4, 51), Point(4, 59)
+		type cell struct {
+			sumX, sumY float64
+			count      int
+			id         int32
+		}
+		want := make(map[[2]int64]*cell)
+		index.each(minPt, maxPt, SubjectIndex, func(id int32, point [2]float32) bool {
+			x, y := mercatorXY(point, z)
+			key := [2]int64{int64(math.Floor(x * 16)), int64(math.Floor(y * 16))}
+			c, ok := want[key]
+			if !ok {
+				c = &cell{id: id}
+				want[key] = c
+			}
+			c.sumX, c.sumY, c.count, c.id = c.sumX+x, c.sumY+y, c.count+1, min(c.id, id)
+			return true
+		})
+
+		var got []pointCluster
+		index.clusters(minPt, maxPt, SubjectIndex, z, 16, func(c pointCluster) {
+			got = append(got, c)
+		})
+		require.Len(t, got, len(want), "zoom %d", z)
+		for _, c := range got {
+			w := want[[2]int64{int64(math.Floor(c.x * 16)), int64(math.Floor(c.y * 16))}]
+			require.NotNil(t, w, "zoom %d", z)
+			assert.Equal(t, w.count, c.count)
+			assert.Equal(t, w.id, c.id)
+			assert.InDelta(t, w.sumX/float64(w.count), c.x, 1e-9)
+			assert.InDelta(t, w.sumY/float64(w.count), c.y, 1e-9)
+		}
+	}
+}
+
+func TestCountAndClusters(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		testRecord(1, -3.2, 55.9),
+		testRecord(2, -3.21, 55.91),
+		testRecord(3, -3.19, 55.92),
+		testRecord(4, -0.12, 51.5),
+		testRecord(5, 10, 10),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	uk := [2][2]float32{Point(-8, 49), Point(2, 61)}
+	assert.Equal(t, 4, subject.Count(uk[0], uk[1], SubjectIndex))
+	assert.Equal(t, 0, subject.Count(uk[0], uk[1], ViewpointIndex))
+
+	clusters, err := subject.Clusters(uk[0], uk[1], SubjectIndex, 5)
+	require.NoError(t, err)
+	require.Len(t, clusters, 2)
+	assert.Equal(t, 3, clusters[0].Count)
+	assert.Equal(t, int32(1), clusters[0].ID)
+	assert.InDelta(t, -3.2, clusters[0].Center[0], 1e-3)
+	assert.InDelta(t, 55.91, clusters[0].Center[1], 1e-3)
+	assert.Equal(t, Cluster{Center: Point(-0.12, 51.5), Count: 1, ID: 4}, clusters[1])
+
+	_, err = subject.Clusters(uk[0], uk[1], SubjectIndex, 12)
+	assert.ErrorIs(t, err, ErrTooManyClusters)
+	_, err = subject.Clusters(uk[0], uk[1], SubjectIndex, -1)
+	assert.ErrorIs(t, err, ErrInvalidZoom)
+	_, err = subject.Clusters(uk[0], uk[1], SubjectIndex, MaxTileZoom+1)
+	assert.ErrorIs(t, err, ErrInvalidZoom)
+
+	// Counts include changes from deltas
+	require.NoError(t, subject.ApplyDelta(&Delta{
+		Upserts: []json.RawMessage{json.RawMessage(testRecord(5, -1, 52)), json.RawMessage(testRecord(2, -3.21, 55.91))},
+		Deletes: []int32{1},
+	}))
+	assert.Equal(t, 4, subject.Count(uk[0], uk[1], SubjectIndex))
+	assert.Equal(t, 2, subject.Count(Point(-4, 55), Point(-3, 56), SubjectIndex))
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	geograph "github.com/dzfranklin/plantopo-geograph"
+	"github.com/dzfranklin/plantopo-geograph/gridref"
 	"github.com/tidwall/sjson"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,32 +20,77 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var serverHost string
 var imageSecret []byte
-var store *geograph.Store
+var dataDir string
+var adminToken string
 
 func main() {
 	addr := "0.0.0.0:8080"
 	imageSecret = []byte(geograph.GetEnvString("IMAGE_SECRET"))
-	metaFile := geograph.GetEnvString("META_FILE")
 	serverHost = geograph.GetEnvString("HOST")
+	dataDir = os.Getenv("DATA_DIR")
+	adminToken = os.Getenv("ADMIN_TOKEN")
 
-	store = geograph.Open(metaFile)
-	defer func() {
-		if err := store.Close(); err != nil {
-			slog.Error("error closing store", "error", err)
+	src := storeSource{snapshotFile: os.Getenv("SNAPSHOT_FILE")}
+	if src.snapshotFile == "" {
+		src.metaFile = geograph.GetEnvString("META_FILE")
+	}
+	currentSource = src
+
+	var reloadInterval time.Duration
+	if v := os.Getenv("RELOAD_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			panic("invalid RELOAD_INTERVAL: " + err.Error())
+		}
+		reloadInterval = interval
+	}
+
+	// Serve status while the store loads so that probes can report progress
+	go func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		store, err := src.open(context.Background(), currentLoad.report)
+		if err != nil {
+			slog.Error("failed to open store", "source", src.String(), "error", err)
+			os.Exit(1)
+		}
+		swapStore(store)
+		currentLoad.setReady(store.Version())
+		slog.Info("store ready", "version", store.Version())
+
+		if reloadInterval != 0 {
+			go reloadPeriodically(reloadInterval)
 		}
 	}()
+	defer closeStore()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = w.Write([]byte("OK"))
-	})
+	mux.HandleFunc("GET /status", handleLive)
+	mux.HandleFunc("GET /status/live", handleLive)
+	mux.HandleFunc("GET /status/ready", handleReady)
 	mux.HandleFunc("GET /v1/gridimage/{id}", handleGetByID)
 	mux.HandleFunc("GET /v1/within", handleGetWithin)
 	mux.HandleFunc("GET /v1/near", handleGetNear)
+	mux.HandleFunc("GET /v1/best", handleGetBest)
+	mux.HandleFunc("POST /v1/along", handlePostAlong)
+	mux.HandleFunc("POST /v1/within-geometry", handlePostWithinGeometry)
+	mux.HandleFunc("GET /v1/users/{id}/pictures", handleGetUserPictures)
+	mux.HandleFunc("GET /v1/gridsquare/{ref}", handleGetGridSquare)
+	mux.HandleFunc("GET /v1/search", handleGetSearch)
+	mux.HandleFunc("GET /v1/tags/autocomplete", handleGetTagsAutocomplete)
+	mux.HandleFunc("GET /v1/facets", handleGetFacets)
+	mux.HandleFunc("GET /v1/clusters", handleGetClusters)
+	mux.HandleFunc("GET /v1/tiles.json", handleGetTileJSON)
+	mux.HandleFunc("GET /v1/tiles/{z}/{x}/{y}", handleGetTile)
+	mux.HandleFunc("GET /v1/export", handleGetExport)
+	mux.HandleFunc("POST /v1/export", handlePostExport)
+	mux.HandleFunc("POST /admin/reload", handleReload)
 
 	shutdownSig := make(chan os.Signal, 1)
 	signal.Notify(shutdownSig, syscall.SIGINT, syscall.SIGTERM)
@@ -73,7 +124,14 @@ func handleGetByID(w http.ResponseWriter, r *http.Request) {
 
 	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
 
-	meta, err := store.Get(int32(id))
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	pic, err := store.Get(int32(id))
 	if errors.Is(err, geograph.ErrNotFound) {
 		respondErr(w, http.StatusNotFound)
 		return
@@ -82,30 +140,75 @@ func handleGetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	value, err := setImageSrc(meta, forBatchProcessing)
+	value, err := setImageSrc(pic, forBatchProcessing)
 	if err != nil {
 		respondISE(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(value))
+	_, _ = w.Write(value)
 }
 
 func handleGetWithin(w http.ResponseWriter, r *http.Request) {
-	minPoint, ok := getReqPoint(w, r, "min")
+	minPoint, maxPoint, ok := getReqBounds(w, r)
+	if !ok {
+		return
+	}
+	pageSize, ok := getReqPageSize(w, r, 100)
+	if !ok {
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	filter, ok := getReqFilter(w, r)
+	if !ok {
+		return
+	}
+	bySubject := getReqOptBool(r, "by_subject")
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	var index = geograph.ViewpointIndex
+	if bySubject {
+		index = geograph.SubjectIndex
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.Within(minPoint, maxPoint, index, pageSize, cursor, filter)
+	if errors.Is(err, geograph.ErrInvalidCursor) {
+		respondBadReq(w, err.Error())
+		return
+	} else if errors.Is(err, geograph.ErrStaleCursor) {
+		http.Error(w, "Gone: "+err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+func handleGetNear(w http.ResponseWriter, r *http.Request) {
+	targetPoint, ok := getReqTarget(w, r)
 	if !ok {
 		return
 	}
-	maxPoint, ok := getReqPoint(w, r, "max")
+	pageSize, ok := getReqPageSize(w, r, 10)
 	if !ok {
 		return
 	}
-	pageSize, ok := getReqOptInt(w, r, "page_size", 100)
+	cursor := r.URL.Query().Get("cursor")
+	maxMeters, ok := getReqOptInt(w, r, "max_meters", 0)
 	if !ok {
 		return
 	}
-	cursor, ok := getReqOptInt(w, r, "cursor", 0)
+	filter, ok := getReqFilter(w, r)
 	if !ok {
 		return
 	}
@@ -117,86 +220,690 @@ func handleGetWithin(w http.ResponseWriter, r *http.Request) {
 		index = geograph.SubjectIndex
 	}
 
-	hasNext, nextCursor, pictures, err := store.Within(minPoint, maxPoint, index, pageSize, cursor)
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.Near(targetPoint, index, pageSize, cursor, float64(maxMeters), filter)
+	if errors.Is(err, geograph.ErrInvalidCursor) {
+		respondBadReq(w, err.Error())
+		return
+	} else if errors.Is(err, geograph.ErrStaleCursor) {
+		http.Error(w, "Gone: "+err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+func handleGetBest(w http.ResponseWriter, r *http.Request) {
+	targetPoint, ok := getReqTarget(w, r)
+	if !ok {
+		return
+	}
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	pic, err := store.Best(targetPoint)
+	if errors.Is(err, geograph.ErrNotFound) {
+		respondErr(w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	value, err := setImageSrc(pic, forBatchProcessing)
 	if err != nil {
 		respondISE(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(value)
+}
+
+const (
+	maxBodyBytes         = 5 << 20
+	maxAlongVertices     = 10_000
+	maxAlongBufferMeters = 2_000
+	maxGeometryVertices  = 100_000
+)
+
+// handlePostAlong returns the pictures near a route posted as a GPX file or a
+// GeoJSON LineString, ordered along the route.
+func handlePostAlong(w http.ResponseWriter, r *http.Request) {
+	bufferMeters, ok := getReqOptInt(w, r, "buffer_meters", 100)
+	if !ok {
+		return
+	}
+	if bufferMeters <= 0 || bufferMeters > maxAlongBufferMeters {
+		respondBadReq(w, fmt.Sprintf("parameter buffer_meters should be between 1 and %d", maxAlongBufferMeters))
+		return
+	}
+	spacingMeters, ok := getReqOptInt(w, r, "spacing_meters", 0)
+	if !ok {
+		return
+	}
+	limit, ok := getReqLimit(w, r, maxPageSize)
+	if !ok {
+		return
+	}
+	bySubject := getReqOptBool(r, "by_subject")
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	var index = geograph.ViewpointIndex
+	if bySubject {
+		index = geograph.SubjectIndex
+	}
+
+	body, ok := readReqBody(w, r)
+	if !ok {
+		return
+	}
+
+	var route [][][2]float32
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/gpx+xml" || strings.HasSuffix(mediaType, "/xml"):
+		route, err = geograph.ParseGPX(bytes.NewReader(body))
+	case mediaType == "application/geo+json" || strings.HasSuffix(mediaType, "/json"):
+		var line [][2]float32
+		line, err = geograph.ParseGeoJSONLine(body)
+		route = [][][2]float32{line}
+	default:
+		respondErr(w, http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		respondBadReq(w, err.Error())
+		return
+	}
+	vertices := 0
+	for _, line := range route {
+		vertices += len(line)
+	}
+	if vertices > maxAlongVertices {
+		respondBadReq(w, fmt.Sprintf("line should have at most %d points", maxAlongVertices))
+		return
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasMore, pictures, err := store.AlongLine(route, float64(bufferMeters), index, float64(spacingMeters), limit)
+	if errors.Is(err, geograph.ErrInvalidLine) {
+		respondBadReq(w, err.Error())
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	geoJSON, ok := getReqWantsGeoJSON(w, r)
+	if !ok {
+		return
+	} else if geoJSON {
+		respondFeatureCollection(w, r, "", pictures, forBatchProcessing)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	out := struct {
 		Pictures []json.RawMessage `json:"pictures"`
-		Next     *string           `json:"next"`
-	}{}
+		// HasMore is set if pictures further along the route were left out
+		// by limit
+		HasMore bool `json:"has_more"`
+	}{Pictures: make([]json.RawMessage, 0, len(pictures)), HasMore: hasMore}
 
-	for _, meta := range pictures {
-		value, err := setImageSrc(meta, forBatchProcessing)
+	for _, pic := range pictures {
+		value, err := setImageSrc(pic, forBatchProcessing)
 		if err != nil {
 			respondISE(w, err)
 			return
 		}
-		out.Pictures = append(out.Pictures, []byte(value))
+		out.Pictures = append(out.Pictures, value)
 	}
 
-	if hasNext {
-		nextURL := copyURLWithCursor(r.URL, nextCursor).String()
-		out.Next = &nextURL
+	outJSON, err := json.Marshal(out)
+	if err != nil {
+		respondISE(w, err)
+		return
 	}
+	_, _ = w.Write(outJSON)
+}
 
-	outJSON, err := json.Marshal(out)
+// handlePostWithinGeometry pages through the pictures inside a posted GeoJSON
+// Polygon or MultiPolygon. The next page is requested by posting the same
+// geometry to the next URL.
+func handlePostWithinGeometry(w http.ResponseWriter, r *http.Request) {
+	pageSize, ok := getReqPageSize(w, r, 100)
+	if !ok {
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	filter, ok := getReqFilter(w, r)
+	if !ok {
+		return
+	}
+	bySubject := getReqOptBool(r, "by_subject")
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	var index = geograph.ViewpointIndex
+	if bySubject {
+		index = geograph.SubjectIndex
+	}
+
+	body, ok := readReqBody(w, r)
+	if !ok {
+		return
+	}
+	area, err := geograph.ParseGeoJSONPolygon(body)
+	if err != nil {
+		respondBadReq(w, err.Error())
+		return
+	}
+	if area.VertexCount() > maxGeometryVertices {
+		respondBadReq(w, fmt.Sprintf("geometry should have at most %d points", maxGeometryVertices))
+		return
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.WithinPolygon(area, index, pageSize, cursor, filter)
+	if errors.Is(err, geograph.ErrInvalidCursor) || errors.Is(err, geograph.ErrInvalidPolygon) {
+		respondBadReq(w, err.Error())
+		return
+	} else if errors.Is(err, geograph.ErrStaleCursor) {
+		http.Error(w, "Gone: "+err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+func handleGetUserPictures(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 32)
+	if err != nil {
+		respondErr(w, http.StatusNotFound)
+		return
+	}
+	pageSize, ok := getReqPageSize(w, r, 100)
+	if !ok {
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.ByUser(int32(userID), pageSize, cursor)
+	if errors.Is(err, geograph.ErrInvalidCursor) {
+		respondBadReq(w, err.Error())
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+// handleGetGridSquare pages through the pictures in a myriad, hectad or grid
+// square. More precise references are taken as the grid square containing
+// them.
+func handleGetGridSquare(w http.ResponseWriter, r *http.Request) {
+	ref, err := gridref.Parse(r.PathValue("ref"))
 	if err != nil {
+		respondBadReq(w, err.Error())
+		return
+	}
+	if ref.Digits > 2 {
+		ref, err = gridref.At(ref.Grid, float64(ref.Easting), float64(ref.Northing), 2)
+		if err != nil {
+			respondBadReq(w, err.Error())
+			return
+		}
+	}
+	pageSize, ok := getReqPageSize(w, r, 100)
+	if !ok {
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.InGridSquare(ref.String(), pageSize, cursor)
+	if errors.Is(err, geograph.ErrInvalidCursor) || errors.Is(err, geograph.ErrInvalidGridRef) {
+		respondBadReq(w, err.Error())
+		return
+	} else if err != nil {
 		respondISE(w, err)
 		return
 	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+func handleGetSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		respondBadReq(w, "parameter q required")
+		return
+	}
+	pageSize, ok := getReqPageSize(w, r, 20)
+	if !ok {
+		return
+	}
+	opts := geograph.SearchOptions{MaxItems: pageSize, Cursor: r.URL.Query().Get("cursor")}
+	if r.URL.Query().Has("min") || r.URL.Query().Has("max") || r.URL.Query().Has("gridref") {
+		opts.Bounded = true
+		if opts.Min, opts.Max, ok = getReqBounds(w, r); !ok {
+			return
+		}
+	}
+	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hasNext, nextCursor, pictures, err := store.Search(query, opts)
+	if errors.Is(err, geograph.ErrInvalidCursor) || errors.Is(err, geograph.ErrInvalidQuery) {
+		respondBadReq(w, err.Error())
+		return
+	} else if errors.Is(err, geograph.ErrStaleCursor) {
+		http.Error(w, "Gone: "+err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	respondPage(w, r, hasNext, nextCursor, pictures, forBatchProcessing)
+}
+
+func handleGetTagsAutocomplete(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	limit, ok := getReqLimit(w, r, 10)
+	if !ok {
+		return
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	tags, err := store.AutocompleteTags(q, limit)
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	outJSON, err := json.Marshal(struct {
+		Tags []geograph.TagCount `json:"tags"`
+	}{tags})
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(outJSON)
 }
 
-func handleGetNear(w http.ResponseWriter, r *http.Request) {
-	targetPoint, ok := getReqPoint(w, r, "target")
+func handleGetFacets(w http.ResponseWriter, r *http.Request) {
+	minPoint, maxPoint, ok := getReqBounds(w, r)
 	if !ok {
 		return
 	}
-	pageSize, ok := getReqOptInt(w, r, "page_size", 10)
+	limit, ok := getReqLimit(w, r, 10)
 	if !ok {
 		return
 	}
-	cursor, ok := getReqOptInt(w, r, "cursor", 0)
+	bySubject := getReqOptBool(r, "by_subject")
+
+	var index = geograph.ViewpointIndex
+	if bySubject {
+		index = geograph.SubjectIndex
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	facets, err := store.Facets(minPoint, maxPoint, index, limit)
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	outJSON, err := json.Marshal(facets)
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(outJSON)
+}
+
+func handleGetClusters(w http.ResponseWriter, r *http.Request) {
+	minPoint, maxPoint, ok := getReqBounds(w, r)
+	if !ok {
+		return
+	}
+	zoom, ok := getReqOptInt(w, r, "zoom", 0)
 	if !ok {
 		return
 	}
 	bySubject := getReqOptBool(r, "by_subject")
-	forBatchProcessing := getReqOptBool(r, "for_batch_processing")
 
 	var index = geograph.ViewpointIndex
 	if bySubject {
 		index = geograph.SubjectIndex
 	}
 
-	hasNext, nextCursor, pictures, err := store.Near(targetPoint, index, pageSize, cursor)
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	clusters, err := store.Clusters(minPoint, maxPoint, index, zoom)
+	if errors.Is(err, geograph.ErrTooManyClusters) || errors.Is(err, geograph.ErrInvalidZoom) {
+		respondBadReq(w, err.Error())
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	out := struct {
+		Count    int                `json:"count"`
+		Clusters []geograph.Cluster `json:"clusters"`
+	}{Count: store.Count(minPoint, maxPoint, index), Clusters: clusters}
+	if out.Clusters == nil {
+		out.Clusters = []geograph.Cluster{}
+	}
+
+	outJSON, err := json.Marshal(out)
 	if err != nil {
 		respondISE(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(outJSON)
+}
+
+// handleGetTileJSON describes the tiles, linking to the tiles of the current
+// dataset version so that they can be cached indefinitely.
+func handleGetTileJSON(w http.ResponseWriter, r *http.Request) {
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
 
+	fields := map[string]string{
+		"id":          "Number",
+		"title":       "String",
+		"thumbnail":   "String",
+		"cluster":     "Boolean",
+		"point_count": "Number",
+	}
+	tileURL := url.URL{
+		Scheme:   "https",
+		Host:     serverHost,
+		Path:     "/v1/tiles/{z}/{x}/{y}.mvt",
+		RawQuery: url.Values{"v": {store.Version()}}.Encode(),
+	}
+	outJSON, err := json.Marshal(map[string]any{
+		"tilejson": "3.0.0",
+		// Not escaped so that clients can substitute the placeholders
+		"tiles":   []string{strings.NewReplacer("%7B", "{", "%7D", "}").Replace(tileURL.String())},
+		"minzoom": 0,
+		"maxzoom": geograph.MaxTileZoom,
+		"vector_layers": []map[string]any{
+			{"id": "subject", "fields": fields},
+			{"id": "viewpoint", "fields": fields},
+		},
+	})
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	_, _ = w.Write(outJSON)
+}
+
+func handleGetTile(w http.ResponseWriter, r *http.Request) {
+	z, zErr := strconv.Atoi(r.PathValue("z"))
+	x, xErr := strconv.Atoi(r.PathValue("x"))
+	yValue, ok := strings.CutSuffix(r.PathValue("y"), ".mvt")
+	y, yErr := strconv.Atoi(yValue)
+	if zErr != nil || xErr != nil || yErr != nil || !ok || geograph.ValidateTile(z, x, y) != nil {
+		respondErr(w, http.StatusNotFound)
+		return
+	}
+
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	// Tiles only change with the dataset version. Requests for a particular
+	// version, as linked to by the TileJSON, can be cached indefinitely.
+	version := store.Version()
+	gzipped := getReqAcceptsGzip(r)
+	etag := `"` + version + `"`
+	if gzipped {
+		etag = `"` + version + `-gzip"`
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	if getReqETagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	tile, err := store.Tile(z, x, y, imageSecret)
+	if errors.Is(err, geograph.ErrInvalidTile) {
+		respondErr(w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzW := gzip.NewWriter(w)
+		_, _ = gzW.Write(tile)
+		_ = gzW.Close()
+		return
+	}
+	_, _ = w.Write(tile)
+}
+
+const maxExportPictures = 50_000
+
+// handleGetExport responds with a region pack of the box [min, max].
+func handleGetExport(w http.ResponseWriter, r *http.Request) {
+	minPoint, maxPoint, ok := getReqBounds(w, r)
+	if !ok {
+		return
+	}
+	respondRegionPack(w, r, geograph.BoxPolygon(minPoint, maxPoint))
+}
+
+// handlePostExport responds with a region pack of a posted GeoJSON Polygon or
+// MultiPolygon.
+func handlePostExport(w http.ResponseWriter, r *http.Request) {
+	body, ok := readReqBody(w, r)
+	if !ok {
+		return
+	}
+	area, err := geograph.ParseGeoJSONPolygon(body)
+	if err != nil {
+		respondBadReq(w, err.Error())
+		return
+	}
+	if area.VertexCount() > maxGeometryVertices {
+		respondBadReq(w, fmt.Sprintf("geometry should have at most %d points", maxGeometryVertices))
+		return
+	}
+	respondRegionPack(w, r, area)
+}
+
+func respondRegionPack(w http.ResponseWriter, r *http.Request, area geograph.MultiPolygon) {
+	store, release, ok := acquireStore()
+	if !ok {
+		respondErr(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	// The pack is streamed, so only errors before it starts can be reported
+	pack := &regionPackWriter{w: w, gzip: getReqAcceptsGzip(r)}
+	opts := geograph.RegionPackOptions{ImageSecret: imageSecret, MaxPictures: maxExportPictures}
+	err := store.ExportRegion(pack, area, opts)
+	if err != nil && pack.started {
+		slog.Error("failed to stream region pack", "error", err)
+		return
+	} else if errors.Is(err, geograph.ErrInvalidPolygon) || errors.Is(err, geograph.ErrRegionTooLarge) {
+		respondBadReq(w, err.Error())
+		return
+	} else if err != nil {
+		respondISE(w, err)
+		return
+	}
+	if err := pack.Close(); err != nil {
+		slog.Error("failed to stream region pack", "error", err)
+	}
+}
+
+// regionPackWriter writes the response headers of a region pack on the first
+// write, so that errors before then can still be responded with.
+type regionPackWriter struct {
+	w       http.ResponseWriter
+	gzip    bool
+	started bool
+	out     io.Writer
+	gzW     *gzip.Writer
+}
+
+func (pw *regionPackWriter) Write(p []byte) (int, error) {
+	if !pw.started {
+		pw.started = true
+		pw.w.Header().Set("Content-Type", "application/vnd.plantopo.geograph-region-pack")
+		pw.w.Header().Set("Content-Disposition", `attachment; filename="region.ggrp"`)
+		pw.w.Header().Set("Vary", "Accept-Encoding")
+		pw.out = pw.w
+		if pw.gzip {
+			pw.w.Header().Set("Content-Encoding", "gzip")
+			pw.gzW = gzip.NewWriter(pw.w)
+			pw.out = pw.gzW
+		}
+	}
+	return pw.out.Write(p)
+}
+
+func (pw *regionPackWriter) Close() error {
+	if pw.gzW != nil {
+		return pw.gzW.Close()
+	}
+	return nil
+}
+
+// respondPage writes a page of pictures with the URL of the next page, if
+// any, as a GeoJSON FeatureCollection if requested with format=geojson or an
+// Accept header.
+func respondPage(w http.ResponseWriter, r *http.Request, hasNext bool, nextCursor string, pictures []*geograph.Picture, forBatchProcessing bool) {
+	var nextURL string
+	if hasNext {
+		nextURL = copyURLWithCursor(r.URL, nextCursor).String()
+	}
+
+	w.Header().Set("Vary", "Accept")
+	geoJSON, ok := getReqWantsGeoJSON(w, r)
+	if !ok {
+		return
+	} else if geoJSON {
+		respondFeatureCollection(w, r, nextURL, pictures, forBatchProcessing)
+		return
+	}
 
 	out := struct {
 		Pictures []json.RawMessage `json:"pictures"`
 		Next     *string           `json:"next"`
 	}{}
 
-	for _, meta := range pictures {
-		value, err := setImageSrc(meta, forBatchProcessing)
+	for _, pic := range pictures {
+		value, err := setImageSrc(pic, forBatchProcessing)
 		if err != nil {
 			respondISE(w, err)
 			return
 		}
-		out.Pictures = append(out.Pictures, []byte(value))
+		out.Pictures = append(out.Pictures, value)
 	}
 
 	if hasNext {
-		nextURL := copyURLWithCursor(r.URL, nextCursor).String()
 		out.Next = &nextURL
 	}
 
@@ -205,12 +912,62 @@ func handleGetNear(w http.ResponseWriter, r *http.Request) {
 		respondISE(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(outJSON)
 }
 
-func setImageSrc(meta string, forBatchProcessing bool) (string, error) {
-	src := geograph.GetImageSrc(imageSecret, meta, forBatchProcessing)
-	return sjson.Set(meta, "src", src)
+type geoJSONLink struct {
+	Href string `json:"href"`
+	Rel  string `json:"rel"`
+	Type string `json:"type"`
+}
+
+// respondFeatureCollection responds with pictures as GeoJSON Point features
+// at the index the request used, each followed by a sight line from its
+// viewpoint to its subject if sight_lines is set.
+func respondFeatureCollection(w http.ResponseWriter, r *http.Request, nextURL string, pictures []*geograph.Picture, forBatchProcessing bool) {
+	var index = geograph.ViewpointIndex
+	if getReqOptBool(r, "by_subject") {
+		index = geograph.SubjectIndex
+	}
+	sightLines := getReqOptBool(r, "sight_lines")
+
+	out := struct {
+		Type     string             `json:"type"`
+		Features []geograph.Feature `json:"features"`
+		Links    []geoJSONLink      `json:"links"`
+	}{Type: "FeatureCollection", Features: make([]geograph.Feature, 0, len(pictures)), Links: []geoJSONLink{}}
+
+	for _, pic := range pictures {
+		value, err := setImageSrc(pic, forBatchProcessing)
+		if err != nil {
+			respondISE(w, err)
+			return
+		}
+		out.Features = append(out.Features, geograph.PictureFeatures(pic, index, sightLines, value)...)
+	}
+
+	if nextURL != "" {
+		out.Links = append(out.Links, geoJSONLink{Href: nextURL, Rel: "next", Type: "application/geo+json"})
+	}
+
+	outJSON, err := json.Marshal(out)
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	_, _ = w.Write(outJSON)
+}
+
+// setImageSrc returns pic with the src and attribution added.
+func setImageSrc(pic *geograph.Picture, forBatchProcessing bool) ([]byte, error) {
+	src := geograph.GetImageSrc(imageSecret, pic, forBatchProcessing)
+	value, err := sjson.SetBytes(pic.Raw(), "src", src)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetBytes(value, "attribution", geograph.Attribution(pic))
 }
 
 func getReqPoint(w http.ResponseWriter, r *http.Request, param string) ([2]float32, bool) {
@@ -238,6 +995,117 @@ func getReqPoint(w http.ResponseWriter, r *http.Request, param string) ([2]float
 	return [2]float32{float32(lng), float32(lat)}, true
 }
 
+// getReqTarget returns the target parameter, or else the center of the
+// square of the gridref parameter.
+func getReqTarget(w http.ResponseWriter, r *http.Request) ([2]float32, bool) {
+	if !r.URL.Query().Has("gridref") {
+		return getReqPoint(w, r, "target")
+	}
+	ref, ok := getReqGridRef(w, r)
+	if !ok {
+		return [2]float32{}, false
+	}
+	lng, lat := ref.LngLat()
+	return geograph.Point(float32(lng), float32(lat)), true
+}
+
+// getReqBounds returns the min and max parameters, or else the bounds of the
+// square of the gridref parameter.
+func getReqBounds(w http.ResponseWriter, r *http.Request) ([2]float32, [2]float32, bool) {
+	if !r.URL.Query().Has("gridref") {
+		minPoint, ok := getReqPoint(w, r, "min")
+		if !ok {
+			return [2]float32{}, [2]float32{}, false
+		}
+		maxPoint, ok := getReqPoint(w, r, "max")
+		if !ok {
+			return [2]float32{}, [2]float32{}, false
+		}
+		return minPoint, maxPoint, true
+	}
+	ref, ok := getReqGridRef(w, r)
+	if !ok {
+		return [2]float32{}, [2]float32{}, false
+	}
+	minLngLat, maxLngLat := ref.Bounds()
+	return geograph.Point(float32(minLngLat[0]), float32(minLngLat[1])),
+		geograph.Point(float32(maxLngLat[0]), float32(maxLngLat[1])), true
+}
+
+func getReqGridRef(w http.ResponseWriter, r *http.Request) (gridref.Ref, bool) {
+	ref, err := gridref.Parse(r.URL.Query().Get("gridref"))
+	if err != nil {
+		respondBadReq(w, "parameter gridref should be an OSGB or Irish grid reference (like NT2573 or J3374)")
+		return gridref.Ref{}, false
+	}
+	return ref, true
+}
+
+func readReqBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondErr(w, http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		respondBadReq(w, err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// getReqFilter parses the attribute filter parameters shared by the queries.
+func getReqFilter(w http.ResponseWriter, r *http.Request) (geograph.Filter, bool) {
+	q := r.URL.Query()
+	// tag may have a prefix, like top:Rivers
+	tag := geograph.ParseTag(q.Get("tag"))
+	filter := geograph.Filter{
+		ModerationStatus: q.Get("moderation_status"),
+		Tag:              tag.Tag,
+		TagPrefix:        tag.Prefix,
+		HasViewpoint:     getReqOptBool(r, "has_viewpoint"),
+	}
+	if prefix := q.Get("tag_prefix"); prefix != "" {
+		filter.TagPrefix = strings.TrimSuffix(prefix, ":")
+	}
+
+	var ok bool
+	if filter.TakenAfter, ok = getReqOptDate(w, r, "taken_after"); !ok {
+		return filter, false
+	}
+	if filter.TakenBefore, ok = getReqOptDate(w, r, "taken_before"); !ok {
+		return filter, false
+	}
+	userID, ok := getReqOptInt(w, r, "user_id", 0)
+	if !ok {
+		return filter, false
+	}
+	filter.UserID = int32(userID)
+	minSize, ok := getReqOptInt(w, r, "min_size", 0)
+	if !ok {
+		return filter, false
+	}
+	filter.MinSize = int32(minSize)
+
+	return filter, true
+}
+
+func getReqOptDate(w http.ResponseWriter, r *http.Request, param string) (time.Time, bool) {
+	s := r.URL.Query().Get(param)
+	if s == "" {
+		return time.Time{}, true
+	}
+
+	v, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		respondBadReq(w, fmt.Sprintf("parameter %s should be a date YYYY-MM-DD", param))
+		return time.Time{}, false
+	}
+
+	return v, true
+}
+
 func getReqOptInt(w http.ResponseWriter, r *http.Request, param string, defaultVal int) (int, bool) {
 	s := r.URL.Query().Get(param)
 	if s == "" {
@@ -253,6 +1121,101 @@ func getReqOptInt(w http.ResponseWriter, r *http.Request, param string, defaultV
 	return int(v), true
 }
 
+// maxPageSize is the largest page_size or limit accepted.
+const maxPageSize = 1000
+
+func getReqPageSize(w http.ResponseWriter, r *http.Request, defaultVal int) (int, bool) {
+	v, ok := getReqOptInt(w, r, "page_size", defaultVal)
+	if !ok {
+		return 0, false
+	}
+	if v < 1 || v > maxPageSize {
+		respondBadReq(w, fmt.Sprintf("parameter page_size should be between 1 and %d", maxPageSize))
+		return 0, false
+	}
+	return v, true
+}
+
+func getReqLimit(w http.ResponseWriter, r *http.Request, defaultVal int) (int, bool) {
+	v, ok := getReqOptInt(w, r, "limit", defaultVal)
+	if !ok {
+		return 0, false
+	}
+	if v < 1 || v > maxPageSize {
+		respondBadReq(w, fmt.Sprintf("parameter limit should be between 1 and %d", maxPageSize))
+		return 0, false
+	}
+	return v, true
+}
+
+// getReqWantsGeoJSON reports whether the response should be GeoJSON, from the
+// format parameter or else the Accept header.
+func getReqWantsGeoJSON(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.URL.Query().Get("format") {
+	case "geojson":
+		return true, true
+	case "json":
+		return false, true
+	case "":
+	default:
+		respondBadReq(w, "parameter format should be json or geojson")
+		return false, false
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		if mediaType == "application/geo+json" {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// getReqAcceptsGzip reports whether the Accept-Encoding header allows a gzip
+// response, ignoring codings with a q-value of 0.
+func getReqAcceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, accept := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(accept, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// getReqETagMatches reports whether the If-None-Match header matches etag,
+// using the weak comparison RFC 9110 requires for it.
+func getReqETagMatches(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func getReqOptBool(r *http.Request, param string) bool {
 	s := r.URL.Query().Get(param)
 	if s == "" || s == "false" || s == "f" {
@@ -261,13 +1224,13 @@ func getReqOptBool(r *http.Request, param string) bool {
 	return true
 }
 
-func copyURLWithCursor(url *url.URL, cursor int) *url.URL {
+func copyURLWithCursor(url *url.URL, cursor string) *url.URL {
 	u := *url
 	u.Scheme = "https"
 	u.Host = serverHost
 
 	q := u.Query()
-	q.Set("cursor", strconv.Itoa(cursor))
+	q.Set("cursor", cursor)
 	u.RawQuery = q.Encode()
 
 	return &u
@@ -283,9 +1246,15 @@ func applyCORS(next http.Handler) http.Handler {
 			strings.HasPrefix(origin, "http://localhost:") ||
 			strings.HasPrefix(origin, "https://localhost:") {
 
-			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
 			next.ServeHTTP(w, r)
 		} else {
 			http.Error(w, "Invalid Origin header", http.StatusForbidden)
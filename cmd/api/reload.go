@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	geograph "github.com/dzfranklin/plantopo-geograph"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// storeHandle tracks the requests using a store so that it can be closed once
+// they have finished after a reload has swapped it out.
+type storeHandle struct {
+	store    *geograph.Store
+	inFlight sync.WaitGroup
+}
+
+var storeMu sync.RWMutex
+var currentStore *storeHandle
+
+// reloadMu is held while a reload is in progress
+var reloadMu sync.Mutex
+var currentSource storeSource
+
+type storeSource struct {
+	metaFile     string
+	snapshotFile string
+}
+
+func (src storeSource) open(ctx context.Context, progress func(geograph.LoadProgress)) (*geograph.Store, error) {
+	opts := geograph.OpenOptions{DataDir: dataDir, Progress: progress}
+	if src.snapshotFile != "" {
+		return geograph.OpenSnapshot(ctx, src.snapshotFile, opts)
+	}
+	return geograph.Open(ctx, src.metaFile, opts)
+}
+
+func (src storeSource) String() string {
+	if src.snapshotFile != "" {
+		return "snapshot " + src.snapshotFile
+	}
+	return src.metaFile
+}
+
+// acquireStore returns the current store, which stays open until release is
+// called. It reports false if no store has been opened yet.
+func acquireStore() (*geograph.Store, func(), bool) {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	h := currentStore
+	if h == nil {
+		return nil, nil, false
+	}
+	h.inFlight.Add(1)
+	return h.store, h.inFlight.Done, true
+}
+
+// swapStore makes next the current store and closes the previous one once the
+// requests using it have finished.
+func swapStore(next *geograph.Store) {
+	storeMu.Lock()
+	prev := currentStore
+	currentStore = &storeHandle{store: next}
+	storeMu.Unlock()
+
+	if prev == nil {
+		return
+	}
+	go func() {
+		prev.inFlight.Wait()
+		if err := prev.store.Close(); err != nil {
+			slog.Error("error closing previous store", "error", err)
+		}
+	}()
+}
+
+func closeStore() {
+	storeMu.Lock()
+	h := currentStore
+	storeMu.Unlock()
+
+	if h == nil {
+		return
+	}
+	h.inFlight.Wait()
+	if err := h.store.Close(); err != nil {
+		slog.Error("error closing store", "error", err)
+	}
+}
+
+// reload opens src in the background and swaps it in. It must be called with
+// reloadMu held.
+func reload(src storeSource) error {
+	start := time.Now()
+	slog.Info("reloading store", "source", src.String())
+	next, err := src.open(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	swapStore(next)
+	currentSource = src
+	currentLoad.setReady(next.Version())
+	slog.Info("reloaded store", "version", next.Version(), "duration", time.Since(start))
+	return nil
+}
+
+func reloadPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloadMu.Lock()
+		if err := reload(currentSource); err != nil {
+			slog.Error("scheduled reload failed", "error", err)
+		}
+		reloadMu.Unlock()
+	}
+}
+
+// handleReload starts reloading the store from the current source, or from
+// the meta_file or snapshot_file given.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		respondErr(w, http.StatusNotFound)
+		return
+	}
+	token := []byte("Bearer " + adminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		respondErr(w, http.StatusUnauthorized)
+		return
+	}
+
+	if !reloadMu.TryLock() {
+		http.Error(w, "Conflict: reload already in progress", http.StatusConflict)
+		return
+	}
+
+	src := currentSource
+	if v := r.URL.Query().Get("meta_file"); v != "" {
+		src = storeSource{metaFile: v}
+	} else if v := r.URL.Query().Get("snapshot_file"); v != "" {
+		src = storeSource{snapshotFile: v}
+	}
+
+	go func() {
+		defer reloadMu.Unlock()
+		if err := reload(src); err != nil {
+			slog.Error("reload failed", "source", src.String(), "error", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Reloading from " + src.String()))
+}
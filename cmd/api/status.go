@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	geograph "github.com/dzfranklin/plantopo-geograph"
+	"net/http"
+	"sync"
+)
+
+// loadStatus tracks the progress of the most recent load so that it can be
+// reported by /status/ready.
+type loadStatus struct {
+	mu       sync.Mutex
+	ready    bool
+	progress geograph.LoadProgress
+}
+
+var currentLoad loadStatus
+
+type readyResponse struct {
+	Ready          bool   `json:"ready"`
+	Phase          string `json:"phase,omitempty"`
+	Records        int    `json:"records"`
+	Bytes          int64  `json:"bytes,omitempty"`
+	TotalBytes     int64  `json:"total_bytes,omitempty"`
+	DatasetVersion string `json:"dataset_version,omitempty"`
+}
+
+func (s *loadStatus) report(p geograph.LoadProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = p
+}
+
+func (s *loadStatus) setReady(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = true
+	s.progress = geograph.LoadProgress{Records: s.progress.Records, DatasetVersion: version}
+}
+
+func (s *loadStatus) response() readyResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return readyResponse{
+		Ready:          s.ready,
+		Phase:          string(s.progress.Phase),
+		Records:        s.progress.Records,
+		Bytes:          s.progress.Bytes,
+		TotalBytes:     s.progress.TotalBytes,
+		DatasetVersion: s.progress.DatasetVersion,
+	}
+}
+
+func handleLive(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("OK"))
+}
+
+// handleReady responds 503 with the load progress until the first store has
+// been opened. Reloads don't affect readiness as the previous store keeps
+// serving.
+func handleReady(w http.ResponseWriter, _ *http.Request) {
+	resp := currentLoad.response()
+	value, err := json.Marshal(resp)
+	if err != nil {
+		respondISE(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(value)
+}
@@ -1,36 +1,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	geograph "github.com/dzfranklin/plantopo-geograph"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
-	metaFile := geograph.GetEnvString("META_FILE")
+	dataDir := os.Getenv("DATA_DIR")
 
 	// Commands
 
 	getFlag := flag.String("get", "", "<id>")
 	withinFlag := flag.String("within", "", "minLng,minLat,maxLng,maxLat")
 	nearFlag := flag.String("near", "", "lng,lat")
+	alongFlag := flag.String("along", "", "<route.gpx>")
+	searchFlag := flag.String("search", "", "<query>")
 	imageFlag := flag.String("image", "", "")
+	buildSnapshotFlag := flag.String("build-snapshot", "", "<output path>")
+	applyDeltaFlag := flag.String("apply-delta", "", "<delta.ndjson.gz>")
+	exportRegionFlag := flag.String("export-region", "", "<output path>")
 
 	// Options
 
 	indexFlag := flag.String("index", "subject", "subject|viewpoint")
 	maxFlag := flag.Int("max", 10, "")
-	cursorFlag := flag.Int("cursor", 0, "")
+	cursorFlag := flag.String("cursor", "", "")
+	maxMetersFlag := flag.Float64("max-meters", 0, "limit -near to within this distance")
+	bufferMetersFlag := flag.Float64("buffer-meters", 100, "include pictures this close to the -along route")
+	spacingMetersFlag := flag.Float64("spacing-meters", 0, "thin -along to one picture every this far")
+	takenAfterFlag := flag.String("taken-after", "", "YYYY-MM-DD")
+	takenBeforeFlag := flag.String("taken-before", "", "YYYY-MM-DD")
+	userIDFlag := flag.Int("user-id", 0, "")
+	moderationStatusFlag := flag.String("moderation-status", "", "geograph|accepted")
+	tagFlag := flag.String("tag", "", "tag, optionally with a prefix like top:Rivers")
+	tagPrefixFlag := flag.String("tag-prefix", "", "")
+	minSizeFlag := flag.Int("min-size", 0, "minimum pixels on the longer side")
+	hasViewpointFlag := flag.Bool("has-viewpoint", false, "")
 	imageForBatchFlag := flag.Bool("image-for-batch", false, "")
+	regionFlag := flag.String("region", "", "minLng,minLat,maxLng,maxLat to -export-region")
+	regionGeoJSONFlag := flag.String("region-geojson", "", "<area.geojson> to -export-region")
+	maxPicturesFlag := flag.Int("max-pictures", 0, "limit -export-region to this many pictures")
 
 	flag.Parse()
 
-	store := geograph.Open(metaFile)
+	tag := geograph.ParseTag(*tagFlag)
+	if *tagPrefixFlag != "" {
+		tag.Prefix = *tagPrefixFlag
+	}
+	filter := geograph.Filter{
+		UserID:           int32(*userIDFlag),
+		ModerationStatus: *moderationStatusFlag,
+		Tag:              tag.Tag,
+		TagPrefix:        tag.Prefix,
+		MinSize:          int32(*minSizeFlag),
+		HasViewpoint:     *hasViewpointFlag,
+	}
+	for _, date := range []struct {
+		value string
+		out   *time.Time
+	}{{*takenAfterFlag, &filter.TakenAfter}, {*takenBeforeFlag, &filter.TakenBefore}} {
+		if date.value == "" {
+			continue
+		}
+		v, err := time.Parse("2006-01-02", date.value)
+		if err != nil {
+			log.Println("invalid date")
+			flag.Usage()
+			os.Exit(1)
+		}
+		*date.out = v
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var store *geograph.Store
+	var err error
+	if snapshotFile := os.Getenv("SNAPSHOT_FILE"); snapshotFile != "" && *buildSnapshotFlag == "" {
+		store, err = geograph.OpenSnapshot(ctx, snapshotFile, geograph.OpenOptions{DataDir: dataDir})
+	} else {
+		metaFile := geograph.GetEnvString("META_FILE")
+		store, err = geograph.Open(ctx, metaFile, geograph.OpenOptions{DataDir: dataDir})
+	}
+	if err != nil {
+		panic(err)
+	}
 	defer func() {
 		if err := store.Close(); err != nil {
 			panic(err)
@@ -48,7 +111,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println(res)
+		fmt.Println(string(res.Raw()))
 	} else if *withinFlag != "" {
 		parts := strings.Split(*withinFlag, ",")
 		if len(parts) != 4 {
@@ -78,13 +141,13 @@ func main() {
 			os.Exit(1)
 		}
 
-		hasMore, nextCursor, res, err := store.Within(minPt, maxPt, index, *maxFlag, *cursorFlag)
+		hasMore, nextCursor, res, err := store.Within(minPt, maxPt, index, *maxFlag, *cursorFlag, filter)
 		if err != nil {
 			panic(err)
 		}
 
 		for _, v := range res {
-			fmt.Println(v)
+			fmt.Println(string(v.Raw()))
 		}
 
 		if hasMore {
@@ -122,13 +185,64 @@ func main() {
 			os.Exit(1)
 		}
 
-		hasMore, nextCursor, res, err := store.Near(target, index, *maxFlag, *cursorFlag)
+		hasMore, nextCursor, res, err := store.Near(target, index, *maxFlag, *cursorFlag, *maxMetersFlag, filter)
 		if err != nil {
 			panic(err)
 		}
 
 		for _, v := range res {
-			fmt.Println(v)
+			fmt.Println(string(v.Raw()))
+		}
+
+		if hasMore {
+			log.Println("next: cursor=", nextCursor)
+		} else {
+			log.Println("no more results")
+		}
+	} else if *alongFlag != "" {
+		routeF, err := os.Open(*alongFlag)
+		if err != nil {
+			panic(err)
+		}
+		route, err := geograph.ParseGPX(routeF)
+		if err != nil {
+			panic(err)
+		}
+		_ = routeF.Close()
+
+		var index geograph.IndexType
+		switch *indexFlag {
+		case "viewpoint":
+			index = geograph.ViewpointIndex
+		case "subject":
+			index = geograph.SubjectIndex
+		default:
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		hasMore, res, err := store.AlongLine(route, *bufferMetersFlag, index, *spacingMetersFlag, *maxFlag)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, v := range res {
+			fmt.Println(string(v.Raw()))
+		}
+
+		if hasMore {
+			log.Println("more results past -max")
+		} else {
+			log.Println("no more results")
+		}
+	} else if *searchFlag != "" {
+		hasMore, nextCursor, res, err := store.Search(*searchFlag, geograph.SearchOptions{MaxItems: *maxFlag, Cursor: *cursorFlag})
+		if err != nil {
+			panic(err)
+		}
+
+		for _, v := range res {
+			fmt.Println(string(v.Raw()))
 		}
 
 		if hasMore {
@@ -145,18 +259,90 @@ func main() {
 			os.Exit(1)
 		}
 
-		meta, err := store.Get(int32(id))
+		pic, err := store.Get(int32(id))
 		if err != nil {
 			panic(err)
 		}
 
-		sizes := geograph.GetImageSrc(secret, meta, *imageForBatchFlag)
+		sizes := geograph.GetImageSrc(secret, pic, *imageForBatchFlag)
 
 		sizesJSON, err := json.MarshalIndent(sizes, "", "    ")
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(string(sizesJSON))
+	} else if *buildSnapshotFlag != "" {
+		outF, err := os.Create(*buildSnapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := store.WriteSnapshot(outF); err != nil {
+			panic(err)
+		}
+		if err := outF.Close(); err != nil {
+			panic(err)
+		}
+		log.Println("wrote snapshot of", store.Version(), "to", *buildSnapshotFlag)
+	} else if *applyDeltaFlag != "" {
+		deltaF, err := os.Open(*applyDeltaFlag)
+		if err != nil {
+			panic(err)
+		}
+		delta, err := geograph.ReadDelta(deltaF)
+		if err != nil {
+			panic(err)
+		}
+		_ = deltaF.Close()
+
+		if err := store.ApplyDelta(delta); err != nil {
+			panic(err)
+		}
+		log.Println("applied delta, now at", store.Version())
+	} else if *exportRegionFlag != "" {
+		var area geograph.MultiPolygon
+		if *regionGeoJSONFlag != "" {
+			data, err := os.ReadFile(*regionGeoJSONFlag)
+			if err != nil {
+				panic(err)
+			}
+			area, err = geograph.ParseGeoJSONPolygon(data)
+			if err != nil {
+				panic(err)
+			}
+		} else {
+			parts := strings.Split(*regionFlag, ",")
+			if len(parts) != 4 {
+				log.Println("-export-region requires -region or -region-geojson")
+				flag.Usage()
+				os.Exit(1)
+			}
+			floatParts := [4]float32{}
+			for i, part := range parts {
+				v, err := strconv.ParseFloat(part, 32)
+				if err != nil {
+					flag.Usage()
+					os.Exit(1)
+				}
+				floatParts[i] = float32(v)
+			}
+			area = geograph.BoxPolygon(geograph.Point(floatParts[0], floatParts[1]), geograph.Point(floatParts[2], floatParts[3]))
+		}
+
+		outF, err := os.Create(*exportRegionFlag)
+		if err != nil {
+			panic(err)
+		}
+		opts := geograph.RegionPackOptions{
+			ImageSecret: []byte(geograph.GetEnvString("IMAGE_SECRET")),
+			MaxPictures: *maxPicturesFlag,
+		}
+		if err := store.ExportRegion(outF, area, opts); err != nil {
+			panic(err)
+		}
+		if err := outF.Close(); err != nil {
+			panic(err)
+		}
+		log.Println("wrote region pack of", store.Version(), "to", *exportRegionFlag)
 	} else {
 		flag.Usage()
 	}
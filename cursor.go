@@ -0,0 +1,190 @@
+package geograph
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// Cursors are opaque tokens returned with each page that resume the query
+// from after the last item on the page. They identify the dataset version and
+// the query they were returned by so that they can't be used to resume a
+// different query or a query against a different version of the dataset.
+//
+// Layout (big-endian), encoded as unpadded base64url:
+//
+//	cursor version u8 | kind u8 | query hash u32 | dataset version length u8 |
+//	dataset version | overlay u8 | position u32 | distance f64
+//
+// Cursors for the secondary indexes instead hold the last key on the page,
+// which stays valid as the dataset changes, so they don't include a dataset
+// version:
+//
+//	cursor version u8 | kind u8 | query hash u32 | key length u8 | key
+const cursorVersion = 1
+
+const (
+	cursorKindWithin  byte = 'w'
+	cursorKindNear    byte = 'n'
+	cursorKindPolygon byte = 'p'
+	cursorKindUser    byte = 'u'
+	cursorKindGrid    byte = 'g'
+	cursorKindTaken   byte = 't'
+	cursorKindSearch  byte = 's'
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrInvalidPageSize is returned when a page of fewer than one item is
+// requested.
+var ErrInvalidPageSize = errors.New("page size must be at least 1")
+
+// pageAlloc is the space to allocate up front for a page of maxItems, bounded
+// so that a large page size costs only as much as the items found.
+func pageAlloc(maxItems int) int {
+	return min(maxItems, 1024)
+}
+
+// ErrStaleCursor is returned for a cursor returned by a different version of
+// the dataset, such as before a reload or a delta was applied. The query must
+// be restarted without a cursor.
+var ErrStaleCursor = errors.New("cursor is for a different version of the dataset")
+
+type cursorHeader struct {
+	Version byte
+	Kind    byte
+	Query   uint32
+}
+
+type cursorPosition struct {
+	Overlay  byte
+	Position uint32
+	Dist     float64
+}
+
+// queryHash identifies the parameters of a query other than the page size.
+func queryHash(params ...any) uint32 {
+	h := fnv.New32a()
+	for _, param := range params {
+		if err := binary.Write(h, binary.BigEndian, param); err != nil {
+			panic(err)
+		}
+	}
+	return h.Sum32()
+}
+
+func encodeCursor(kind byte, query uint32, dsVersion string, c indexCursor) string {
+	var buf bytes.Buffer
+	writeCursorHeader(&buf, kind, query)
+	buf.WriteByte(byte(len(dsVersion)))
+	buf.WriteString(dsVersion)
+	position := cursorPosition{Position: uint32(c.pos), Dist: c.dist}
+	if c.overlay {
+		position.Overlay = 1
+	}
+	_ = binary.Write(&buf, binary.BigEndian, position)
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeCursor returns the position encoded in cursor, or nil if cursor is
+// empty.
+func decodeCursor(cursor string, kind byte, query uint32, dsVersion string) (*indexCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	r, err := readCursorHeader(cursor, kind, query)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := readCursorBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if string(version) != dsVersion {
+		return nil, ErrStaleCursor
+	}
+
+	var position cursorPosition
+	if err := binary.Read(r, binary.BigEndian, &position); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	if r.Len() != 0 || position.Overlay > 1 || position.Position > math.MaxInt32 ||
+		math.IsNaN(position.Dist) || position.Dist < 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &indexCursor{overlay: position.Overlay == 1, pos: int(position.Position), dist: position.Dist}, nil
+}
+
+func encodeKeyCursor(kind byte, query uint32, key []byte) string {
+	var buf bytes.Buffer
+	writeCursorHeader(&buf, kind, query)
+	buf.WriteByte(byte(len(key)))
+	buf.Write(key)
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeKeyCursor returns the key encoded in cursor, or nil if cursor is
+// empty.
+func decodeKeyCursor(cursor string, kind byte, query uint32) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	r, err := readCursorHeader(cursor, kind, query)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readCursorBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 || len(key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
+
+func writeCursorHeader(buf *bytes.Buffer, kind byte, query uint32) {
+	_ = binary.Write(buf, binary.BigEndian, cursorHeader{Version: cursorVersion, Kind: kind, Query: query})
+}
+
+func readCursorHeader(cursor string, kind byte, query uint32) (*bytes.Reader, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	r := bytes.NewReader(data)
+
+	var header cursorHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	if header.Version != cursorVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidCursor, header.Version)
+	}
+	if header.Kind != kind || header.Query != query {
+		return nil, fmt.Errorf("%w: cursor is for a different query", ErrInvalidCursor)
+	}
+	return r, nil
+}
+
+// readCursorBytes reads a length-prefixed field.
+func readCursorBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	return b, nil
+}
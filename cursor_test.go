@@ -0,0 +1,114 @@
+package geograph
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestCursorPagination(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var records []string
+	for i := range 5000 {
+		lng, lat := -4+rng.Float32()*2, 55+rng.Float32()*2
+		if i%5 == 0 {
+			// Many pictures share a location
+			lng, lat = -3.2, 55.9
+		}
+		records = append(records, testRecord(int32(i+1), lng, lat))
+	}
+	subject := openTestStore(t, writeTestDump(t, records...), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	require.NoError(t, subject.ApplyDelta(&Delta{
+		Upserts: []json.RawMessage{json.RawMessage(testRecord(10_000, -3.2, 55.9))},
+		Deletes: []int32{2},
+	}))
+
+	paginate := func(query func(cursor string) (bool, string, []*Picture, error)) []int32 {
+		var got []int32
+		cursor := ""
+		for {
+			hasNext, next, page, err := query(cursor)
+			require.NoError(t, err)
+			for _, pic := range page {
+				got = append(got, pic.ID)
+			}
+			if !hasNext {
+				return got
+			}
+			cursor = next
+		}
+	}
+
+	t.Run("within", func(t *testing.T) {
+		minPt, maxPt := Point(-3.5, 55.5), Point(-2.5, 56.5)
+		_, _, all, err := subject.Within(minPt, maxPt, SubjectIndex, 10_000, "", Filter{})
+		require.NoError(t, err)
+		var want []int32
+		for _, pic := range all {
+			want = append(want, pic.ID)
+		}
+
+		got := paginate(func(cursor string) (bool, string, []*Picture, error) {
+			return subject.Within(minPt, maxPt, SubjectIndex, 7, cursor, Filter{})
+		})
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("near", func(t *testing.T) {
+		target := Point(-3.2, 55.9)
+		_, _, all, err := subject.Near(target, SubjectIndex, 10_000, "", 30_000, Filter{})
+		require.NoError(t, err)
+		var want []int32
+		for _, pic := range all {
+			want = append(want, pic.ID)
+		}
+		require.Contains(t, want, int32(10_000))
+
+		got := paginate(func(cursor string) (bool, string, []*Picture, error) {
+			return subject.Near(target, SubjectIndex, 7, cursor, 30_000, Filter{})
+		})
+		assert.Equal(t, want, got)
+	})
+}
+
+func TestCursorErrors(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56), testRecord(3, -3.4, 56.1),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	target := Point(-3.2, 55.9)
+	hasNext, cursor, _, err := subject.Near(target, SubjectIndex, 1, "", 0, Filter{})
+	require.NoError(t, err)
+	require.True(t, hasNext)
+
+	_, _, _, err = subject.Near(Point(0, 0), SubjectIndex, 1, cursor, 0, Filter{})
+	assert.ErrorIs(t, err, ErrInvalidCursor, "should reject cursor for another query")
+	_, _, _, err = subject.Within(target, target, SubjectIndex, 1, cursor, Filter{})
+	assert.ErrorIs(t, err, ErrInvalidCursor, "should reject cursor for another kind of query")
+	_, _, _, err = subject.Near(target, SubjectIndex, 1, "not a cursor", 0, Filter{})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	require.NoError(t, subject.ApplyDelta(&Delta{Deletes: []int32{3}}))
+	_, _, _, err = subject.Near(target, SubjectIndex, 1, cursor, 0, Filter{})
+	assert.ErrorIs(t, err, ErrStaleCursor)
+}
+
+func TestInvalidPageSize(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t, testRecord(1, -3.2, 55.9)), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	for _, pageSize := range []int{0, -1} {
+		_, _, _, err := subject.Within(Point(-180, -90), Point(180, 90), SubjectIndex, pageSize, "", Filter{})
+		assert.ErrorIs(t, err, ErrInvalidPageSize)
+		_, _, _, err = subject.Near(Point(-3.2, 55.9), SubjectIndex, pageSize, "", 0, Filter{})
+		assert.ErrorIs(t, err, ErrInvalidPageSize)
+		_, _, _, err = subject.ByUser(1, pageSize, "")
+		assert.ErrorIs(t, err, ErrInvalidPageSize)
+		_, _, _, err = subject.Search("picture", SearchOptions{MaxItems: pageSize})
+		assert.ErrorIs(t, err, ErrInvalidPageSize)
+	}
+}
@@ -0,0 +1,411 @@
+package geograph
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storeFormatVersion is bumped whenever the on-disk layout of a dataset
+// directory changes so that stores built by older code are rebuilt.
+const storeFormatVersion = 6
+
+const (
+	datasetDirPrefix = "ds-"
+	manifestFile     = "manifest.json"
+	dbDir            = "db"
+	indexFile        = "index.bin"
+)
+
+type OpenOptions struct {
+	// DataDir is a durable directory to keep the store in. If set, a store
+	// previously built from the same source is reopened instead of being
+	// rebuilt. If empty the store is built in a temporary directory that is
+	// removed on Close.
+	DataDir string
+
+	// Progress is called as the store is loaded. If nil progress is logged.
+	Progress func(LoadProgress)
+}
+
+func (o OpenOptions) progress() func(LoadProgress) {
+	if o.Progress != nil {
+		return o.Progress
+	}
+	return func(p LoadProgress) {
+		slog.Info("loading", "phase", p.Phase, "records", p.Records, "version", p.DatasetVersion)
+	}
+}
+
+type LoadPhase string
+
+const (
+	PhaseDownloading LoadPhase = "downloading"
+	PhaseExtracting  LoadPhase = "extracting"
+	PhaseWriting     LoadPhase = "writing"
+	PhaseCompacting  LoadPhase = "compacting"
+	PhaseIndexing    LoadPhase = "indexing"
+)
+
+// LoadProgress reports how far Open or OpenSnapshot has got.
+type LoadProgress struct {
+	Phase LoadPhase
+	// Records is the number of records written so far, or the total once
+	// writing is complete.
+	Records int
+	// Bytes and TotalBytes report the progress of downloading a remote
+	// source. TotalBytes is -1 if the size is unknown.
+	Bytes      int64
+	TotalBytes int64
+	// DatasetVersion is the version the store will have once loaded, or empty
+	// if it isn't known yet.
+	DatasetVersion string
+}
+
+// withDatasetVersion sets DatasetVersion on everything reported to progress.
+func withDatasetVersion(progress func(LoadProgress), dsVersion string) func(LoadProgress) {
+	return func(p LoadProgress) {
+		p.DatasetVersion = dsVersion
+		progress(p)
+	}
+}
+
+// RecordError is returned when the source contains a record that can't be
+// loaded.
+type RecordError struct {
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatusError is returned when a remote source responds with a status
+// other than 200 OK.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// manifest is written last when building a dataset directory, so its presence
+// marks the directory as complete.
+type manifest struct {
+	FormatVersion  int       `json:"format_version"`
+	DatasetVersion string    `json:"dataset_version"`
+	Source         string    `json:"source"`
+	SourceVersion  string    `json:"source_version"`
+	Records        int       `json:"records"`
+	CreatedAt      time.Time `json:"created_at"`
+	// DeltaSeq and DeltaHash identify the deltas applied to the dataset when
+	// a snapshot was taken of it.
+	DeltaSeq  uint64 `json:"delta_seq,omitempty"`
+	DeltaHash string `json:"delta_hash,omitempty"`
+}
+
+// snapshotVersion identifies the contents of a snapshot, which differ from
+// the dataset it was taken of if deltas had been applied.
+func (m manifest) snapshotVersion() string {
+	if m.DeltaHash == "" {
+		return m.DatasetVersion
+	}
+	return m.DatasetVersion + "-" + m.DeltaHash[:16]
+}
+
+// sourceVersion identifies the content of metaFile without reading it into
+// the store. Remote files are identified by their ETag (or Last-Modified and
+// size), local files by their SHA-256. An empty version means the source
+// cannot be identified and must always be rebuilt.
+func sourceVersion(ctx context.Context, metaFile string) (string, error) {
+	if isRemote(metaFile) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, metaFile, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", &HTTPStatusError{URL: metaFile, StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			return "etag:" + etag, nil
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" && resp.ContentLength >= 0 {
+			return fmt.Sprintf("last-modified:%s:%d", lastModified, resp.ContentLength), nil
+		}
+		return "", nil
+	}
+
+	f, err := os.Open(metaFile)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx, f}); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openSource opens a local file or downloads a remote one. Remote files are
+// cached in opts.DataDir if set, and otherwise in a temporary directory removed
+// on Close.
+func openSource(ctx context.Context, path string, opts OpenOptions, progress func(LoadProgress)) (io.ReadCloser, error) {
+	if !isRemote(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{contextReader{ctx, f}, f.Close}, nil
+	}
+
+	if opts.DataDir != "" {
+		cachePath := downloadCachePath(opts.DataDir, path)
+		if err := download(ctx, path, cachePath, progress); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(cachePath)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{contextReader{ctx, f}, f.Close}, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(tmpDir, "source")
+	if err := download(ctx, path, tmpPath, progress); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return readCloser{contextReader{ctx, f}, func() error {
+		err := f.Close()
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func isRemote(metaFile string) bool {
+	return strings.HasPrefix(metaFile, "https://") || strings.HasPrefix(metaFile, "http://")
+}
+
+// datasetVersion is a short stable identifier for a store built by this code
+// from a source with the given version.
+func datasetVersion(sourceVersion string) string {
+	var input string
+	if sourceVersion == "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err)
+		}
+		input = "nonce:" + hex.EncodeToString(nonce)
+	} else {
+		input = fmt.Sprintf("%d:%s", storeFormatVersion, sourceVersion)
+	}
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+func readManifest(dir string) (manifest, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{}, false
+	} else if err != nil {
+		slog.Warn("failed to read manifest", "dir", dir, "error", err)
+		return manifest{}, false
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		slog.Warn("invalid manifest", "dir", dir, "error", err)
+		return manifest{}, false
+	}
+	return m, true
+}
+
+func writeManifest(dir string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, manifestFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, manifestFile))
+}
+
+// openDatasets tracks the dataset directories open in this process so that
+// stores opened on the same directory share it and so that directories still
+// in use aren't pruned.
+var openDatasets = struct {
+	sync.Mutex
+	byDir map[string]*dataset
+	// opening holds the directories being opened, so that concurrent opens
+	// of the same directory wait for the first instead of opening it again
+	opening map[string]*pendingDataset
+}{byDir: make(map[string]*dataset), opening: make(map[string]*pendingDataset)}
+
+type pendingDataset struct {
+	done chan struct{}
+	err  error
+}
+
+// openDataset returns a store for the dataset in dir, sharing it if it is
+// already open and otherwise opening it with open.
+func openDataset(dir string, open func() (*dataset, error)) (*Store, error) {
+	openDatasets.Lock()
+	for {
+		if ds, ok := openDatasets.byDir[dir]; ok {
+			ds.refs++
+			openDatasets.Unlock()
+			slog.Info("sharing open store", "dir", dir)
+			return &Store{dataset: ds}, nil
+		}
+		pending, ok := openDatasets.opening[dir]
+		if !ok {
+			break
+		}
+		openDatasets.Unlock()
+		<-pending.done
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		openDatasets.Lock()
+	}
+	pending := &pendingDataset{done: make(chan struct{})}
+	openDatasets.opening[dir] = pending
+	openDatasets.Unlock()
+
+	ds, err := open()
+
+	openDatasets.Lock()
+	defer openDatasets.Unlock()
+	delete(openDatasets.opening, dir)
+	pending.err = err
+	close(pending.done)
+	if err != nil {
+		return nil, err
+	}
+	openDatasets.byDir[dir] = ds
+	return &Store{dataset: ds}, nil
+}
+
+// releaseDataset drops a reference to ds, reporting whether it was the last
+// one and so ds should be closed.
+func releaseDataset(ds *dataset) (last bool, removeOnClose bool) {
+	openDatasets.Lock()
+	defer openDatasets.Unlock()
+
+	ds.refs--
+	if ds.refs > 0 {
+		return false, false
+	}
+	if openDatasets.byDir[ds.dir] == ds {
+		delete(openDatasets.byDir, ds.dir)
+	}
+	return true, ds.removeOnClose
+}
+
+// pruneDatasets removes every dataset directory in dataDir other than keep.
+// Directories that are still open are removed when they are closed.
+func pruneDatasets(dataDir string, keep string) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		slog.Warn("failed to list data dir", "dir", dataDir, "error", err)
+		return
+	}
+
+	openDatasets.Lock()
+	defer openDatasets.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), datasetDirPrefix) {
+			continue
+		}
+		path := filepath.Join(dataDir, entry.Name())
+		if path == keep {
+			continue
+		}
+		if ds, ok := openDatasets.byDir[path]; ok {
+			ds.removeOnClose = true
+			continue
+		}
+		if _, ok := openDatasets.opening[path]; ok {
+			continue
+		}
+		slog.Info("removing stale dataset", "dir", path)
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("failed to remove stale dataset", "dir", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package geograph
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"github.com/tidwall/gjson"
+	"hash/fnv"
+	"io"
+	"slices"
+)
+
+// Delta is a set of changes between two dumps, keyed by gridimage_id.
+//
+// Deltas are stored as gzipped NDJSON with one change per line, either
+// {"upsert": <record>} or {"delete": <gridimage_id>}.
+type Delta struct {
+	Upserts []json.RawMessage
+	Deletes []int32
+}
+
+type deltaLine struct {
+	Upsert json.RawMessage `json:"upsert,omitempty"`
+	Delete *int32          `json:"delete,omitempty"`
+}
+
+func ReadDelta(r io.Reader) (*Delta, error) {
+	gzR, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(gzR)
+
+	delta := &Delta{}
+	for line := 1; ; line++ {
+		var change deltaLine
+		err := d.Decode(&change)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("delta line %d: %w", line, err)
+		}
+
+		if change.Upsert != nil {
+			delta.Upserts = append(delta.Upserts, change.Upsert)
+		} else if change.Delete != nil {
+			delta.Deletes = append(delta.Deletes, *change.Delete)
+		} else {
+			return nil, fmt.Errorf("delta line %d: expected upsert or delete", line)
+		}
+	}
+	return delta, nil
+}
+
+func WriteDelta(w io.Writer, delta *Delta) error {
+	gzW := gzip.NewWriter(w)
+	enc := json.NewEncoder(gzW)
+	for _, record := range delta.Upserts {
+		if err := enc.Encode(deltaLine{Upsert: record}); err != nil {
+			return err
+		}
+	}
+	for _, id := range delta.Deletes {
+		if err := enc.Encode(deltaLine{Delete: &id}); err != nil {
+			return err
+		}
+	}
+	return gzW.Close()
+}
+
+// DiffDumps computes the delta that turns the gzipped NDJSON dump prev into
+// next.
+func DiffDumps(prev, next io.Reader) (*Delta, error) {
+	prevHashes := make(map[int32]uint64)
+	err := scanDump(prev, func(id int32, record []byte) {
+		prevHashes[id] = hashRecord(record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("previous dump: %w", err)
+	}
+
+	delta := &Delta{}
+	err = scanDump(next, func(id int32, record []byte) {
+		prevHash, ok := prevHashes[id]
+		if !ok || prevHash != hashRecord(record) {
+			delta.Upserts = append(delta.Upserts, slices.Clone(record))
+		}
+		delete(prevHashes, id)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("next dump: %w", err)
+	}
+
+	for id := range prevHashes {
+		delta.Deletes = append(delta.Deletes, id)
+	}
+	slices.Sort(delta.Deletes)
+
+	return delta, nil
+}
+
+func scanDump(r io.Reader, cb func(id int32, record []byte)) error {
+	gzR, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(gzR)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		record := scanner.Bytes()
+		if len(record) == 0 {
+			continue
+		}
+		id := gjson.GetBytes(record, "gridimage_id")
+		if !id.Exists() {
+			return fmt.Errorf("line %d: missing gridimage_id", line)
+		}
+		cb(int32(id.Int()), record)
+	}
+	return scanner.Err()
+}
+
+func hashRecord(record []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(record)
+	return h.Sum64()
+}
+
+// ApplyDelta updates the store with the changes in delta. Queries may run
+// concurrently and see the store either before or after the delta. If an id
+// is changed more than once the last upsert wins, and deletes are applied
+// after upserts.
+func (s *Store) ApplyDelta(delta *Delta) error {
+	s.deltaMu.Lock()
+	defer s.deltaMu.Unlock()
+
+	// The batch is indexed so that an id changed twice sees its first change
+	batch := s.db.NewIndexedBatch()
+	defer func() { _ = batch.Close() }()
+
+	stats, err := s.textStats()
+	if err != nil {
+		return err
+	}
+	overlay := s.index.overlay.Load()
+	changes := make(map[int32]overlayEntry, len(delta.Upserts)+len(delta.Deletes))
+	// base holds the entries in the packed trees of ids first hidden by this
+	// delta, so that only they need to be looked up
+	base := make(map[int32]overlayEntry)
+	tags := make(tagCounts)
+	terms := make(termCounts)
+	removePrevious := func(id int32) error {
+		prev, ok, err := s.deleteSecondaryKeys(batch, id, tags, terms, &stats)
+		if err != nil {
+			return err
+		}
+		if _, changed := changes[id]; ok && !changed && !overlay.hides(id) {
+			base[id] = overlayEntry{
+				subject:   Point(prev.SubjectLng, prev.SubjectLat),
+				viewpoint: Point(prev.ViewpointLng, prev.ViewpointLat),
+			}
+		}
+		return nil
+	}
+
+	for _, record := range delta.Upserts {
+		fields, err := parseIndexedFields(record)
+		if err != nil {
+			return err
+		}
+		entry := overlayEntry{
+			subject:   Point(fields.SubjectLng, fields.SubjectLat),
+			viewpoint: Point(fields.ViewpointLng, fields.ViewpointLat),
+		}
+		if err := removePrevious(fields.ID); err != nil {
+			return err
+		}
+		if err := batch.Set(recordKey(fields.ID), record, nil); err != nil {
+			return err
+		}
+		for _, entry := range secondaryEntries(fields) {
+			if err := batch.Set(entry.key, entry.value, nil); err != nil {
+				return err
+			}
+		}
+		if err := batch.Set(overlayKey(fields.ID), entry.encode(), nil); err != nil {
+			return err
+		}
+		tags.add(fields, 1)
+		terms.add(fields, 1)
+		stats.add(fields)
+		changes[fields.ID] = entry
+	}
+	for _, id := range delta.Deletes {
+		entry := overlayEntry{deleted: true}
+		if err := removePrevious(id); err != nil {
+			return err
+		}
+		if err := batch.Delete(recordKey(id), nil); err != nil {
+			return err
+		}
+		if err := batch.Set(overlayKey(id), entry.encode(), nil); err != nil {
+			return err
+		}
+		changes[id] = entry
+	}
+
+	if err := tags.apply(s.db, batch); err != nil {
+		return err
+	}
+	if err := terms.apply(s.db, batch); err != nil {
+		return err
+	}
+	if err := batch.Set(textStatsKey, stats.encode(), nil); err != nil {
+		return err
+	}
+
+	seq := s.deltaSeq.Load() + 1
+	if err := batch.Set(deltaSeqKey, binary.BigEndian.AppendUint64(nil, seq), nil); err != nil {
+		return err
+	}
+	hash := chainDeltaHash(s.deltaHash, delta)
+	if err := batch.Set(deltaHashKey, []byte(hash), nil); err != nil {
+		return err
+	}
+
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	s.index.applyOverlay(changes, base)
+	s.setDeltas(seq, hash)
+	return nil
+}
+
+// setDeltas records the number of deltas applied and the hash chained over
+// them, which identify the version of the dataset as snapshotVersion does.
+func (s *dataset) setDeltas(seq uint64, hash string) {
+	m := s.manifest
+	m.DeltaHash = hash
+	version := m.snapshotVersion()
+	if hash == "" && seq > 0 {
+		// Applied before deltas were hashed
+		version = fmt.Sprintf("%s.%d", m.DatasetVersion, seq)
+	}
+	s.deltaSeq.Store(seq)
+	s.deltaHash = hash
+	s.version.Store(&version)
+}
+
+// chainDeltaHash returns the hash identifying the deltas hashed by prev
+// followed by delta.
+func chainDeltaHash(prev string, delta *Delta) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	for _, record := range delta.Upserts {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(record)))
+		h.Write(record)
+	}
+	for _, id := range delta.Deletes {
+		_ = binary.Write(h, binary.BigEndian, id)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// deleteSecondaryKeys deletes the secondary index entries for the record
+// with id as of batch, if any, and removes it from tags, terms and stats. It
+// returns the fields of the record and whether there was one.
+func (s *Store) deleteSecondaryKeys(batch *pebble.Batch, id int32, tags tagCounts, terms termCounts, stats *textStats) (indexedFields, bool, error) {
+	record, closer, err := batch.Get(recordKey(id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return indexedFields{}, false, nil
+	} else if err != nil {
+		return indexedFields{}, false, err
+	}
+	fields, err := parseIndexedFields(record)
+	if err := closer.Close(); err != nil {
+		return indexedFields{}, false, err
+	}
+	if err != nil {
+		return indexedFields{}, false, err
+	}
+
+	for _, entry := range secondaryEntries(fields) {
+		if err := batch.Delete(entry.key, nil); err != nil {
+			return indexedFields{}, false, err
+		}
+	}
+	tags.add(fields, -1)
+	terms.add(fields, -1)
+	stats.remove(fields)
+	return fields, true, nil
+}
+
+// loadDeltas restores the index entries and sequence number of deltas applied
+// before the store was last closed.
+func (s *dataset) loadDeltas() error {
+	seqValue, closer, err := s.db.Get(deltaSeqKey)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	seq := binary.BigEndian.Uint64(seqValue)
+	if err := closer.Close(); err != nil {
+		return err
+	}
+
+	var hash string
+	hashValue, closer, err := s.db.Get(deltaHashKey)
+	if err == nil {
+		hash = string(hashValue)
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return err
+	}
+
+	lower, upper := prefixBounds(overlayKeyPrefix)
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return err
+	}
+	changes := make(map[int32]overlayEntry)
+	for iter.First(); iter.Valid(); iter.Next() {
+		entry, err := decodeOverlayEntry(iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return err
+		}
+		changes[keyID(iter.Key())] = entry
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	s.index.loadOverlay(changes)
+	s.setDeltas(seq, hash)
+	return nil
+}
@@ -0,0 +1,169 @@
+package geograph
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDiffDumps(t *testing.T) {
+	prev := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56), testRecord(3, -3.4, 56.1))
+	next := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(3, -4, 57), testRecord(4, -3.5, 56.2))
+
+	delta := diffTestDumps(t, prev, next)
+	require.Len(t, delta.Upserts, 2)
+	assert.JSONEq(t, testRecord(3, -4, 57), string(delta.Upserts[0]))
+	assert.JSONEq(t, testRecord(4, -3.5, 56.2), string(delta.Upserts[1]))
+	assert.Equal(t, []int32{2}, delta.Deletes)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteDelta(&buf, delta))
+	got, err := ReadDelta(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, delta, got)
+}
+
+func TestApplyDelta(t *testing.T) {
+	dataDir := t.TempDir()
+	prev := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56), testRecord(3, -3.4, 56.1))
+	next := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(3, 1, 51), testRecord(4, -3.31, 56))
+	delta := diffTestDumps(t, prev, next)
+
+	subject := openTestStore(t, prev, OpenOptions{DataDir: dataDir})
+	baseVersion := subject.Version()
+	require.NoError(t, subject.ApplyDelta(delta))
+	assert.NotEqual(t, baseVersion, subject.Version())
+
+	check := func(t *testing.T, subject *Store) {
+		_, err := subject.Get(2)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = subject.Get(4)
+		assert.NoError(t, err)
+
+		page, err := subject.index.within(Point(-5, 55), Point(-3, 57), SubjectIndex, 10, nil)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []int32{1, 4}, page.items)
+
+		page, err = subject.index.near(Point(-3.3, 56), SubjectIndex, 10, nil, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []int32{4, 1, 3}, page.items)
+
+		page, err = subject.index.near(Point(-3.3, 56), SubjectIndex, 1, nil, 0)
+		require.NoError(t, err)
+		page, err = subject.index.near(Point(-3.3, 56), SubjectIndex, 1, &page.next, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []int32{1}, page.items)
+		assert.True(t, page.hasNext)
+	}
+
+	check(t, subject)
+	version := subject.Version()
+	require.NoError(t, subject.Close())
+
+	t.Run("after reopen", func(t *testing.T) {
+		reopened := openTestStore(t, prev, OpenOptions{DataDir: dataDir})
+		defer func() { require.NoError(t, reopened.Close()) }()
+		assert.Equal(t, version, reopened.Version())
+		check(t, reopened)
+	})
+}
+
+func TestApplyDeltaVersion(t *testing.T) {
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56), testRecord(3, -3.4, 56.1))
+	first := openTestStore(t, metaFile, OpenOptions{})
+	defer func() { require.NoError(t, first.Close()) }()
+	second := openTestStore(t, metaFile, OpenOptions{})
+	defer func() { require.NoError(t, second.Close()) }()
+	require.Equal(t, first.Version(), second.Version())
+
+	require.NoError(t, first.ApplyDelta(&Delta{Deletes: []int32{2}}))
+	require.NoError(t, second.ApplyDelta(&Delta{Deletes: []int32{3}}))
+	assert.NotEqual(t, first.Version(), second.Version(), "should differ after different deltas at the same sequence number")
+
+	hasNext, cursor, _, err := second.Near(Point(-3.2, 55.9), SubjectIndex, 1, "", 0, Filter{})
+	require.NoError(t, err)
+	require.True(t, hasNext)
+	_, _, _, err = first.Near(Point(-3.2, 55.9), SubjectIndex, 1, cursor, 0, Filter{})
+	assert.ErrorIs(t, err, ErrStaleCursor, "should reject a cursor from a store with different deltas")
+}
+
+func TestApplyDeltaRepeatedID(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		searchTestRecord(1, -3.2, 55.9, "Trig point", ""),
+		searchTestRecord(2, -3.3, 56, "Summit cairn", ""),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	require.NoError(t, subject.ApplyDelta(&Delta{Upserts: []json.RawMessage{
+		json.RawMessage(searchTestRecord(2, 1, 51, "Bothy", "")),
+		json.RawMessage(searchTestRecord(2, 1.1, 51.1, "Corrie", "")),
+	}}))
+
+	for query, want := range map[string][]int32{"summit": nil, "bothy": nil, "corrie": {2}} {
+		_, _, got, err := subject.Search(query, SearchOptions{MaxItems: 10})
+		require.NoError(t, err)
+		assert.Len(t, got, len(want), query)
+	}
+
+	stats, err := subject.textStats()
+	require.NoError(t, err)
+	assert.Equal(t, textStats{records: 2, terms: 3}, stats)
+
+	assert.Equal(t, 2, subject.index.count(Point(-180, -90), Point(180, 90), SubjectIndex))
+	assert.Equal(t, 1, subject.index.count(Point(-5, 55), Point(-3, 57), SubjectIndex))
+}
+
+func TestApplyDeltaConcurrentQueries(t *testing.T) {
+	subject := sampleSubject(t)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, _, _, err := subject.Near(Point(-3.2, 55.9), SubjectIndex, 10, "", 0, Filter{})
+				require.NoError(t, err)
+			}
+		}()
+	}
+
+	for i := range 20 {
+		id := int32(1_000_000 + i)
+		delta := &Delta{
+			Upserts: []json.RawMessage{json.RawMessage(testRecord(id, -3.2, 55.9))},
+			Deletes: []int32{int32(i + 1)},
+		}
+		require.NoError(t, subject.ApplyDelta(delta))
+	}
+	close(stop)
+	wg.Wait()
+
+	_, _, got, err := subject.Near(Point(-3.2, 55.9), SubjectIndex, 20, "", 0, Filter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 20)
+}
+
+func diffTestDumps(t *testing.T, prevPath, nextPath string) *Delta {
+	t.Helper()
+	prev, err := os.Open(prevPath)
+	require.NoError(t, err)
+	defer func() { _ = prev.Close() }()
+	next, err := os.Open(nextPath)
+	require.NoError(t, err)
+	defer func() { _ = next.Close() }()
+
+	delta, err := DiffDumps(prev, next)
+	require.NoError(t, err)
+	return delta
+}
@@ -0,0 +1,392 @@
+package geograph
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	downloadsDir        = "downloads"
+	downloadMaxAttempts = 6
+	// downloadProgressBytes is how often download progress is reported
+	downloadProgressBytes = 64 << 20
+)
+
+// downloadRetryDelay is the delay before the first retry of a download,
+// doubling with each further attempt.
+var downloadRetryDelay = time.Second
+
+// ErrChecksumMismatch is returned when a download doesn't match the SHA-256
+// published alongside it.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrChecksumMissing is returned when the SHA-256 published alongside a
+// download is missing after one has been seen for it before.
+var ErrChecksumMissing = errors.New("checksum missing")
+
+// downloadState is stored next to a cached download so that an interrupted
+// download can be resumed and a complete one reused while the remote object
+// is unchanged.
+type downloadState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+	Complete     bool   `json:"complete"`
+	SHA256       string `json:"sha256,omitempty"`
+	// ChecksumSeen is set once a checksum has been published for URL, after
+	// which downloads without one are rejected rather than left unverified
+	ChecksumSeen bool `json:"checksum_seen,omitempty"`
+}
+
+// validator is the value to send as If-Range or If-None-Match, preferring the
+// ETag.
+func (s downloadState) validator() string {
+	if s.ETag != "" {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// downloadCachePath is where the download of url is cached in dataDir.
+func downloadCachePath(dataDir string, url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return filepath.Join(dataDir, downloadsDir, hex.EncodeToString(hash[:])[:16])
+}
+
+// download fetches url to path, resuming a partial download left at path by a
+// previous call and skipping the download entirely if path already holds the
+// current version of url. If url+".sha256" exists the download is verified
+// against it, and once it has existed it is required.
+func download(ctx context.Context, url string, path string, progress func(LoadProgress)) error {
+	state, _ := readDownloadState(path)
+	if state.URL != url {
+		state = downloadState{URL: url}
+	}
+
+	for republished := false; ; republished = true {
+		err := withRetries(ctx, url, func() (bool, error) {
+			var retry bool
+			var err error
+			state, retry, err = downloadAttempt(ctx, state, path, progress)
+			return retry, err
+		})
+		if err != nil {
+			return err
+		}
+
+		if state.SHA256 != "" {
+			return nil
+		}
+		sum, err := verifyDownload(ctx, url, path, state.ChecksumSeen)
+		if errors.Is(err, ErrChecksumMismatch) {
+			_ = os.Remove(path)
+			_ = os.Remove(path + ".json")
+			// The object and its checksum may have been read either side of
+			// them being republished, in which case the new object is
+			// downloaded instead
+			if !republished && remoteChanged(ctx, state) {
+				slog.Warn("object changed while downloading, restarting download", "url", url)
+				state = downloadState{URL: url, ChecksumSeen: true}
+				continue
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		state.SHA256 = sum
+		state.ChecksumSeen = state.ChecksumSeen || sum != ""
+		return writeDownloadState(path, state)
+	}
+}
+
+// withRetries calls attempt until it succeeds, fails with an error it reports
+// isn't worth retrying, or has been tried downloadMaxAttempts times.
+func withRetries(ctx context.Context, url string, attempt func() (retry bool, err error)) error {
+	var err error
+	for i := 0; i < downloadMaxAttempts; i++ {
+		if i > 0 {
+			delay := downloadRetryDelay << (i - 1)
+			slog.Warn("retrying download", "url", url, "error", err, "delay", delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		var retry bool
+		retry, err = attempt()
+		if err == nil {
+			return nil
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// remoteChanged reports whether url has changed since it was downloaded with
+// state.
+func remoteChanged(ctx context.Context, state downloadState) bool {
+	version, err := sourceVersion(ctx, state.URL)
+	if err != nil {
+		return false
+	}
+	if state.ETag != "" {
+		return version != "etag:"+state.ETag
+	}
+	return !strings.HasPrefix(version, "last-modified:"+state.LastModified+":")
+}
+
+// downloadAttempt makes a single request for the rest of the download. It
+// reports whether a failed attempt is worth retrying.
+func downloadAttempt(
+	ctx context.Context,
+	state downloadState,
+	path string,
+	progress func(LoadProgress),
+) (downloadState, bool, error) {
+	var have int64
+	if info, err := os.Stat(path); err == nil {
+		have = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, state.URL, nil)
+	if err != nil {
+		return state, false, err
+	}
+	if state.Complete && have == state.Size && state.validator() != "" {
+		if state.ETag != "" {
+			req.Header.Set("If-None-Match", state.ETag)
+		} else {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	} else if have > 0 && state.validator() != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+		req.Header.Set("If-Range", state.validator())
+	} else {
+		have = 0
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return state, true, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var flags int
+	var total int64
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		slog.Info("using cached download", "url", state.URL, "path", path)
+		return state, false, nil
+	case http.StatusOK:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		have = 0
+		total = resp.ContentLength
+		state = downloadState{
+			URL:          state.URL,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ChecksumSeen: state.ChecksumSeen,
+		}
+	case http.StatusPartialContent:
+		start, end, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != have || end != size-1 {
+			return state, false, fmt.Errorf("%s: unexpected Content-Range %q", state.URL, resp.Header.Get("Content-Range"))
+		}
+		slog.Info("resuming download", "url", state.URL, "offset", have)
+		flags = os.O_WRONLY | os.O_APPEND
+		total = size
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Start again from scratch
+			_ = os.Remove(path)
+		}
+		return state, retry, &HTTPStatusError{URL: state.URL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	state.Complete = false
+	state.Size = total
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return state, false, err
+	}
+	if err := writeDownloadState(path, state); err != nil {
+		return state, false, err
+	}
+
+	f, err := os.OpenFile(path, flags, 0640)
+	if err != nil {
+		return state, false, err
+	}
+	n, copyErr := io.Copy(f, &progressReader{r: resp.Body, n: have, total: total, progress: progress})
+	have += n
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return state, false, err
+	}
+	if err := f.Close(); err != nil {
+		return state, false, err
+	}
+	if copyErr != nil {
+		return state, true, copyErr
+	}
+	if total >= 0 && have != total {
+		return state, true, fmt.Errorf("%s: got %d of %d bytes", state.URL, have, total)
+	}
+
+	state.Complete = true
+	state.Size = have
+	return state, false, writeDownloadState(path, state)
+}
+
+// verifyDownload checks path against the SHA-256 published at url+".sha256",
+// returning the checksum. Unless required it is not an error for the sidecar
+// not to exist, and an empty checksum is returned. If required a missing
+// sidecar is waited for, as it is briefly missing while being republished.
+func verifyDownload(ctx context.Context, url string, path string, required bool) (string, error) {
+	var want string
+	err := withRetries(ctx, url+".sha256", func() (bool, error) {
+		var retry bool
+		var err error
+		want, retry, err = fetchChecksum(ctx, url)
+		if err == nil && want == "" && required {
+			return true, fmt.Errorf("%w: %s.sha256 not found", ErrChecksumMissing, url)
+		}
+		return retry, err
+	})
+	if err != nil {
+		return "", err
+	}
+	if want == "" {
+		slog.Warn("no checksum published, skipping verification", "url", url)
+		return "", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx, f}); err != nil {
+		return "", err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+
+	if got != want {
+		return "", fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, url, got, want)
+	}
+	return got, nil
+}
+
+// fetchChecksum returns the checksum published at url+".sha256", or an empty
+// string if there is none. It reports whether a failure is worth retrying.
+func fetchChecksum(ctx context.Context, url string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+".sha256", nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode >= 500, &HTTPStatusError{URL: url + ".sha256", StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	// Accept both a bare checksum and sha256sum output
+	sidecar, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", true, err
+	}
+	fields := strings.Fields(string(sidecar))
+	if len(fields) == 0 {
+		return "", false, fmt.Errorf("%s.sha256: empty", url)
+	}
+	return strings.ToLower(fields[0]), false, nil
+}
+
+// parseContentRange parses a header of the form "bytes start-end/size".
+func parseContentRange(header string) (start, end, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New("invalid Content-Range")
+	}
+	rangeSpec, sizeSpec, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errors.New("invalid Content-Range")
+	}
+	startSpec, endSpec, ok := strings.Cut(rangeSpec, "-")
+	if !ok {
+		return 0, 0, 0, errors.New("invalid Content-Range")
+	}
+	if start, err = strconv.ParseInt(startSpec, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseInt(endSpec, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if size, err = strconv.ParseInt(sizeSpec, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	return start, end, size, nil
+}
+
+func readDownloadState(path string) (downloadState, error) {
+	data, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return downloadState{}, err
+	}
+	var state downloadState
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writeDownloadState(path string, state downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".json.tmp"
+	if err := os.WriteFile(tmpPath, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path+".json")
+}
+
+type progressReader struct {
+	r          io.Reader
+	n          int64
+	total      int64
+	lastReport int64
+	progress   func(LoadProgress)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n-r.lastReport >= downloadProgressBytes {
+		r.lastReport = r.n
+		r.progress(LoadProgress{Phase: PhaseDownloading, Bytes: r.n, TotalBytes: r.total})
+	}
+	return n, err
+}
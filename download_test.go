@@ -0,0 +1,188 @@
+package geograph
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	data       []byte
+	etag       string
+	sha256     string
+	interrupts atomic.Int32 // number of responses to cut off halfway
+	fullGets   atomic.Int32
+	// sidecarFailures is the number of checksum requests to fail
+	sidecarFailures atomic.Int32
+	// republish replaces the object before its checksum is next requested
+	republish *testObject
+}
+
+func (o *testObject) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if filepath.Ext(r.URL.Path) == ".sha256" {
+		if o.sidecarFailures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if o.republish != nil {
+			o.data, o.etag, o.sha256 = o.republish.data, o.republish.etag, o.republish.sha256
+			o.republish = nil
+		}
+		if o.sha256 == "" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(o.sha256 + "  meta.ndjson.gz\n"))
+		return
+	}
+
+	w.Header().Set("ETag", o.etag)
+	if r.Header.Get("Range") == "" && r.Header.Get("If-None-Match") != o.etag {
+		o.fullGets.Add(1)
+	}
+	if o.interrupts.Add(-1) >= 0 {
+		w.Header().Set("Content-Length", "1000000")
+		_, _ = w.Write(o.data[:len(o.data)/2])
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(o.data))
+}
+
+func newTestObject(t *testing.T, etag string) *testObject {
+	t.Helper()
+	data, err := os.ReadFile(writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56)))
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	return &testObject{data: data, etag: etag, sha256: hex.EncodeToString(sum[:])}
+}
+
+func TestDownload(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "download")
+	url := srv.URL + "/meta.ndjson.gz"
+
+	require.NoError(t, download(context.Background(), url, path, func(LoadProgress) {}))
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, obj.data, got)
+
+	require.NoError(t, download(context.Background(), url, path, func(LoadProgress) {}))
+	assert.Equal(t, int32(1), obj.fullGets.Load(), "should reuse cached download")
+
+	obj.etag = `"v2"`
+	require.NoError(t, download(context.Background(), url, path, func(LoadProgress) {}))
+	assert.Equal(t, int32(2), obj.fullGets.Load(), "should download changed object")
+}
+
+func TestDownloadResume(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	obj.data = bytes.Repeat(obj.data, 1000)
+	sum := sha256.Sum256(obj.data)
+	obj.sha256 = hex.EncodeToString(sum[:])
+	obj.interrupts.Store(1)
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "download")
+
+	require.NoError(t, download(context.Background(), srv.URL+"/meta.ndjson.gz", path, func(LoadProgress) {}))
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, obj.data, got)
+	assert.Equal(t, int32(1), obj.fullGets.Load(), "should resume with a range request")
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	obj.sha256 = hex.EncodeToString(make([]byte, sha256.Size))
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+
+	_, err := Open(context.Background(), srv.URL+"/meta.ndjson.gz", OpenOptions{DataDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestDownloadChecksumRetry(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	obj.sidecarFailures.Store(1)
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "download")
+
+	require.NoError(t, download(context.Background(), srv.URL+"/meta.ndjson.gz", path, func(LoadProgress) {}))
+	state, err := readDownloadState(path)
+	require.NoError(t, err)
+	assert.Equal(t, obj.sha256, state.SHA256)
+}
+
+func TestDownloadChecksumMissing(t *testing.T) {
+	prevDelay := downloadRetryDelay
+	downloadRetryDelay = time.Millisecond
+	t.Cleanup(func() { downloadRetryDelay = prevDelay })
+
+	obj := newTestObject(t, `"v1"`)
+	obj.sha256 = ""
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "download")
+	url := srv.URL + "/meta.ndjson.gz"
+
+	require.NoError(t, download(context.Background(), url, path, func(LoadProgress) {}),
+		"should allow a download never published with a checksum")
+	state, err := readDownloadState(path)
+	require.NoError(t, err)
+	assert.Empty(t, state.SHA256, "should not record an unverified download as verified")
+
+	published := newTestObject(t, `"v2"`)
+	obj.etag, obj.sha256 = published.etag, published.sha256
+	require.NoError(t, download(context.Background(), url, path, func(LoadProgress) {}))
+	state, err = readDownloadState(path)
+	require.NoError(t, err)
+	assert.Equal(t, obj.sha256, state.SHA256)
+
+	obj.etag, obj.sha256 = `"v3"`, ""
+	err = download(context.Background(), url, path, func(LoadProgress) {})
+	assert.ErrorIs(t, err, ErrChecksumMissing, "should require a checksum once one has been published")
+	state, err = readDownloadState(path)
+	require.NoError(t, err)
+	assert.Empty(t, state.SHA256)
+}
+
+func TestDownloadRepublished(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	next := newTestObject(t, `"v2"`)
+	next.data = bytes.Repeat(next.data, 2)
+	sum := sha256.Sum256(next.data)
+	next.sha256 = hex.EncodeToString(sum[:])
+	obj.republish = next
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "download")
+
+	require.NoError(t, download(context.Background(), srv.URL+"/meta.ndjson.gz", path, func(LoadProgress) {}))
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, next.data, got)
+}
+
+func TestOpenRemote(t *testing.T) {
+	obj := newTestObject(t, `"v1"`)
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+
+	subject := openTestStore(t, srv.URL+"/meta.ndjson.gz", OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	_, err := subject.Get(2)
+	require.NoError(t, err)
+}
@@ -0,0 +1,145 @@
+package geograph
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Filter restricts the pictures returned by a query by their attributes. The
+// zero Filter matches every picture.
+//
+// Filters are evaluated while the index is traversed so that pages are full
+// and cursors resume after the last picture tested. A query tests at most
+// maxFilterExamined pictures per page, so a selective filter may give a page
+// with fewer pictures than asked for, or none, and a cursor to continue.
+type Filter struct {
+	// TakenAfter and TakenBefore match pictures taken on or after and before
+	// the dates. Pictures with an unknown date never match.
+	TakenAfter  time.Time
+	TakenBefore time.Time
+	UserID      int32
+	// ModerationStatus is such as "geograph" or "accepted".
+	ModerationStatus string
+	// Tag and TagPrefix match pictures with a tag with that name and prefix,
+	// ignoring case. If both are set they must match the same tag.
+	Tag       string
+	TagPrefix string
+	// MinSize matches pictures whose largest available size is at least this
+	// many pixels on the longer side.
+	MinSize      int32
+	HasViewpoint bool
+}
+
+func (f Filter) IsZero() bool {
+	return f == Filter{}
+}
+
+// Match reports whether pic matches every condition of f.
+func (f Filter) Match(pic *Picture) bool {
+	if !f.TakenAfter.IsZero() || !f.TakenBefore.IsZero() {
+		taken, ok := pic.TakenAt()
+		if !ok ||
+			(!f.TakenAfter.IsZero() && taken.Before(f.TakenAfter)) ||
+			(!f.TakenBefore.IsZero() && !taken.Before(f.TakenBefore)) {
+			return false
+		}
+	}
+	if f.UserID != 0 && pic.UserID != f.UserID {
+		return false
+	}
+	if f.ModerationStatus != "" && pic.ModerationStatus != f.ModerationStatus {
+		return false
+	}
+	if f.Tag != "" || f.TagPrefix != "" {
+		found := false
+		for _, t := range pic.Tags {
+			if (f.Tag == "" || strings.EqualFold(t.Tag, f.Tag)) &&
+				(f.TagPrefix == "" || strings.EqualFold(t.Prefix, f.TagPrefix)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinSize != 0 && max(pic.OriginalSize(), pic.Width, pic.Height) < f.MinSize {
+		return false
+	}
+	if f.HasViewpoint {
+		if _, ok := pic.Viewpoint(); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// queryParams identifies f in a queryHash.
+func (f Filter) queryParams() []any {
+	var flags byte
+	if f.HasViewpoint {
+		flags |= 1
+	}
+	params := []any{f.TakenAfter.UnixNano(), f.TakenBefore.UnixNano(), f.UserID, f.MinSize, flags}
+	for _, s := range []string{f.ModerationStatus, strings.ToLower(f.Tag), strings.ToLower(f.TagPrefix)} {
+		params = append(params, int32(len(s)), []byte(s))
+	}
+	return params
+}
+
+// maxFilterExamined is the most pictures a query fetches to test against its
+// filter, or tests against its polygon, for a page.
+var maxFilterExamined = 10_000
+
+// filterer tests the pictures visited by a query against a filter, keeping
+// those that match so that they don't need to be fetched again.
+type filterer struct {
+	store    *Store
+	filter   Filter
+	matched  map[int32]*Picture
+	examined int
+	err      error
+}
+
+func (s *Store) newFilterer(filter Filter) *filterer {
+	return &filterer{store: s, filter: filter, matched: make(map[int32]*Picture)}
+}
+
+// accept is for traversing the index. It returns nil if every item is
+// accepted. The traversal is stopped once maxFilterExamined items have been
+// tested or an error occurs.
+func (f *filterer) accept() acceptFunc {
+	if f.filter.IsZero() {
+		return nil
+	}
+	return func(id int32, _ [2]float32) (bool, bool) {
+		if f.err != nil {
+			return false, false
+		}
+		f.examined++
+		more := f.examined < maxFilterExamined
+
+		pic, err := f.store.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			return false, more
+		} else if err != nil {
+			f.err = err
+			return false, false
+		}
+		if !f.filter.Match(pic) {
+			return false, more
+		}
+		f.matched[id] = pic
+		return true, more
+	}
+}
+
+// get returns an accepted picture.
+func (f *filterer) get(id int32) (*Picture, error) {
+	if pic, ok := f.matched[id]; ok {
+		return pic, nil
+	}
+	return f.store.Get(id)
+}
@@ -0,0 +1,134 @@
+package geograph
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	pic := &Picture{
+		UserID:           7,
+		ModerationStatus: "geograph",
+		ImageTaken:       "2015-06-01",
+		Width:            640,
+		Height:           480,
+		OriginalWidth:    1600,
+		Tags:             []Tag{{Prefix: "top", Tag: "Coastal"}, {Tag: "cliff"}},
+	}
+	date := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return v
+	}
+
+	cases := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{TakenAfter: date("2015-06-01")}, true},
+		{Filter{TakenAfter: date("2015-06-02")}, false},
+		{Filter{TakenBefore: date("2015-06-01")}, false},
+		{Filter{TakenBefore: date("2015-06-02")}, true},
+		{Filter{UserID: 7}, true},
+		{Filter{UserID: 8}, false},
+		{Filter{ModerationStatus: "accepted"}, false},
+		{Filter{Tag: "coastal"}, true},
+		{Filter{TagPrefix: "top"}, true},
+		{Filter{TagPrefix: "top", Tag: "cliff"}, false},
+		{Filter{MinSize: 1600}, true},
+		{Filter{MinSize: 1601}, false},
+		{Filter{HasViewpoint: true}, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.filter.Match(pic), "%+v", c.filter)
+	}
+}
+
+func TestFilteredPagination(t *testing.T) {
+	var records []string
+	for i := range int32(40) {
+		records = append(records, fmt.Sprintf(
+			`{"gridimage_id":%d,"user_id":%d,"realname":"Test User","wgs84_long":%f,"wgs84_lat":56}`,
+			i+1, i%3, -3+float32(i)*0.001))
+	}
+	subject := openTestStore(t, writeTestDump(t, records...), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	filter := Filter{UserID: 1}
+
+	var got []int32
+	cursor := ""
+	for {
+		hasNext, next, pictures, err := subject.Near(Point(-3, 56), SubjectIndex, 4, cursor, 0, filter)
+		require.NoError(t, err)
+		if hasNext {
+			assert.Len(t, pictures, 4, "pages should be full")
+		}
+		for _, pic := range pictures {
+			assert.Equal(t, int32(1), pic.UserID)
+			got = append(got, pic.ID)
+		}
+		if !hasNext {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(t, got, 13)
+
+	_, _, all, err := subject.Within(Point(-4, 55), Point(-2, 57), SubjectIndex, 100, "", filter)
+	require.NoError(t, err)
+	assert.Len(t, all, 13)
+
+	_, _, _, err = subject.Near(Point(-3, 56), SubjectIndex, 4, cursor, 0, Filter{UserID: 2})
+	assert.ErrorIs(t, err, ErrInvalidCursor, "should reject a cursor for a different filter")
+}
+
+func TestFilterExaminedLimit(t *testing.T) {
+	prevLimit := maxFilterExamined
+	maxFilterExamined = 5
+	t.Cleanup(func() { maxFilterExamined = prevLimit })
+
+	var records []string
+	for i := range int32(40) {
+		userID := 0
+		if i >= 30 {
+			userID = 1
+		}
+		records = append(records, fmt.Sprintf(
+			`{"gridimage_id":%d,"user_id":%d,"realname":"Test User","wgs84_long":%f,"wgs84_lat":56}`,
+			i+1, userID, -3+float32(i)*0.001))
+	}
+	subject := openTestStore(t, writeTestDump(t, records...), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	filter := Filter{UserID: 1}
+
+	for name, query := range map[string]func(cursor string) (bool, string, []*Picture, error){
+		"near": func(cursor string) (bool, string, []*Picture, error) {
+			return subject.Near(Point(-3, 56), SubjectIndex, 4, cursor, 0, filter)
+		},
+		"within": func(cursor string) (bool, string, []*Picture, error) {
+			return subject.Within(Point(-4, 55), Point(-2, 57), SubjectIndex, 4, cursor, filter)
+		},
+	} {
+		var got []int32
+		pages := 0
+		cursor := ""
+		for {
+			hasNext, next, pictures, err := query(cursor)
+			require.NoError(t, err)
+			pages++
+			for _, pic := range pictures {
+				got = append(got, pic.ID)
+			}
+			if !hasNext {
+				break
+			}
+			cursor = next
+		}
+		assert.Len(t, got, 10, name)
+		assert.GreaterOrEqual(t, pages, 8, "%s: should stop pages after examining the limit", name)
+	}
+}
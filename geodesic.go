@@ -0,0 +1,100 @@
+package geograph
+
+import (
+	"math"
+)
+
+const earthRadiusMeters = 6371e3
+
+// Distances between lng/lat points are compared as the haversine of the
+// central angle between them, which increases monotonically with the
+// great-circle distance and is cheaper to compute.
+
+// geoTarget is a query point prepared for distance calculations.
+type geoTarget struct {
+	lng, lat float64 // radians
+	cosLat   float64
+}
+
+func newGeoTarget(p [2]float32) geoTarget {
+	lat := degreesToRadians(float64(p[1]))
+	return geoTarget{lng: degreesToRadians(float64(p[0])), lat: lat, cosLat: math.Cos(lat)}
+}
+
+func haverSin(theta float64) float64 {
+	s := math.Sin(theta / 2)
+	return s * s
+}
+
+// dist is the haversine of the angle between t and p.
+func (t geoTarget) dist(p [2]float32) float64 {
+	lng := degreesToRadians(float64(p[0]))
+	lat := degreesToRadians(float64(p[1]))
+	return t.distPartial(haverSin(t.lng-lng), lat)
+}
+
+func (t geoTarget) distPartial(haverSinDLng float64, lat float64) float64 {
+	return t.cosLat*math.Cos(lat)*haverSinDLng + haverSin(t.lat-lat)
+}
+
+// boxDist is a lower bound of dist to any point in the box, after
+// https://github.com/mourner/geokdbush.
+func (t geoTarget) boxDist(min, max [2]float32) float64 {
+	minLng, minLat := degreesToRadians(float64(min[0])), degreesToRadians(float64(min[1]))
+	maxLng, maxLat := degreesToRadians(float64(max[0])), degreesToRadians(float64(max[1]))
+
+	// Between the meridians of the box the closest point is due north or south
+	if t.lng >= minLng && t.lng <= maxLng {
+		if t.lat < minLat {
+			return haverSin(t.lat - minLat)
+		}
+		if t.lat > maxLat {
+			return haverSin(t.lat - maxLat)
+		}
+		return 0
+	}
+
+	// Otherwise it is on the closer meridian, either where the great circle
+	// through the target perpendicular to the meridian crosses it or at a
+	// corner
+	haverSinDLng := math.Min(haverSin(t.lng-minLng), haverSin(t.lng-maxLng))
+	extremumLat := vertexLat(t.lat, haverSinDLng)
+	if extremumLat > minLat && extremumLat < maxLat {
+		return t.distPartial(haverSinDLng, extremumLat)
+	}
+	return math.Min(t.distPartial(haverSinDLng, minLat), t.distPartial(haverSinDLng, maxLat))
+}
+
+// boxMaxDist is an upper bound of dist to any point in the box. Along a
+// parallel the distance grows with the difference in longitude, and along a
+// meridian less than 90° away it only has a minimum, so the furthest point is
+// a corner. Boxes that extend further than 90° get the trivial bound.
+func (t geoTarget) boxMaxDist(min, max [2]float32) float64 {
+	minLng, minLat := degreesToRadians(float64(min[0])), degreesToRadians(float64(min[1]))
+	maxLng, maxLat := degreesToRadians(float64(max[0])), degreesToRadians(float64(max[1]))
+
+	if math.Abs(t.lng-minLng) > math.Pi/2 || math.Abs(t.lng-maxLng) > math.Pi/2 {
+		return 1
+	}
+	haverSinDLng := math.Max(haverSin(t.lng-minLng), haverSin(t.lng-maxLng))
+	return math.Max(t.distPartial(haverSinDLng, minLat), t.distPartial(haverSinDLng, maxLat))
+}
+
+func vertexLat(lat float64, haverSinDLng float64) float64 {
+	cosDLng := 1 - 2*haverSinDLng
+	if cosDLng <= 0 {
+		if lat > 0 {
+			return math.Pi / 2
+		}
+		return -math.Pi / 2
+	}
+	return math.Atan(math.Tan(lat) / cosDLng)
+}
+
+func haverToMeters(h float64) float64 {
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+func metersToHaver(meters float64) float64 {
+	return haverSin(meters / earthRadiusMeters)
+}
@@ -0,0 +1,51 @@
+package geograph
+
+import (
+	"encoding/json"
+)
+
+// Feature is a GeoJSON Feature.
+type Feature struct {
+	Type       string          `json:"type"`
+	ID         any             `json:"id,omitempty"`
+	Geometry   Geometry        `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// Geometry is a GeoJSON Point or LineString.
+type Geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// PictureFeatures returns pic as a GeoJSON Point feature with properties. The
+// point is the subject for SubjectIndex and the viewpoint for ViewpointIndex,
+// falling back to the subject for pictures without a viewpoint.
+//
+// If sightLine is true and pic has a viewpoint it is followed by a LineString
+// feature from the viewpoint to the subject with the same properties.
+func PictureFeatures(pic *Picture, index IndexType, sightLine bool, properties json.RawMessage) []Feature {
+	subject := pic.Subject()
+	viewpoint, hasViewpoint := pic.Viewpoint()
+
+	point := subject
+	if index == ViewpointIndex && hasViewpoint {
+		point = viewpoint
+	}
+
+	out := []Feature{{
+		Type:       "Feature",
+		ID:         pic.ID,
+		Geometry:   Geometry{Type: "Point", Coordinates: point},
+		Properties: properties,
+	}}
+
+	if sightLine && hasViewpoint {
+		out = append(out, Feature{
+			Type:       "Feature",
+			Geometry:   Geometry{Type: "LineString", Coordinates: [][2]float32{viewpoint, subject}},
+			Properties: properties,
+		})
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+package geograph
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPictureFeatures(t *testing.T) {
+	pic := &Picture{ID: 7, Lng: -3.5, Lat: 56.25, ViewpointLng: -3.25, ViewpointLat: 56.5}
+	props := json.RawMessage(`{"title":"Loch"}`)
+
+	got, err := json.Marshal(PictureFeatures(pic, ViewpointIndex, true, props))
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type":"Feature","id":7,"geometry":{"type":"Point","coordinates":[-3.25,56.5]},"properties":{"title":"Loch"}},
+		{"type":"Feature","geometry":{"type":"LineString","coordinates":[[-3.25,56.5],[-3.5,56.25]]},"properties":{"title":"Loch"}}
+	]`, string(got))
+
+	got, err = json.Marshal(PictureFeatures(pic, SubjectIndex, false, props))
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type":"Feature","id":7,"geometry":{"type":"Point","coordinates":[-3.5,56.25]},"properties":{"title":"Loch"}}
+	]`, string(got))
+
+	// Without a viewpoint there is no sight line and the subject is used
+	noViewpoint := &Picture{ID: 8, Lng: -3.5, Lat: 56.25}
+	features := PictureFeatures(noViewpoint, ViewpointIndex, true, props)
+	require.Len(t, features, 1)
+	assert.Equal(t, Point(-3.5, 56.25), features[0].Geometry.Coordinates)
+}
@@ -0,0 +1,259 @@
+// Package gridref parses and formats British (OSGB36, EPSG:27700) and Irish
+// (EPSG:29903) grid references and converts them to and from WGS84.
+//
+// Conversions use a Helmert transformation between datums, which is accurate
+// to a few meters. That is finer than the grid squares Geograph works in but
+// not good enough for surveying.
+package gridref
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Grid is a national grid.
+type Grid int
+
+const (
+	// OSGB is the Ordnance Survey National Grid of Great Britain
+	OSGB Grid = iota + 1
+	// Irish is the Irish Grid, covering Northern Ireland and the Republic of
+	// Ireland
+	Irish
+)
+
+func (g Grid) String() string {
+	switch g {
+	case OSGB:
+		return "OSGB"
+	case Irish:
+		return "Irish"
+	default:
+		return fmt.Sprintf("Grid(%d)", int(g))
+	}
+}
+
+// MaxDigits is the most digits of easting or northing in a reference, which
+// gives a 1m square.
+const MaxDigits = 5
+
+var ErrInvalid = errors.New("invalid grid reference")
+
+// ErrOutOfRange is returned for a position outside the lettered squares of
+// the grid.
+var ErrOutOfRange = errors.New("position is outside the grid")
+
+// Ref is a square on a grid, such as "NT2573" or "J3374".
+type Ref struct {
+	Grid Grid
+	// Easting and Northing are of the south-west corner in meters
+	Easting  int
+	Northing int
+	// Digits is how many digits of easting and of northing the reference
+	// has, from 0 for a 100km square to MaxDigits for a 1m square
+	Digits int
+}
+
+// Parse parses a reference made of the letters of a 100km square and an even
+// number of digits, ignoring case and spaces. References with two letters are
+// on the OSGB grid and those with one on the Irish grid.
+func Parse(s string) (Ref, error) {
+	ref := strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+
+	letters := 0
+	for letters < len(ref) && letters < 2 && ref[letters] >= 'A' && ref[letters] <= 'Z' {
+		letters++
+	}
+	digits := ref[letters:]
+	if letters == 0 || len(digits)%2 != 0 || len(digits) > 2*MaxDigits {
+		return Ref{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Ref{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+		}
+	}
+
+	var r Ref
+	var ok bool
+	if letters == 2 {
+		r.Grid = OSGB
+		r.Easting, r.Northing, ok = osgbSquareOrigin(ref[0], ref[1])
+	} else {
+		r.Grid = Irish
+		r.Easting, r.Northing, ok = irishSquareOrigin(ref[0])
+	}
+	if !ok {
+		return Ref{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+
+	r.Digits = len(digits) / 2
+	size := r.Size()
+	for i := range r.Digits {
+		r.Easting += int(digits[i]-'0') * size * pow10(r.Digits-1-i)
+		r.Northing += int(digits[r.Digits+i]-'0') * size * pow10(r.Digits-1-i)
+	}
+	return r, nil
+}
+
+// At returns the square with digits containing the grid position easting,
+// northing.
+func At(grid Grid, easting, northing float64, digits int) (Ref, error) {
+	if digits < 0 || digits > MaxDigits {
+		return Ref{}, fmt.Errorf("digits must be between 0 and %d", MaxDigits)
+	}
+	var maxEasting, maxNorthing float64
+	switch grid {
+	case OSGB:
+		maxEasting, maxNorthing = 700_000, 1_300_000
+	case Irish:
+		maxEasting, maxNorthing = 500_000, 500_000
+	default:
+		return Ref{}, fmt.Errorf("unknown grid %s", grid)
+	}
+	if !(easting >= 0 && easting < maxEasting && northing >= 0 && northing < maxNorthing) {
+		return Ref{}, ErrOutOfRange
+	}
+
+	r := Ref{Grid: grid, Digits: digits}
+	size := r.Size()
+	r.Easting = int(easting) / size * size
+	r.Northing = int(northing) / size * size
+	return r, nil
+}
+
+// FromLngLat returns the square with digits containing the WGS84 point.
+func FromLngLat(grid Grid, lng, lat float64, digits int) (Ref, error) {
+	easting, northing := FromWGS84(grid, lng, lat)
+	return At(grid, easting, northing, digits)
+}
+
+// Size is the length of the sides of r in meters.
+func (r Ref) Size() int {
+	return pow10(MaxDigits - r.Digits)
+}
+
+// Center returns the grid position of the center of r.
+func (r Ref) Center() (easting, northing float64) {
+	half := float64(r.Size()) / 2
+	return float64(r.Easting) + half, float64(r.Northing) + half
+}
+
+// LngLat returns the WGS84 position of the center of r.
+func (r Ref) LngLat() (lng, lat float64) {
+	easting, northing := r.Center()
+	return ToWGS84(r.Grid, easting, northing)
+}
+
+// Bounds returns the WGS84 bounding box of r. As grid north isn't true north
+// the box is slightly larger than the square.
+func (r Ref) Bounds() (min, max [2]float64) {
+	size := float64(r.Size())
+	for i, corner := range [][2]float64{{0, 0}, {size, 0}, {0, size}, {size, size}} {
+		lng, lat := ToWGS84(r.Grid, float64(r.Easting)+corner[0], float64(r.Northing)+corner[1])
+		if i == 0 {
+			min, max = [2]float64{lng, lat}, [2]float64{lng, lat}
+			continue
+		}
+		min = [2]float64{math.Min(min[0], lng), math.Min(min[1], lat)}
+		max = [2]float64{math.Max(max[0], lng), math.Max(max[1], lat)}
+	}
+	return min, max
+}
+
+// String formats r without spaces, as Geograph does.
+func (r Ref) String() string {
+	var letters string
+	switch r.Grid {
+	case OSGB:
+		letters = osgbSquareLetters(r.Easting, r.Northing)
+	case Irish:
+		letters = irishSquareLetter(r.Easting, r.Northing)
+	}
+	if letters == "" || r.Digits < 0 || r.Digits > MaxDigits {
+		return fmt.Sprintf("%s(%d,%d)", r.Grid, r.Easting, r.Northing)
+	}
+	if r.Digits == 0 {
+		return letters
+	}
+	scale := r.Size()
+	return fmt.Sprintf("%s%0*d%0*d", letters,
+		r.Digits, r.Easting%100_000/scale,
+		r.Digits, r.Northing%100_000/scale)
+}
+
+// The OSGB grid is lettered in 500km squares, each divided into 25 100km
+// squares, lettered A to Z without I from the north-west. The false origin is
+// the south-west corner of SV.
+
+func osgbSquareOrigin(l1, l2 byte) (easting, northing int, ok bool) {
+	i1, ok1 := letterIndex(l1)
+	i2, ok2 := letterIndex(l2)
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	e := (i1-2)%5*5 + i2%5
+	n := 19 - i1/5*5 - i2/5
+	if e < 0 || e >= 7 || n < 0 || n >= 13 {
+		return 0, 0, false
+	}
+	return e * 100_000, n * 100_000, true
+}
+
+func osgbSquareLetters(easting, northing int) string {
+	e, n := easting/100_000, northing/100_000
+	if easting < 0 || northing < 0 || e >= 7 || n >= 13 {
+		return ""
+	}
+	i1 := (19-n)/5*5 + (e+10)/5
+	i2 := (19-n)*5%25 + e%5
+	return string([]byte{indexLetter(i1), indexLetter(i2)})
+}
+
+// The Irish grid has a single 500km square of 25 100km squares, lettered as
+// OSGB's.
+
+func irishSquareOrigin(l byte) (easting, northing int, ok bool) {
+	i, ok := letterIndex(l)
+	if !ok {
+		return 0, 0, false
+	}
+	return i % 5 * 100_000, (4 - i/5) * 100_000, true
+}
+
+func irishSquareLetter(easting, northing int) string {
+	e, n := easting/100_000, northing/100_000
+	if easting < 0 || northing < 0 || e >= 5 || n >= 5 {
+		return ""
+	}
+	return string([]byte{indexLetter((4-n)*5 + e)})
+}
+
+// letterIndex is the position of l in the alphabet without I.
+func letterIndex(l byte) (int, bool) {
+	switch {
+	case l < 'A' || l > 'Z' || l == 'I':
+		return 0, false
+	case l > 'I':
+		return int(l-'A') - 1, true
+	default:
+		return int(l - 'A'), true
+	}
+}
+
+func indexLetter(i int) byte {
+	if i >= int('I'-'A') {
+		i++
+	}
+	return byte('A' + i)
+}
+
+func pow10(n int) int {
+	out := 1
+	for range n {
+		out *= 10
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package gridref
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Ref
+		str  string
+	}{
+		{"NT", Ref{Grid: OSGB, Easting: 300_000, Northing: 600_000}, "NT"},
+		{"nt27", Ref{Grid: OSGB, Easting: 320_000, Northing: 670_000, Digits: 1}, "NT27"},
+		{"NT 25 73", Ref{Grid: OSGB, Easting: 325_000, Northing: 673_000, Digits: 2}, "NT2573"},
+		{"SV0000", Ref{Grid: OSGB, Digits: 2}, "SV0000"},
+		{"TG 51409 13177", Ref{Grid: OSGB, Easting: 651_409, Northing: 313_177, Digits: 5}, "TG5140913177"},
+		{"HP6016", Ref{Grid: OSGB, Easting: 460_000, Northing: 1_216_000, Digits: 2}, "HP6016"},
+		{"J3374", Ref{Grid: Irish, Easting: 333_000, Northing: 374_000, Digits: 2}, "J3374"},
+		{"V", Ref{Grid: Irish}, "V"},
+		{"O 159 344", Ref{Grid: Irish, Easting: 315_900, Northing: 234_400, Digits: 3}, "O159344"},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.in)
+		require.NoError(t, err, c.in)
+		assert.Equal(t, c.want, got, c.in)
+		assert.Equal(t, c.str, got.String(), c.in)
+	}
+
+	for _, in := range []string{"", "12", "NT2", "NT25a3", "NI", "AA", "NT123456789012", "I12"} {
+		_, err := Parse(in)
+		assert.ErrorIs(t, err, ErrInvalid, in)
+	}
+}
+
+func TestAt(t *testing.T) {
+	got, err := At(OSGB, 325_999.9, 673_000, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "NT2573", got.String())
+
+	_, err = At(OSGB, -1, 0, 2)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = At(Irish, 500_000, 0, 2)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+}
+
+func TestProjection(t *testing.T) {
+	// The worked example in Ordnance Survey's "A guide to coordinate systems
+	// in Great Britain", on OSGB36
+	p := projections[OSGB]
+	e, n := p.forward(52+39.0/60+27.2531/3600, 1+43.0/60+4.5177/3600)
+	assert.InDelta(t, 651409.903, e, 0.001)
+	assert.InDelta(t, 313177.270, n, 0.001)
+
+	lat, lng := p.inverse(651409.903, 313177.270)
+	assert.InDelta(t, 52+39.0/60+27.2531/3600, lat, 1e-8)
+	assert.InDelta(t, 1+43.0/60+4.5177/3600, lng, 1e-8)
+
+	e, n = projections[Irish].forward(53.5, -8)
+	assert.InDelta(t, 200_000, e, 0.001)
+	assert.InDelta(t, 250_000, n, 0.001)
+}
+
+func TestWGS84(t *testing.T) {
+	// Ben Nevis summit
+	ref, err := Parse("NN 16667 71285")
+	require.NoError(t, err)
+	lng, lat := ToWGS84(OSGB, float64(ref.Easting), float64(ref.Northing))
+	assert.InDelta(t, -5.00360, lng, 0.0002)
+	assert.InDelta(t, 56.79685, lat, 0.0002)
+
+	for _, grid := range []Grid{OSGB, Irish} {
+		e, n := FromWGS84(grid, -6.26031, 53.34981)
+		gotLng, gotLat := ToWGS84(grid, e, n)
+		assert.InDelta(t, -6.26031, gotLng, 1e-7, grid)
+		assert.InDelta(t, 53.34981, gotLat, 1e-7, grid)
+	}
+
+	// The Spire, Dublin
+	dublin, err := FromLngLat(Irish, -6.26031, 53.34981, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "O1534", dublin.String())
+
+	lng, lat = ref.LngLat()
+	min, max := ref.Bounds()
+	assert.Less(t, min[0], lng)
+	assert.Less(t, min[1], lat)
+	assert.Greater(t, max[0], lng)
+	assert.Greater(t, max[1], lat)
+}
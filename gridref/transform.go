@@ -0,0 +1,203 @@
+package gridref
+
+import (
+	"math"
+)
+
+type ellipsoid struct {
+	a, b float64
+}
+
+func (e ellipsoid) eccSquared() float64 {
+	return 1 - e.b*e.b/(e.a*e.a)
+}
+
+var (
+	wgs84         = ellipsoid{a: 6378137, b: 6356752.314245}
+	airy1830      = ellipsoid{a: 6377563.396, b: 6356256.909}
+	airyModified  = ellipsoid{a: 6377340.189, b: 6356034.448}
+	arcSecondsRad = math.Pi / 180 / 3600
+)
+
+// helmert is a seven parameter transformation from WGS84, with translations
+// in meters, rotations in arc seconds and scale in parts per million.
+type helmert struct {
+	tx, ty, tz float64
+	rx, ry, rz float64
+	s          float64
+}
+
+func (h helmert) inverse() helmert {
+	return helmert{tx: -h.tx, ty: -h.ty, tz: -h.tz, rx: -h.rx, ry: -h.ry, rz: -h.rz, s: -h.s}
+}
+
+func (h helmert) apply(x, y, z float64) (float64, float64, float64) {
+	s := 1 + h.s/1e6
+	rx, ry, rz := h.rx*arcSecondsRad, h.ry*arcSecondsRad, h.rz*arcSecondsRad
+	return h.tx + x*s - y*rz + z*ry,
+		h.ty + x*rz + y*s - z*rx,
+		h.tz - x*ry + y*rx + z*s
+}
+
+// transverseMercator is the projection of a grid.
+type transverseMercator struct {
+	ellipsoid     ellipsoid
+	fromWGS84     helmert
+	scale         float64 // on the central meridian
+	originLat     float64 // degrees
+	originLng     float64 // degrees
+	falseEasting  float64
+	falseNorthing float64
+}
+
+var projections = map[Grid]transverseMercator{
+	// OSGB36, after Ordnance Survey's "A guide to coordinate systems in Great
+	// Britain"
+	OSGB: {
+		ellipsoid:     airy1830,
+		fromWGS84:     helmert{tx: -446.448, ty: 125.157, tz: -542.060, rx: -0.1502, ry: -0.2470, rz: -0.8421, s: 20.4894},
+		scale:         0.9996012717,
+		originLat:     49,
+		originLng:     -2,
+		falseEasting:  400_000,
+		falseNorthing: -100_000,
+	},
+	// Ireland 1965 (TM75)
+	Irish: {
+		ellipsoid:     airyModified,
+		fromWGS84:     helmert{tx: -482.530, ty: 130.596, tz: -564.557, rx: 1.042, ry: 0.214, rz: 0.631, s: -8.150},
+		scale:         1.000035,
+		originLat:     53.5,
+		originLng:     -8,
+		falseEasting:  200_000,
+		falseNorthing: 250_000,
+	},
+}
+
+// ToWGS84 converts a position on grid to WGS84 degrees.
+func ToWGS84(grid Grid, easting, northing float64) (lng, lat float64) {
+	p := projections[grid]
+	lat, lng = p.inverse(easting, northing)
+	lat, lng = convertDatum(lat, lng, p.ellipsoid, wgs84, p.fromWGS84.inverse())
+	return lng, lat
+}
+
+// FromWGS84 converts WGS84 degrees to a position on grid. Positions far
+// outside the area the grid covers are distorted.
+func FromWGS84(grid Grid, lng, lat float64) (easting, northing float64) {
+	p := projections[grid]
+	lat, lng = convertDatum(lat, lng, wgs84, p.ellipsoid, p.fromWGS84)
+	return p.forward(lat, lng)
+}
+
+// convertDatum converts degrees on one datum to another through geocentric
+// cartesian coordinates, ignoring height.
+func convertDatum(lat, lng float64, from, to ellipsoid, h helmert) (float64, float64) {
+	phi, lambda := lat*math.Pi/180, lng*math.Pi/180
+
+	e2 := from.eccSquared()
+	sinPhi, cosPhi := math.Sincos(phi)
+	nu := from.a / math.Sqrt(1-e2*sinPhi*sinPhi)
+	x := nu * cosPhi * math.Cos(lambda)
+	y := nu * cosPhi * math.Sin(lambda)
+	z := nu * (1 - e2) * sinPhi
+
+	x, y, z = h.apply(x, y, z)
+
+	// Bowring's method
+	e2 = to.eccSquared()
+	eps2 := e2 / (1 - e2)
+	p := math.Hypot(x, y)
+	r := math.Hypot(p, z)
+	beta := math.Atan2(to.b*z*(1+eps2*to.b/r), to.a*p)
+	sinBeta, cosBeta := math.Sincos(beta)
+	phi = math.Atan2(z+eps2*to.b*sinBeta*sinBeta*sinBeta, p-e2*to.a*cosBeta*cosBeta*cosBeta)
+	lambda = math.Atan2(y, x)
+
+	return phi * 180 / math.Pi, lambda * 180 / math.Pi
+}
+
+// meridionalArc is the distance from the origin parallel to phi along the
+// central meridian, scaled.
+func (p transverseMercator) meridionalArc(phi float64) float64 {
+	a, b := p.ellipsoid.a, p.ellipsoid.b
+	n := (a - b) / (a + b)
+	n2, n3 := n*n, n*n*n
+	phi0 := p.originLat * math.Pi / 180
+
+	ma := (1 + n + 5.0/4*n2 + 5.0/4*n3) * (phi - phi0)
+	mb := (3*n + 3*n2 + 21.0/8*n3) * math.Sin(phi-phi0) * math.Cos(phi+phi0)
+	mc := (15.0/8*n2 + 15.0/8*n3) * math.Sin(2*(phi-phi0)) * math.Cos(2*(phi+phi0))
+	md := 35.0 / 24 * n3 * math.Sin(3*(phi-phi0)) * math.Cos(3*(phi+phi0))
+	return b * p.scale * (ma - mb + mc - md)
+}
+
+// radii returns the radii of curvature at phi, scaled, across and along the
+// meridian.
+func (p transverseMercator) radii(phi float64) (nu, rho float64) {
+	e2 := p.ellipsoid.eccSquared()
+	sin2 := math.Sin(phi) * math.Sin(phi)
+	nu = p.ellipsoid.a * p.scale / math.Sqrt(1-e2*sin2)
+	rho = p.ellipsoid.a * p.scale * (1 - e2) / math.Pow(1-e2*sin2, 1.5)
+	return nu, rho
+}
+
+func (p transverseMercator) forward(lat, lng float64) (easting, northing float64) {
+	phi := lat * math.Pi / 180
+	dLambda := (lng - p.originLng) * math.Pi / 180
+
+	sinPhi, cosPhi := math.Sincos(phi)
+	cos3, cos5 := cosPhi*cosPhi*cosPhi, math.Pow(cosPhi, 5)
+	tan2 := math.Tan(phi) * math.Tan(phi)
+	tan4 := tan2 * tan2
+	nu, rho := p.radii(phi)
+	eta2 := nu/rho - 1
+
+	i := p.meridionalArc(phi) + p.falseNorthing
+	ii := nu / 2 * sinPhi * cosPhi
+	iii := nu / 24 * sinPhi * cos3 * (5 - tan2 + 9*eta2)
+	iiia := nu / 720 * sinPhi * cos5 * (61 - 58*tan2 + tan4)
+	iv := nu * cosPhi
+	v := nu / 6 * cos3 * (nu/rho - tan2)
+	vi := nu / 120 * cos5 * (5 - 18*tan2 + tan4 + 14*eta2 - 58*tan2*eta2)
+
+	d2 := dLambda * dLambda
+	northing = i + ii*d2 + iii*d2*d2 + iiia*d2*d2*d2
+	easting = p.falseEasting + iv*dLambda + v*d2*dLambda + vi*d2*d2*dLambda
+	return easting, northing
+}
+
+func (p transverseMercator) inverse(easting, northing float64) (lat, lng float64) {
+	aF0 := p.ellipsoid.a * p.scale
+	phi := p.originLat * math.Pi / 180
+	var m float64
+	for {
+		phi += (northing - p.falseNorthing - m) / aF0
+		m = p.meridionalArc(phi)
+		if math.Abs(northing-p.falseNorthing-m) < 0.00001 {
+			break
+		}
+	}
+
+	tanPhi := math.Tan(phi)
+	tan2 := tanPhi * tanPhi
+	tan4, tan6 := tan2*tan2, tan2*tan2*tan2
+	secPhi := 1 / math.Cos(phi)
+	nu, rho := p.radii(phi)
+	eta2 := nu/rho - 1
+	nu3, nu5, nu7 := nu*nu*nu, math.Pow(nu, 5), math.Pow(nu, 7)
+
+	vii := tanPhi / (2 * rho * nu)
+	viii := tanPhi / (24 * rho * nu3) * (5 + 3*tan2 + eta2 - 9*tan2*eta2)
+	ix := tanPhi / (720 * rho * nu5) * (61 + 90*tan2 + 45*tan4)
+	x := secPhi / nu
+	xi := secPhi / (6 * nu3) * (nu/rho + 2*tan2)
+	xii := secPhi / (120 * nu5) * (5 + 28*tan2 + 24*tan4)
+	xiia := secPhi / (5040 * nu7) * (61 + 662*tan2 + 1320*tan4 + 720*tan6)
+
+	dE := easting - p.falseEasting
+	d2 := dE * dE
+	phi = phi - vii*d2 + viii*d2*d2 - ix*d2*d2*d2
+	lambda := p.originLng*math.Pi/180 + x*dE - xi*d2*dE + xii*d2*d2*dE - xiia*d2*d2*d2*dE
+	return phi * 180 / math.Pi, lambda * 180 / math.Pi
+}
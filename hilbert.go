@@ -0,0 +1,122 @@
+package geograph
+
+import (
+	"math"
+	"sort"
+)
+
+const hilbertMax = 1<<16 - 1
+
+// bulkLoad sorts the items along a Hilbert curve over their bounds and packs
+// them into a tree. ids and points are reordered in place.
+func bulkLoad(ids []int32, points []float32) *packedTree {
+	minX, minY := float32(math.Inf(1)), float32(math.Inf(1))
+	maxX, maxY := float32(math.Inf(-1)), float32(math.Inf(-1))
+	for i := 0; i < len(points); i += 2 {
+		minX, minY = min(minX, points[i]), min(minY, points[i+1])
+		maxX, maxY = max(maxX, points[i]), max(maxY, points[i+1])
+	}
+	width, height := float64(maxX-minX), float64(maxY-minY)
+
+	values := make([]uint32, len(ids))
+	for i := range ids {
+		var x, y uint32
+		if width > 0 {
+			x = uint32(hilbertMax * float64(points[2*i]-minX) / width)
+		}
+		if height > 0 {
+			y = uint32(hilbertMax * float64(points[2*i+1]-minY) / height)
+		}
+		values[i] = hilbert(x, y)
+	}
+
+	sort.Sort(hilbertSorter{values: values, ids: ids, points: points})
+
+	return packTree(ids, points)
+}
+
+// hilbertSorter orders items by Hilbert value and then by id so that the same
+// input always packs into the same tree.
+type hilbertSorter struct {
+	values []uint32
+	ids    []int32
+	points []float32
+}
+
+func (s hilbertSorter) Len() int {
+	return len(s.values)
+}
+
+func (s hilbertSorter) Less(i, j int) bool {
+	if s.values[i] != s.values[j] {
+		return s.values[i] < s.values[j]
+	}
+	return s.ids[i] < s.ids[j]
+}
+
+func (s hilbertSorter) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.points[2*i], s.points[2*j] = s.points[2*j], s.points[2*i]
+	s.points[2*i+1], s.points[2*j+1] = s.points[2*j+1], s.points[2*i+1]
+}
+
+// hilbert computes the position of (x, y) along a Hilbert curve filling a
+// 2^16 by 2^16 grid.
+//
+// Based on the public domain <https://github.com/rawrunprotected/hilbert_curves>
+// as used by flatbush.
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a = A
+	b = B
+	c = C
+	d = D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a = A
+	b = B
+	c = C
+	d = D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a = A
+	b = B
+	c = C
+	d = D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
@@ -5,16 +5,16 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"github.com/tidwall/gjson"
+	"strconv"
 )
 
-func getImageHash(secret []byte, meta string) string {
+func getImageHash(secret []byte, pic *Picture) string {
 	/*  <https://github.com/geograph-project/geograph-project/blob/83ec6782fc81174480c6386c6ede90b0a0411d95/libs/geograph/gridimage.class.php#L445>
 	substr(md5($this->gridimage_id.$this->user_id.$CONF['photo_hashing_secret']), 0, 8)
 	*/
 
-	gridimageId := gjson.Get(meta, "gridimage_id").String()
-	userId := gjson.Get(meta, "user_id").String()
+	gridimageId := strconv.FormatInt(int64(pic.ID), 10)
+	userId := strconv.FormatInt(int64(pic.UserID), 10)
 
 	var input bytes.Buffer
 	input.Write([]byte(gridimageId))
@@ -32,7 +32,7 @@ type ImageSrc struct {
 	Thumbnail string `json:"thumbnail,omitempty"`
 }
 
-func GetImageSrc(secret []byte, meta string, forBatchProcessing bool) ImageSrc {
+func GetImageSrc(secret []byte, pic *Picture, forBatchProcessing bool) ImageSrc {
 	/* From email with geograph
 	$size = largest($row['original_width'],$row['original_height']);
 	if ($size == 1024) {
@@ -44,9 +44,9 @@ func GetImageSrc(secret []byte, meta string, forBatchProcessing bool) ImageSrc {
 	}
 	*/
 
-	hash := getImageHash(secret, meta)
-	id := int32(gjson.Get(meta, "gridimage_id").Int())
-	size := int32(max(gjson.Get(meta, "original_width").Int(), gjson.Get(meta, "original_height").Int()))
+	hash := getImageHash(secret, pic)
+	id := pic.ID
+	size := pic.OriginalSize()
 
 	out := ImageSrc{
 		Small:     getGeographURL(forBatchProcessing, id, hash, ""),
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	geograph "github.com/dzfranklin/plantopo-geograph"
 	"github.com/go-sql-driver/mysql"
 	"github.com/twpayne/go-proj/v10"
 	"log"
@@ -18,6 +19,7 @@ import (
 var srcDb *sql.DB
 
 func main() {
+	previousFlag := flag.String("previous", "", "previous meta.ndjson.gz to write ./out/delta.ndjson.gz against")
 	flag.Parse()
 
 	dbCfg := mysql.Config{
@@ -78,9 +80,45 @@ func main() {
 	if err := outF.Close(); err != nil {
 		panic(err)
 	}
+
+	if *previousFlag != "" {
+		log.Println("Writing delta against", *previousFlag)
+		writeDelta(*previousFlag, "./out/meta.ndjson.gz", "./out/delta.ndjson.gz")
+	}
+
 	log.Println("All done")
 }
 
+func writeDelta(prevPath, nextPath, outPath string) {
+	prevF, err := os.Open(prevPath)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = prevF.Close() }()
+	nextF, err := os.Open(nextPath)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = nextF.Close() }()
+
+	delta, err := geograph.DiffDumps(prevF, nextF)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Delta has", len(delta.Upserts), "upserts and", len(delta.Deletes), "deletes")
+
+	outF, err := os.Create(outPath)
+	if err != nil {
+		panic(err)
+	}
+	if err := geograph.WriteDelta(outF, delta); err != nil {
+		panic(err)
+	}
+	if err := outF.Close(); err != nil {
+		panic(err)
+	}
+}
+
 type tagJSON struct {
 	Prefix string `json:"prefix"`
 	Tag    string `json:"tag"`
@@ -1,3 +1,9 @@
 #!/usr/bin/env bash
 set -euox pipefail
+(cd ./out && sha256sum meta.ndjson.gz > meta.ndjson.gz.sha256)
+# Remove the old checksum before replacing meta so that the checksum never
+# describes a different meta. Clients that have seen a checksum before wait for
+# the new one rather than use meta unverified.
+mc rm dfranklin/geograph/meta.ndjson.gz.sha256 || true
 mc mv ./out/meta.ndjson.gz dfranklin/geograph/
+mc mv ./out/meta.ndjson.gz.sha256 dfranklin/geograph/
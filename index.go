@@ -1,8 +1,8 @@
 package geograph
 
 import (
-	"github.com/tidwall/rtree"
 	"math"
+	"sync/atomic"
 )
 
 type IndexType int
@@ -12,18 +12,45 @@ const (
 	ViewpointIndex
 )
 
-type indexRTree = rtree.RTreeGN[float32, int32]
-
 type inMemoryIndex struct {
-	subject   indexRTree
-	viewpoint indexRTree
+	subject   *packedTree
+	viewpoint *packedTree
+	overlay   atomic.Pointer[indexOverlay]
+	unmap     func() error
+}
+
+func newInMemoryIndex(subject, viewpoint *packedTree) *inMemoryIndex {
+	d := &inMemoryIndex{subject: subject, viewpoint: viewpoint}
+	d.overlay.Store(newIndexOverlay(nil))
+	return d
 }
 
 type indexPage struct {
 	items      []int32
 	itemPoints [][2]float32
 	hasNext    bool
-	nextCursor int
+	next       indexCursor
+}
+
+// indexCursor is the position of the last item on a page. Positions are leaf
+// positions in either the base tree or the overlay tree, and so are only valid
+// for the index they were returned by.
+type indexCursor struct {
+	overlay bool
+	pos     int
+	dist    float64 // only used by near, and as the score by Search
+}
+
+// after reports whether an item at pos in the base or overlay tree and dist
+// comes after c in the order near returns items.
+func (c indexCursor) after(overlay bool, pos int, dist float64) bool {
+	if dist != c.dist {
+		return dist > c.dist
+	}
+	if overlay != c.overlay {
+		return overlay
+	}
+	return pos > c.pos
 }
 
 type indexContents struct {
@@ -37,90 +64,239 @@ type indexContents struct {
 func loadIndex(contents indexContents) *inMemoryIndex {
 	sanityCheckIndex(contents)
 
-	var subject indexRTree
-	var viewpoint indexRTree
+	var subjectIDs, viewpointIDs []int32
+	var subjectPoints, viewpointPoints []float32
 	for i, id := range contents.ID {
 		subjectPoint := Point(contents.SubjectLng[i], contents.SubjectLat[i])
 		if !isZeroPoint(subjectPoint) {
-			subject.Insert(subjectPoint, subjectPoint, id)
+			subjectIDs = append(subjectIDs, id)
+			subjectPoints = append(subjectPoints, subjectPoint[0], subjectPoint[1])
 		}
 
 		viewpointPoint := Point(contents.ViewpointLng[i], contents.ViewpointLat[i])
 		if !isZeroPoint(viewpointPoint) {
-			viewpoint.Insert(viewpointPoint, viewpointPoint, id)
+			viewpointIDs = append(viewpointIDs, id)
+			viewpointPoints = append(viewpointPoints, viewpointPoint[0], viewpointPoint[1])
 		}
 	}
 
-	return &inMemoryIndex{
-		subject:   subject,
-		viewpoint: viewpoint,
+	return newInMemoryIndex(bulkLoad(subjectIDs, subjectPoints), bulkLoad(viewpointIDs, viewpointPoints))
+}
+
+func (d *inMemoryIndex) close() error {
+	if d.unmap == nil {
+		return nil
 	}
+	return d.unmap()
 }
 
-func (d *inMemoryIndex) within(min, max [2]float32, index IndexType, maxItems, cursor int) (indexPage, error) {
-	i := 0
-	ids := make([]int32, 0, maxItems)
-	points := make([][2]float32, 0, maxItems)
+// acceptFunc decides whether a query includes an item it visits, and whether
+// the query continues after it. A query stopped by an acceptFunc has a next
+// page starting after the item.
+type acceptFunc func(id int32, point [2]float32) (accepted bool, more bool)
+
+// within pages through the items in [min, max], starting after the cursor
+// if it is non-nil.
+func (d *inMemoryIndex) within(min, max [2]float32, index IndexType, maxItems int, after *indexCursor) (indexPage, error) {
+	return d.withinFunc(min, max, index, maxItems, after, nil)
+}
+
+// withinFunc is within but skips items accept doesn't accept, if it is
+// non-nil.
+func (d *inMemoryIndex) withinFunc(min, max [2]float32, index IndexType, maxItems int, after *indexCursor, accept acceptFunc) (indexPage, error) {
+	if maxItems < 1 {
+		return indexPage{}, ErrInvalidPageSize
+	}
+	ids := make([]int32, 0, pageAlloc(maxItems))
+	points := make([][2]float32, 0, pageAlloc(maxItems))
 	hasMore := false
-	d.of(index).Search(min, max, func(point, _ [2]float32, id int32) bool {
-		// Skip up to cursor
-		if i < cursor {
-			i++
+	var next indexCursor
+	overlay := d.overlay.Load()
+	visit := func(inOverlay bool) func(pos int, id int32, point [2]float32) bool {
+		return func(pos int, id int32, point [2]float32) bool {
+			if !inOverlay && overlay.hides(id) {
+				return true
+			}
+			accepted, more := true, true
+			if accept != nil {
+				accepted, more = accept(id, point)
+			}
+
+			if accepted {
+				// Stop if past max
+				if len(ids) == maxItems {
+					hasMore = true
+					return false
+				}
+
+				ids = append(ids, id)
+				points = append(points, point)
+			}
+			next = indexCursor{overlay: inOverlay, pos: pos}
+			if !more {
+				hasMore = true
+				return false
+			}
 			return true
 		}
+	}
 
-		// Stop if past max
-		if i-cursor > maxItems-1 {
-			hasMore = true
-			return false
+	// Base entries first, then entries changed by deltas
+	completed := true
+	if after == nil || !after.overlay {
+		start := 0
+		if after != nil {
+			start = after.pos + 1
 		}
+		completed = d.of(index).search(min, max, start, visit(false))
+	}
+	if completed {
+		start := 0
+		if after != nil && after.overlay {
+			start = after.pos + 1
+		}
+		overlay.of(index).search(min, max, start, visit(true))
+	}
 
-		ids = append(ids, id)
-		points = append(points, point)
+	return indexPage{hasNext: hasMore, next: next, items: ids, itemPoints: points}, nil
+}
 
-		i++
-		return true
+// each calls fn with every item in [min, max] until fn returns false.
+func (d *inMemoryIndex) each(min, max [2]float32, index IndexType, fn func(id int32, point [2]float32) bool) {
+	overlay := d.overlay.Load()
+	completed := d.of(index).search(min, max, 0, func(_ int, id int32, point [2]float32) bool {
+		if overlay.hides(id) {
+			return true
+		}
+		return fn(id, point)
 	})
-	return indexPage{hasNext: hasMore, nextCursor: i, items: ids, itemPoints: points}, nil
+	if completed {
+		overlay.of(index).search(min, max, 0, func(_ int, id int32, point [2]float32) bool {
+			return fn(id, point)
+		})
+	}
+}
+
+// near pages through the items in order of distance from target, starting
+// after the cursor if it is non-nil. If maxMeters is positive items further
+// away are excluded.
+func (d *inMemoryIndex) near(target [2]float32, index IndexType, maxItems int, after *indexCursor, maxMeters float64) (indexPage, error) {
+	return d.nearFunc(target, index, maxItems, after, maxMeters, nil)
 }
 
-func (d *inMemoryIndex) near(target [2]float32, index IndexType, maxItems, cursor int) (indexPage, error) {
-	i := 0
-	ids := make([]int32, 0, maxItems)
-	points := make([][2]float32, 0, maxItems)
+// nearFunc is near but skips items accept doesn't accept, if it is non-nil.
+func (d *inMemoryIndex) nearFunc(target [2]float32, index IndexType, maxItems int, after *indexCursor, maxMeters float64, accept acceptFunc) (indexPage, error) {
+	if maxItems < 1 {
+		return indexPage{}, ErrInvalidPageSize
+	}
+	maxDist := math.Inf(1)
+	if maxMeters > 0 {
+		maxDist = metersToHaver(maxMeters)
+	}
+	var minDist float64
+	if after != nil {
+		minDist = after.dist
+	}
+
+	ids := make([]int32, 0, pageAlloc(maxItems))
+	points := make([][2]float32, 0, pageAlloc(maxItems))
 	hasMore := false
-	d.of(index).Nearby(
-		rtree.BoxDist[float32, int32](target, target, nil),
-		func(point, _ [2]float32, id int32, _ float32) bool {
-			// Skip up to cursor
-			if i < cursor {
-				i++
-				return true
+	var next indexCursor
+	overlay := d.overlay.Load()
+
+	baseIter := d.of(index).nearbyIter(target, minDist)
+	baseNext := func() (int, int32, [2]float32, float64, bool) {
+		for {
+			pos, id, point, dist, ok := baseIter.next()
+			if !ok || (!overlay.hides(id) && (after == nil || after.after(false, pos, dist))) {
+				return pos, id, point, dist, ok
 			}
+		}
+	}
+	overlayIter := overlay.of(index).nearbyIter(target, minDist)
+	overlayNext := func() (int, int32, [2]float32, float64, bool) {
+		for {
+			pos, id, point, dist, ok := overlayIter.next()
+			if !ok || after == nil || after.after(true, pos, dist) {
+				return pos, id, point, dist, ok
+			}
+		}
+	}
+
+	// Merge the base and overlay entries by distance
+	basePos, baseID, basePoint, baseDist, baseOK := baseNext()
+	overlayPos, overlayID, overlayPoint, overlayDist, overlayOK := overlayNext()
+	for baseOK || overlayOK {
+		var id int32
+		var point [2]float32
+		var cursor indexCursor
+		if baseOK && (!overlayOK || baseDist <= overlayDist) {
+			id, point = baseID, basePoint
+			cursor = indexCursor{pos: basePos, dist: baseDist}
+			basePos, baseID, basePoint, baseDist, baseOK = baseNext()
+		} else {
+			id, point = overlayID, overlayPoint
+			cursor = indexCursor{overlay: true, pos: overlayPos, dist: overlayDist}
+			overlayPos, overlayID, overlayPoint, overlayDist, overlayOK = overlayNext()
+		}
+		if cursor.dist > maxDist {
+			break
+		}
+		accepted, more := true, true
+		if accept != nil {
+			accepted, more = accept(id, point)
+		}
 
+		if accepted {
 			// Stop if past max
-			if i-cursor > maxItems-1 {
+			if len(ids) == maxItems {
 				hasMore = true
-				return false
+				break
 			}
 
 			ids = append(ids, id)
 			points = append(points, point)
+		}
+		next = cursor
+		if !more {
+			hasMore = true
+			break
+		}
+	}
+	return indexPage{hasNext: hasMore, next: next, items: ids, itemPoints: points}, nil
+}
 
-			i++
-			return true
-		},
-	)
-	return indexPage{hasNext: hasMore, nextCursor: i, items: ids, itemPoints: points}, nil
+// applyOverlay replaces the entries for the ids in changes. base holds the
+// entries in the packed trees of the ids not already in the overlay. Queries
+// already in progress continue to see the previous entries.
+func (d *inMemoryIndex) applyOverlay(changes map[int32]overlayEntry, base map[int32]overlayEntry) {
+	prev := d.overlay.Load()
+	overlay := prev.with(changes)
+	overlay.hideFrom(prev, base, d.subject, d.viewpoint)
+	d.overlay.Store(overlay)
+}
+
+// loadOverlay sets the overlay of a newly opened index to entries.
+func (d *inMemoryIndex) loadOverlay(entries map[int32]overlayEntry) {
+	overlay := newIndexOverlay(entries)
+	overlay.hide(d.subject, d.viewpoint)
+	d.overlay.Store(overlay)
+}
 
+// count returns the number of items in [min, max].
+func (d *inMemoryIndex) count(min, max [2]float32, index IndexType) int {
+	overlay := d.overlay.Load()
+	return d.of(index).count(min, max) -
+		overlay.hiddenOf(index).count(min, max) +
+		overlay.of(index).count(min, max)
 }
 
-func (d *inMemoryIndex) of(ty IndexType) *indexRTree {
+func (d *inMemoryIndex) of(ty IndexType) *packedTree {
 	switch ty {
 	case SubjectIndex:
-		return &d.subject
+		return d.subject
 	case ViewpointIndex:
-		return &d.viewpoint
+		return d.viewpoint
 	default:
 		panic("invalid index type")
 	}
@@ -1,8 +1,17 @@
 package geograph
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tidwall/rtree"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
 	"testing"
 )
@@ -31,28 +40,28 @@ func TestIndex(t *testing.T) {
 	})
 
 	t.Run("within/entire world", func(t *testing.T) {
-		page, err := subject.within(Point(-180, -90), Point(180, 90), SubjectIndex, 10, 0)
+		page, err := subject.within(Point(-180, -90), Point(180, 90), SubjectIndex, 10, nil)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 10)
 		assert.False(t, page.hasNext)
 	})
 
 	t.Run("within/reversed bounds is empty", func(t *testing.T) {
-		page, err := subject.within(Point(180, 90), Point(-180, -90), SubjectIndex, 10, 0)
+		page, err := subject.within(Point(180, 90), Point(-180, -90), SubjectIndex, 10, nil)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 0)
 		assert.False(t, page.hasNext)
 	})
 
 	t.Run("within/less than page", func(t *testing.T) {
-		page, err := subject.within(Point(1.5, 1.5), Point(3.5, 3.5), SubjectIndex, 10, 0)
+		page, err := subject.within(Point(1.5, 1.5), Point(3.5, 3.5), SubjectIndex, 10, nil)
 		require.NoError(t, err)
 		require.Equal(t, page.items, []int32{2, 3})
 		require.False(t, page.hasNext)
 	})
 
 	t.Run("within/maxItems=1", func(t *testing.T) {
-		page, err := subject.within(Point(-180, -90), Point(180, 90), SubjectIndex, 1, 0)
+		page, err := subject.within(Point(-180, -90), Point(180, 90), SubjectIndex, 1, nil)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 1)
 		assert.True(t, page.hasNext)
@@ -64,31 +73,31 @@ func TestIndex(t *testing.T) {
 
 		var got []int32
 
-		page, err := subject.within(minPt, maxPt, SubjectIndex, 2, 0)
+		page, err := subject.within(minPt, maxPt, SubjectIndex, 2, nil)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 2)
 		assert.True(t, page.hasNext)
 		got = append(got, page.items...)
 
-		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, page.nextCursor)
+		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, &page.next)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 2)
 		assert.True(t, page.hasNext)
 		got = append(got, page.items...)
 
-		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, page.nextCursor)
+		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, &page.next)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 2)
 		assert.True(t, page.hasNext)
 		got = append(got, page.items...)
 
-		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, page.nextCursor)
+		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, &page.next)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 2)
 		assert.True(t, page.hasNext)
 		got = append(got, page.items...)
 
-		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, page.nextCursor)
+		page, err = subject.within(minPt, maxPt, SubjectIndex, 2, &page.next)
 		require.NoError(t, err)
 		assert.Len(t, page.items, 2)
 		assert.False(t, page.hasNext)
@@ -100,7 +109,7 @@ func TestIndex(t *testing.T) {
 
 	t.Run("near/entire world", func(t *testing.T) {
 		target := Point(1, 1)
-		page, err := subject.near(target, ViewpointIndex, 1000, 0)
+		page, err := subject.near(target, ViewpointIndex, 1000, nil, 0)
 		require.NoError(t, err)
 		assert.Equal(t, []int32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, page.items)
 		assert.False(t, page.hasNext)
@@ -109,17 +118,17 @@ func TestIndex(t *testing.T) {
 	t.Run("near/paginate", func(t *testing.T) {
 		target := Point(1, 1)
 
-		page, err := subject.near(target, ViewpointIndex, 4, 0)
+		page, err := subject.near(target, ViewpointIndex, 4, nil, 0)
 		require.NoError(t, err)
 		assert.Equal(t, []int32{1, 2, 3, 4}, page.items)
 		assert.True(t, page.hasNext)
 
-		page, err = subject.near(target, ViewpointIndex, 4, page.nextCursor)
+		page, err = subject.near(target, ViewpointIndex, 4, &page.next, 0)
 		require.NoError(t, err)
 		assert.Equal(t, []int32{5, 6, 7, 8}, page.items)
 		assert.True(t, page.hasNext)
 
-		page, err = subject.near(target, ViewpointIndex, 4, page.nextCursor)
+		page, err = subject.near(target, ViewpointIndex, 4, &page.next, 0)
 		require.NoError(t, err)
 		assert.Equal(t, []int32{9, 10}, page.items)
 		assert.False(t, page.hasNext)
@@ -137,11 +146,298 @@ func TestIndexIgnoresZero(t *testing.T) {
 
 	minPt, maxPt := Point(-180, -90), Point(180, 90)
 
-	page, err := subject.within(minPt, maxPt, SubjectIndex, 100, 0)
+	page, err := subject.within(minPt, maxPt, SubjectIndex, 100, nil)
 	require.NoError(t, err)
 	require.Len(t, page.items, 1)
 
-	page, err = subject.within(minPt, maxPt, ViewpointIndex, 100, 0)
+	page, err = subject.within(minPt, maxPt, ViewpointIndex, 100, nil)
 	require.NoError(t, err)
 	require.Len(t, page.items, 1)
 }
+
+func TestIndexFile(t *testing.T) {
+	contents := indexContents{}
+	for i := range 1000 {
+		contents.ID = append(contents.ID, int32(i+1))
+		contents.SubjectLng = append(contents.SubjectLng, float32(i%37)-18)
+		contents.SubjectLat = append(contents.SubjectLat, float32(i%23)+40)
+		if i%3 == 0 {
+			contents.ViewpointLng = append(contents.ViewpointLng, float32(i%37)-18.5)
+			contents.ViewpointLat = append(contents.ViewpointLat, float32(i%23)+40.5)
+		} else {
+			contents.ViewpointLng = append(contents.ViewpointLng, 0)
+			contents.ViewpointLat = append(contents.ViewpointLat, 0)
+		}
+	}
+	built := loadIndex(contents)
+
+	path := filepath.Join(t.TempDir(), "index.bin")
+	require.NoError(t, writeIndex(path, built))
+
+	mapped, err := mapIndex(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mapped.close()) }()
+
+	for _, index := range []IndexType{SubjectIndex, ViewpointIndex} {
+		want, err := built.within(Point(-10, 45), Point(5, 55), index, 1000, nil)
+		require.NoError(t, err)
+		got, err := mapped.within(Point(-10, 45), Point(5, 55), index, 1000, nil)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		want, err = built.near(Point(0, 50), index, 50, nil, 0)
+		require.NoError(t, err)
+		got, err = mapped.near(Point(0, 50), index, 50, nil, 0)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	t.Run("corrupt", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		_, err = parseIndex(data, storeFormatVersion)
+		assert.ErrorIs(t, err, ErrInvalidIndexFile)
+	})
+}
+
+func TestIndexNearGeodesic(t *testing.T) {
+	// At high latitudes a degree of longitude is much shorter than a degree
+	// of latitude, so planar ordering in degrees would be wrong
+	rng := rand.New(rand.NewPCG(1, 2))
+	contents := indexContents{}
+	for i := range 2000 {
+		contents.ID = append(contents.ID, int32(i+1))
+		contents.SubjectLng = append(contents.SubjectLng, -8+rng.Float32()*10)
+		contents.SubjectLat = append(contents.SubjectLat, 54+rng.Float32()*7)
+		contents.ViewpointLng = append(contents.ViewpointLng, 0)
+		contents.ViewpointLat = append(contents.ViewpointLat, 0)
+	}
+	subject := loadIndex(contents)
+	target := Point(-3.2, 57)
+
+	page, err := subject.near(target, SubjectIndex, 2000, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, page.items, 2000)
+	prev := -1.0
+	for _, point := range page.itemPoints {
+		dist := haverToMeters(newGeoTarget(target).dist(point))
+		require.GreaterOrEqual(t, dist, prev)
+		prev = dist
+	}
+
+	page, err = subject.near(target, SubjectIndex, 2000, nil, 50_000)
+	require.NoError(t, err)
+	var want int
+	for i := range contents.ID {
+		if haversineDistanceMeters(Point(contents.SubjectLng[i], contents.SubjectLat[i]), target) <= 50_000 {
+			want++
+		}
+	}
+	assert.Len(t, page.items, want)
+	assert.False(t, page.hasNext)
+}
+
+func TestGeoBoxDist(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for range 10_000 {
+		target := newGeoTarget(Point(rng.Float32()*360-180, rng.Float32()*170-85))
+		minPt := Point(rng.Float32()*360-180, rng.Float32()*170-85)
+		maxPt := Point(minPt[0]+rng.Float32()*(180-minPt[0]), minPt[1]+rng.Float32()*(85-minPt[1]))
+		bound := target.boxDist(minPt, maxPt)
+		for range 10 {
+			p := Point(minPt[0]+rng.Float32()*(maxPt[0]-minPt[0]), minPt[1]+rng.Float32()*(maxPt[1]-minPt[1]))
+			require.LessOrEqual(t, bound, target.dist(p)+1e-9)
+		}
+	}
+}
+
+func TestHilbert(t *testing.T) {
+	// The first 2^16 positions along the curve fill the 256x256 corner
+	const side = 256
+	cells := make(map[uint32][2]int, side*side)
+	for x := range side {
+		for y := range side {
+			cells[hilbert(uint32(x), uint32(y))] = [2]int{x, y}
+		}
+	}
+	require.Len(t, cells, side*side)
+
+	for i := uint32(1); i < side*side; i++ {
+		prev, ok := cells[i-1]
+		require.True(t, ok)
+		cur, ok := cells[i]
+		require.True(t, ok)
+		dist := abs(cur[0]-prev[0]) + abs(cur[1]-prev[1])
+		require.Equal(t, 1, dist, "positions %d and %d should be adjacent", i-1, i)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Benchmarks compare the packed index against the dynamic rtree it replaced.
+// They use the full dump if it has been imported and the sample otherwise.
+
+func BenchmarkIndexBuild(b *testing.B) {
+	contents := benchIndexContents(b)
+
+	b.Run("rtree", func(b *testing.B) {
+		for range b.N {
+			var tree rtree.RTreeGN[float32, int32]
+			for i, id := range contents.ID {
+				p := Point(contents.SubjectLng[i], contents.SubjectLat[i])
+				tree.Insert(p, p, id)
+			}
+		}
+	})
+
+	b.Run("packed", func(b *testing.B) {
+		for range b.N {
+			ids := slices.Clone(contents.ID)
+			points := make([]float32, 0, 2*len(ids))
+			for i := range ids {
+				points = append(points, contents.SubjectLng[i], contents.SubjectLat[i])
+			}
+			bulkLoad(ids, points)
+		}
+	})
+}
+
+func BenchmarkIndexHeap(b *testing.B) {
+	contents := benchIndexContents(b)
+
+	b.Run("rtree", func(b *testing.B) {
+		for range b.N {
+			before := heapInUse()
+			var tree rtree.RTreeGN[float32, int32]
+			for i, id := range contents.ID {
+				p := Point(contents.SubjectLng[i], contents.SubjectLat[i])
+				tree.Insert(p, p, id)
+			}
+			b.ReportMetric(float64(heapInUse()-before), "heap-B")
+			runtime.KeepAlive(&tree)
+		}
+	})
+
+	b.Run("packed", func(b *testing.B) {
+		for range b.N {
+			before := heapInUse()
+			ids := slices.Clone(contents.ID)
+			points := make([]float32, 0, 2*len(ids))
+			for i := range ids {
+				points = append(points, contents.SubjectLng[i], contents.SubjectLat[i])
+			}
+			tree := bulkLoad(ids, points)
+			b.ReportMetric(float64(heapInUse()-before), "heap-B")
+			runtime.KeepAlive(tree)
+		}
+	})
+}
+
+func BenchmarkIndexQuery(b *testing.B) {
+	contents := benchIndexContents(b)
+
+	var tree rtree.RTreeGN[float32, int32]
+	for i, id := range contents.ID {
+		p := Point(contents.SubjectLng[i], contents.SubjectLat[i])
+		tree.Insert(p, p, id)
+	}
+	packed := loadIndex(contents).subject
+
+	// Around Edinburgh
+	target := Point(-3.19, 55.95)
+	minPt, maxPt := Point(-3.3, 55.9), Point(-3.1, 56)
+
+	b.Run("within/rtree", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			tree.Search(minPt, maxPt, func(_, _ [2]float32, _ int32) bool {
+				n++
+				return n < 100
+			})
+		}
+	})
+
+	b.Run("within/packed", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			packed.search(minPt, maxPt, 0, func(_ int, _ int32, _ [2]float32) bool {
+				n++
+				return n < 100
+			})
+		}
+	})
+
+	b.Run("near/rtree", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			tree.Nearby(rtree.BoxDist[float32, int32](target, target, nil),
+				func(_, _ [2]float32, _ int32, _ float32) bool {
+					n++
+					return n < 10
+				})
+		}
+	})
+
+	b.Run("near/packed", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			packed.nearby(target, func(_ int32, _ [2]float32, _ float64) bool {
+				n++
+				return n < 10
+			})
+		}
+	})
+}
+
+func benchIndexContents(b *testing.B) indexContents {
+	b.Helper()
+
+	path := "./import/out/meta.ndjson.gz"
+	if _, err := os.Stat(path); err != nil {
+		path = "./sample.ndjson.gz"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		b.Skip("no dump to benchmark against")
+	}
+	defer func() { _ = f.Close() }()
+	r, err := gzip.NewReader(f)
+	require.NoError(b, err)
+
+	var contents indexContents
+	d := json.NewDecoder(r)
+	for {
+		var data struct {
+			ID           int32   `json:"gridimage_id"`
+			SubjectLng   float32 `json:"wgs84_long"`
+			SubjectLat   float32 `json:"wgs84_lat"`
+			ViewpointLng float32 `json:"viewpoint_wgs84_long"`
+			ViewpointLat float32 `json:"viewpoint_wgs84_lat"`
+		}
+		err := d.Decode(&data)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(b, err)
+		contents.ID = append(contents.ID, data.ID)
+		contents.SubjectLng = append(contents.SubjectLng, data.SubjectLng)
+		contents.SubjectLat = append(contents.SubjectLat, data.SubjectLat)
+		contents.ViewpointLng = append(contents.ViewpointLng, data.ViewpointLng)
+		contents.ViewpointLat = append(contents.ViewpointLat, data.ViewpointLat)
+	}
+	b.ResetTimer()
+	return contents
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
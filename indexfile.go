@@ -0,0 +1,178 @@
+package geograph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// The index file holds the packed subject and viewpoint trees so that they
+// can be memory-mapped on reopen instead of being rebuilt.
+//
+// Layout (little-endian, every section 4-byte aligned):
+//
+//	header: magic "GGIX" | version u32 | node size u32 | crc32c of body u32 |
+//	        subject items u32 | viewpoint items u32
+//	body, for subject then viewpoint: ids []int32 | points []float32 | boxes []float32
+var indexFileMagic = [4]byte{'G', 'G', 'I', 'X'}
+
+var ErrInvalidIndexFile = errors.New("invalid index file")
+
+type indexFileHeader struct {
+	Magic         [4]byte
+	Version       uint32
+	NodeSize      uint32
+	Checksum      uint32
+	SubjectSize   uint32
+	ViewpointSize uint32
+}
+
+var indexFileHeaderSize = binary.Size(indexFileHeader{})
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func writeIndex(path string, index *inMemoryIndex) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := encodeIndex(w, index, storeFormatVersion); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodeIndex writes index in the index file format with version in the
+// header. The body is encoded twice, first to compute the checksum in the
+// header.
+func encodeIndex(w io.Writer, index *inMemoryIndex, version uint32) error {
+	crc := crc32.New(castagnoli)
+	if err := encodeIndexBody(crc, index); err != nil {
+		return err
+	}
+
+	header := indexFileHeader{
+		Magic:         indexFileMagic,
+		Version:       version,
+		NodeSize:      packedNodeSize,
+		Checksum:      crc.Sum32(),
+		SubjectSize:   uint32(index.subject.len()),
+		ViewpointSize: uint32(index.viewpoint.len()),
+	}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	return encodeIndexBody(w, index)
+}
+
+func encodeIndexBody(w io.Writer, index *inMemoryIndex) error {
+	for _, tree := range []*packedTree{index.subject, index.viewpoint} {
+		for _, section := range []any{tree.ids, tree.points, tree.boxes} {
+			if err := binary.Write(w, binary.LittleEndian, section); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mapIndex memory-maps an index file written by writeIndex. The index must be
+// closed to release the mapping.
+func mapIndex(path string) (*inMemoryIndex, error) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		return nil, errors.New("index files are only supported on little-endian machines")
+	}
+
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := parseIndex(data, storeFormatVersion)
+	if err != nil {
+		_ = unmap()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	index.unmap = unmap
+	return index, nil
+}
+
+// parseIndex parses an index written by encodeIndex with version.
+func parseIndex(data []byte, version uint32) (*inMemoryIndex, error) {
+	if len(data) < indexFileHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidIndexFile)
+	}
+	var header indexFileHeader
+	if err := binary.Read(bytes.NewReader(data[:indexFileHeaderSize]), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIndexFile, err)
+	}
+	if header.Magic != indexFileMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidIndexFile)
+	}
+	if header.Version != version || header.NodeSize != packedNodeSize {
+		return nil, fmt.Errorf("%w: unsupported version %d with node size %d",
+			ErrInvalidIndexFile, header.Version, header.NodeSize)
+	}
+
+	body := data[indexFileHeaderSize:]
+	if crc32.Checksum(body, castagnoli) != header.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidIndexFile)
+	}
+
+	subject, body, err := parsePackedTree(body, int(header.SubjectSize))
+	if err != nil {
+		return nil, err
+	}
+	viewpoint, body, err := parsePackedTree(body, int(header.ViewpointSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidIndexFile)
+	}
+
+	return newInMemoryIndex(subject, viewpoint), nil
+}
+
+func parsePackedTree(body []byte, size int) (*packedTree, []byte, error) {
+	nodes := packedNodeCount(size)
+	idsLen, pointsLen, boxesLen := 4*size, 8*size, 16*nodes
+	if len(body) < idsLen+pointsLen+boxesLen {
+		return nil, nil, fmt.Errorf("%w: truncated", ErrInvalidIndexFile)
+	}
+
+	t := &packedTree{
+		ids:    castSlice[int32](body[:idsLen]),
+		points: castSlice[float32](body[idsLen : idsLen+pointsLen]),
+		boxes:  castSlice[float32](body[idsLen+pointsLen : idsLen+pointsLen+boxesLen]),
+		levels: packedLevels(size),
+	}
+	return t, body[idsLen+pointsLen+boxesLen:], nil
+}
+
+// castSlice reinterprets b as a slice of T without copying.
+func castSlice[T int32 | float32](b []byte) []T {
+	if len(b) == 0 {
+		return nil
+	}
+	var zero T
+	return unsafe.Slice((*T)(unsafe.Pointer(&b[0])), len(b)/int(unsafe.Sizeof(zero)))
+}
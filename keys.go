@@ -0,0 +1,134 @@
+package geograph
+
+import (
+	"encoding/binary"
+)
+
+// Keys in the database start with a byte identifying the kind of value they
+// hold. Ids are encoded big-endian so that keys sort by id.
+const (
+	recordKeyPrefix  byte = 'r'
+	overlayKeyPrefix byte = 'o'
+	metaKeyPrefix    byte = 'm'
+
+	// Secondary indexes map an attribute to the ids of the pictures with it.
+	// Keys are the attribute followed by the id, with empty values.
+	userKeyPrefix  byte = 'u'
+	gridKeyPrefix  byte = 'g'
+	takenKeyPrefix byte = 't'
+	termKeyPrefix  byte = 'w'
+
+	// tagKeyPrefix is the tag dictionary, which maps each tag to the number
+	// of pictures with it.
+	tagKeyPrefix byte = 'k'
+	// termCountKeyPrefix maps each search term to the number of pictures
+	// with it.
+	termCountKeyPrefix byte = 'c'
+)
+
+var deltaSeqKey = []byte{metaKeyPrefix, 'd', 'e', 'l', 't', 'a', '_', 's', 'e', 'q'}
+
+// deltaHashKey holds a hash chained over every delta applied, identifying the
+// contents of the store along with the dataset version.
+var deltaHashKey = []byte{metaKeyPrefix, 'd', 'e', 'l', 't', 'a', '_', 'h', 'a', 's', 'h'}
+
+// textStatsKey holds the number of terms indexed for search, used to rank
+// results.
+var textStatsKey = []byte{metaKeyPrefix, 't', 'e', 'x', 't', '_', 's', 't', 'a', 't', 's'}
+
+func recordKey(id int32) []byte {
+	return idKey(recordKeyPrefix, id)
+}
+
+func overlayKey(id int32) []byte {
+	return idKey(overlayKeyPrefix, id)
+}
+
+// userKey is a user id followed by a picture id.
+func userKey(userID int32, id int32) []byte {
+	return binary.BigEndian.AppendUint32(userPrefix(userID), uint32(id))
+}
+
+func userPrefix(userID int32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{userKeyPrefix}, uint32(userID))
+}
+
+// gridKey is a myriad, hectad or grid square followed by a picture id.
+func gridKey(ref string, id int32) []byte {
+	return binary.BigEndian.AppendUint32(gridPrefix(ref), uint32(id))
+}
+
+func gridPrefix(ref string) []byte {
+	b := append([]byte{gridKeyPrefix}, ref...)
+	return append(b, 0)
+}
+
+// takenKey is a YYYY-MM-DD date followed by a picture id.
+func takenKey(date string, id int32) []byte {
+	b := append([]byte{takenKeyPrefix}, date...)
+	return binary.BigEndian.AppendUint32(b, uint32(id))
+}
+
+type secondaryEntry struct {
+	key   []byte
+	value []byte
+}
+
+// secondaryEntries are the secondary index entries for a record.
+func secondaryEntries(fields indexedFields) []secondaryEntry {
+	var entries []secondaryEntry
+	if fields.UserID != 0 {
+		entries = append(entries, secondaryEntry{key: userKey(fields.UserID, fields.ID)})
+	}
+	for _, ref := range gridRefLevels(fields.GridReference) {
+		entries = append(entries, secondaryEntry{key: gridKey(ref, fields.ID)})
+	}
+	if isTakenDate(fields.ImageTaken) {
+		entries = append(entries, secondaryEntry{key: takenKey(fields.ImageTaken, fields.ID)})
+	}
+	for term, posting := range indexText(fields) {
+		entries = append(entries, secondaryEntry{key: termKey(term, fields.ID), value: posting.encode()})
+	}
+	return entries
+}
+
+// termKey is a search term followed by a picture id.
+func termKey(term string, id int32) []byte {
+	return binary.BigEndian.AppendUint32(termPrefix(term), uint32(id))
+}
+
+func termPrefix(term string) []byte {
+	b := append([]byte{termKeyPrefix}, term...)
+	return append(b, 0)
+}
+
+// termCountKey is a search term, without a terminator so that terms can be
+// looked up by their start.
+func termCountKey(term string) []byte {
+	return append([]byte{termCountKeyPrefix}, term...)
+}
+
+func idKey(prefix byte, id int32) []byte {
+	b := make([]byte, 5)
+	b[0] = prefix
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return b
+}
+
+// keyID decodes the id at the end of a key built by idKey.
+func keyID(key []byte) int32 {
+	return int32(binary.BigEndian.Uint32(key[len(key)-4:]))
+}
+
+// prefixBounds returns the range of keys starting with prefix.
+func prefixBounds(prefix ...byte) (lower, upper []byte) {
+	lower = append([]byte(nil), prefix...)
+	upper = append([]byte(nil), prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return lower, upper[:i+1]
+		}
+	}
+	return lower, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package geograph
+
+import "os"
+
+// mapFile reads the contents of path into memory on platforms without mmap.
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
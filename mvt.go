@@ -0,0 +1,177 @@
+package geograph
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// A minimal encoder for Mapbox Vector Tiles of points, after
+// https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+
+const mvtExtent = 4096
+
+// Protobuf field numbers
+const (
+	mvtTileLayers = 3
+
+	mvtLayerVersion  = 15
+	mvtLayerName     = 1
+	mvtLayerFeatures = 2
+	mvtLayerKeys     = 3
+	mvtLayerValues   = 4
+	mvtLayerExtent   = 5
+
+	mvtFeatureID       = 1
+	mvtFeatureTags     = 2
+	mvtFeatureType     = 3
+	mvtFeatureGeometry = 4
+
+	mvtValueString = 1
+	mvtValueInt    = 4
+	mvtValueBool   = 7
+)
+
+const (
+	mvtPoint  = 1
+	mvtMoveTo = 1
+)
+
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+type mvtLayer struct {
+	name       string
+	keys       []string
+	keyIndex   map[string]uint32
+	values     [][]byte
+	valueIndex map[string]uint32
+	features   [][]byte
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, keyIndex: make(map[string]uint32), valueIndex: make(map[string]uint32)}
+}
+
+// addPoint adds a point feature at x, y in tile coordinates. Attribute values
+// may be strings, int64s or bools.
+func (l *mvtLayer) addPoint(id uint64, x, y int32, attrs []mvtAttr) {
+	var tags []byte
+	for _, attr := range attrs {
+		tags = binary.AppendUvarint(tags, uint64(l.key(attr.key)))
+		tags = binary.AppendUvarint(tags, uint64(l.value(attr.value)))
+	}
+	geometry := binary.AppendUvarint(nil, mvtMoveTo|1<<3)
+	geometry = binary.AppendUvarint(geometry, zigzag(x))
+	geometry = binary.AppendUvarint(geometry, zigzag(y))
+
+	var f []byte
+	f = appendProtoVarint(f, mvtFeatureID, id)
+	f = appendProtoBytes(f, mvtFeatureTags, tags)
+	f = appendProtoVarint(f, mvtFeatureType, mvtPoint)
+	f = appendProtoBytes(f, mvtFeatureGeometry, geometry)
+	l.features = append(l.features, f)
+}
+
+type mvtAttr struct {
+	key   string
+	value any
+}
+
+func (l *mvtLayer) key(k string) uint32 {
+	i, ok := l.keyIndex[k]
+	if !ok {
+		i = uint32(len(l.keys))
+		l.keys = append(l.keys, k)
+		l.keyIndex[k] = i
+	}
+	return i
+}
+
+func (l *mvtLayer) value(v any) uint32 {
+	var encoded []byte
+	switch v := v.(type) {
+	case string:
+		encoded = appendProtoBytes(nil, mvtValueString, []byte(v))
+	case int64:
+		encoded = appendProtoVarint(nil, mvtValueInt, uint64(v))
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		encoded = appendProtoVarint(nil, mvtValueBool, b)
+	default:
+		panic("unsupported mvt value")
+	}
+
+	i, ok := l.valueIndex[string(encoded)]
+	if !ok {
+		i = uint32(len(l.values))
+		l.values = append(l.values, encoded)
+		l.valueIndex[string(encoded)] = i
+	}
+	return i
+}
+
+func (l *mvtLayer) encode() []byte {
+	var b []byte
+	b = appendProtoVarint(b, mvtLayerVersion, 2)
+	b = appendProtoBytes(b, mvtLayerName, []byte(l.name))
+	for _, f := range l.features {
+		b = appendProtoBytes(b, mvtLayerFeatures, f)
+	}
+	for _, k := range l.keys {
+		b = appendProtoBytes(b, mvtLayerKeys, []byte(k))
+	}
+	for _, v := range l.values {
+		b = appendProtoBytes(b, mvtLayerValues, v)
+	}
+	b = appendProtoVarint(b, mvtLayerExtent, mvtExtent)
+	return b
+}
+
+func encodeMVT(layers ...*mvtLayer) []byte {
+	var b []byte
+	for _, l := range layers {
+		b = appendProtoBytes(b, mvtTileLayers, l.encode())
+	}
+	return b
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protoVarint))
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protoBytes))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func zigzag(v int32) uint64 {
+	return uint64(uint32((v << 1) ^ (v >> 31)))
+}
+
+// Web Mercator
+
+const maxMercatorLat = 85.05112878
+
+// mercatorXY is the position of p in the world at zoom z, in tiles.
+func mercatorXY(p [2]float32, z int) (float64, float64) {
+	n := math.Exp2(float64(z))
+	lat := degreesToRadians(math.Max(math.Min(float64(p[1]), maxMercatorLat), -maxMercatorLat))
+	x := (float64(p[0]) + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+	return x, y
+}
+
+// mercatorLngLat is the inverse of mercatorXY.
+func mercatorLngLat(x, y float64, z int) [2]float32 {
+	n := math.Exp2(float64(z))
+	lng := x/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+	return Point(float32(lng), float32(lat))
+}
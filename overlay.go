@@ -0,0 +1,166 @@
+package geograph
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+// indexOverlay holds the index entries of records changed by deltas since the
+// packed trees were built. Entries in the overlay hide any entries for the
+// same id in the packed trees. Overlays are immutable and replaced as a whole
+// when a delta is applied.
+type indexOverlay struct {
+	entries   map[int32]overlayEntry
+	subject   *packedTree
+	viewpoint *packedTree
+	// hiddenSubject and hiddenViewpoint are the entries in the packed trees
+	// hidden by the overlay, so that they can be subtracted from counts
+	hiddenSubject   *packedTree
+	hiddenViewpoint *packedTree
+}
+
+type overlayEntry struct {
+	deleted   bool
+	subject   [2]float32
+	viewpoint [2]float32
+}
+
+func newIndexOverlay(entries map[int32]overlayEntry) *indexOverlay {
+	var subjectIDs, viewpointIDs []int32
+	var subjectPoints, viewpointPoints []float32
+	for id, entry := range entries {
+		if entry.deleted {
+			continue
+		}
+		if !isZeroPoint(entry.subject) {
+			subjectIDs = append(subjectIDs, id)
+			subjectPoints = append(subjectPoints, entry.subject[0], entry.subject[1])
+		}
+		if !isZeroPoint(entry.viewpoint) {
+			viewpointIDs = append(viewpointIDs, id)
+			viewpointPoints = append(viewpointPoints, entry.viewpoint[0], entry.viewpoint[1])
+		}
+	}
+
+	return &indexOverlay{
+		entries:         entries,
+		subject:         bulkLoad(subjectIDs, subjectPoints),
+		viewpoint:       bulkLoad(viewpointIDs, viewpointPoints),
+		hiddenSubject:   bulkLoad(nil, nil),
+		hiddenViewpoint: bulkLoad(nil, nil),
+	}
+}
+
+// with returns a new overlay with changes applied on top of o.
+func (o *indexOverlay) with(changes map[int32]overlayEntry) *indexOverlay {
+	entries := make(map[int32]overlayEntry, len(o.entries)+len(changes))
+	for id, entry := range o.entries {
+		entries[id] = entry
+	}
+	for id, entry := range changes {
+		entries[id] = entry
+	}
+	return newIndexOverlay(entries)
+}
+
+func (o *indexOverlay) hides(id int32) bool {
+	_, ok := o.entries[id]
+	return ok
+}
+
+// hide records the entries of base hidden by o.
+func (o *indexOverlay) hide(subject, viewpoint *packedTree) {
+	hidden := func(base *packedTree) *packedTree {
+		var ids []int32
+		var points []float32
+		for i, id := range base.ids {
+			if o.hides(id) {
+				ids = append(ids, id)
+				points = append(points, base.points[2*i], base.points[2*i+1])
+			}
+		}
+		return bulkLoad(ids, points)
+	}
+	if len(o.entries) > 0 {
+		o.hiddenSubject = hidden(subject)
+		o.hiddenViewpoint = hidden(viewpoint)
+	}
+}
+
+// hideFrom records the entries of the packed trees hidden by o, which replaced
+// prev. base holds the entries of ids hidden by o but not prev, which are
+// looked up in the trees by point rather than scanning them.
+func (o *indexOverlay) hideFrom(prev *indexOverlay, base map[int32]overlayEntry, subject, viewpoint *packedTree) {
+	hidden := func(prevHidden *packedTree, tree *packedTree, point func(overlayEntry) [2]float32) *packedTree {
+		ids := slices.Clone(prevHidden.ids)
+		points := slices.Clone(prevHidden.points)
+		for id, entry := range base {
+			p := point(entry)
+			tree.search(p, p, 0, func(_ int, found int32, _ [2]float32) bool {
+				if found != id {
+					return true
+				}
+				ids = append(ids, id)
+				points = append(points, p[0], p[1])
+				return false
+			})
+		}
+		if len(ids) == prevHidden.len() {
+			return prevHidden
+		}
+		return bulkLoad(ids, points)
+	}
+	o.hiddenSubject = hidden(prev.hiddenSubject, subject, func(e overlayEntry) [2]float32 { return e.subject })
+	o.hiddenViewpoint = hidden(prev.hiddenViewpoint, viewpoint, func(e overlayEntry) [2]float32 { return e.viewpoint })
+}
+
+func (o *indexOverlay) hiddenOf(ty IndexType) *packedTree {
+	switch ty {
+	case SubjectIndex:
+		return o.hiddenSubject
+	case ViewpointIndex:
+		return o.hiddenViewpoint
+	default:
+		panic("invalid index type")
+	}
+}
+
+func (o *indexOverlay) of(ty IndexType) *packedTree {
+	switch ty {
+	case SubjectIndex:
+		return o.subject
+	case ViewpointIndex:
+		return o.viewpoint
+	default:
+		panic("invalid index type")
+	}
+}
+
+// encode returns the value stored under overlayKey. Deleted entries are
+// stored as an empty value.
+func (e overlayEntry) encode() []byte {
+	if e.deleted {
+		return nil
+	}
+	b := make([]byte, 16)
+	for i, v := range []float32{e.subject[0], e.subject[1], e.viewpoint[0], e.viewpoint[1]} {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return b
+}
+
+func decodeOverlayEntry(b []byte) (overlayEntry, error) {
+	if len(b) == 0 {
+		return overlayEntry{deleted: true}, nil
+	}
+	if len(b) != 16 {
+		return overlayEntry{}, errors.New("invalid overlay entry")
+	}
+	var v [4]float32
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return overlayEntry{subject: Point(v[0], v[1]), viewpoint: Point(v[2], v[3])}, nil
+}
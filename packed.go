@@ -0,0 +1,440 @@
+package geograph
+
+import (
+	"math"
+	"sync"
+)
+
+const packedNodeSize = 16
+
+// packedTree is a static R-tree laid out in flat arrays so that it can be
+// written to disk and memory-mapped back without being rebuilt.
+//
+// Items are stored in leaf order. Each node above the leaves covers
+// packedNodeSize consecutive nodes (or items) of the level below, so the
+// structure of the tree is implied by the number of items.
+type packedTree struct {
+	ids    []int32
+	points []float32 // lng, lat per item
+	boxes  []float32 // minLng, minLat, maxLng, maxLat per node, lowest level first
+	levels []packedLevel
+
+	summaryOnce sync.Once
+	summary     []nodeSummary // per node, in the order of boxes
+}
+
+type packedLevel struct {
+	start int // offset in nodes into boxes
+	size  int
+}
+
+func packedLevels(size int) []packedLevel {
+	var levels []packedLevel
+	start := 0
+	for size > 1 || (size == 1 && len(levels) == 0) {
+		size = (size + packedNodeSize - 1) / packedNodeSize
+		levels = append(levels, packedLevel{start: start, size: size})
+		start += size
+	}
+	return levels
+}
+
+func packedNodeCount(size int) int {
+	count := 0
+	for _, level := range packedLevels(size) {
+		count += level.size
+	}
+	return count
+}
+
+// packTree builds the node levels over items already in leaf order.
+func packTree(ids []int32, points []float32) *packedTree {
+	t := &packedTree{
+		ids:    ids,
+		points: points,
+		levels: packedLevels(len(ids)),
+	}
+	t.boxes = make([]float32, 0, 4*packedNodeCount(len(ids)))
+
+	childCount := len(ids)
+	childBox := func(i int) (float32, float32, float32, float32) {
+		return points[2*i], points[2*i+1], points[2*i], points[2*i+1]
+	}
+	for _, level := range t.levels {
+		for j := 0; j < level.size; j++ {
+			minX, minY := float32(math.Inf(1)), float32(math.Inf(1))
+			maxX, maxY := float32(math.Inf(-1)), float32(math.Inf(-1))
+			for c := j * packedNodeSize; c < min((j+1)*packedNodeSize, childCount); c++ {
+				cMinX, cMinY, cMaxX, cMaxY := childBox(c)
+				minX, minY = min(minX, cMinX), min(minY, cMinY)
+				maxX, maxY = max(maxX, cMaxX), max(maxY, cMaxY)
+			}
+			t.boxes = append(t.boxes, minX, minY, maxX, maxY)
+		}
+
+		boxes := t.boxes[4*level.start:]
+		childCount = level.size
+		childBox = func(i int) (float32, float32, float32, float32) {
+			return boxes[4*i], boxes[4*i+1], boxes[4*i+2], boxes[4*i+3]
+		}
+	}
+	return t
+}
+
+func (t *packedTree) len() int {
+	return len(t.ids)
+}
+
+func (t *packedTree) point(i int) [2]float32 {
+	return [2]float32{t.points[2*i], t.points[2*i+1]}
+}
+
+// box returns the bounds of node j on the given level. Level 0 is the items.
+func (t *packedTree) box(level, j int) (min, max [2]float32) {
+	if level == 0 {
+		p := t.point(j)
+		return p, p
+	}
+	b := t.boxes[4*(t.levels[level-1].start+j):]
+	return [2]float32{b[0], b[1]}, [2]float32{b[2], b[3]}
+}
+
+func (t *packedTree) levelSize(level int) int {
+	if level == 0 {
+		return len(t.ids)
+	}
+	return t.levels[level-1].size
+}
+
+// search calls iter with every item within [min, max] at or after leaf
+// position start, in leaf order, until iter returns false. It reports whether
+// every item was visited.
+func (t *packedTree) search(min, max [2]float32, start int, iter func(pos int, id int32, point [2]float32) bool) bool {
+	if t.len() == 0 {
+		return true
+	}
+	span := 1
+	for range t.levels {
+		span *= packedNodeSize
+	}
+	return t.searchNode(len(t.levels), 0, span, min, max, start, iter)
+}
+
+// searchNode searches node j on level, which covers span leaf positions.
+func (t *packedTree) searchNode(
+	level, j, span int,
+	min, max [2]float32,
+	startPos int,
+	iter func(pos int, id int32, point [2]float32) bool,
+) bool {
+	childLevel := level - 1
+	start, end := t.children(level, j)
+
+	if childLevel == 0 {
+		if start < startPos {
+			start = startPos
+		}
+		for c := start; c < end; c++ {
+			x, y := t.points[2*c], t.points[2*c+1]
+			if x < min[0] || x > max[0] || y < min[1] || y > max[1] {
+				continue
+			}
+			if !iter(c, t.ids[c], [2]float32{x, y}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	childSpan := span / packedNodeSize
+	if start < startPos/childSpan {
+		start = startPos / childSpan
+	}
+	boxes := t.boxes[4*t.levels[childLevel-1].start:]
+	for c := start; c < end; c++ {
+		b := boxes[4*c : 4*c+4]
+		if b[0] > max[0] || b[2] < min[0] || b[1] > max[1] || b[3] < min[1] {
+			continue
+		}
+		if !t.searchNode(childLevel, c, childSpan, min, max, startPos, iter) {
+			return false
+		}
+	}
+	return true
+}
+
+// count returns the number of items within [min, max], counting nodes
+// entirely within it without visiting their items.
+func (t *packedTree) count(min, max [2]float32) int {
+	if t.len() == 0 {
+		return 0
+	}
+	span := 1
+	for range t.levels {
+		span *= packedNodeSize
+	}
+	return t.countNode(len(t.levels), 0, span, min, max)
+}
+
+// countNode counts the items of node j on level, which covers span leaf
+// positions.
+func (t *packedTree) countNode(level, j, span int, min, max [2]float32) int {
+	childLevel := level - 1
+	start, end := t.children(level, j)
+
+	n := 0
+	if childLevel == 0 {
+		for c := start; c < end; c++ {
+			x, y := t.points[2*c], t.points[2*c+1]
+			if x >= min[0] && x <= max[0] && y >= min[1] && y <= max[1] {
+				n++
+			}
+		}
+		return n
+	}
+
+	childSpan := span / packedNodeSize
+	boxes := t.boxes[4*t.levels[childLevel-1].start:]
+	for c := start; c < end; c++ {
+		b := boxes[4*c : 4*c+4]
+		if b[0] > max[0] || b[2] < min[0] || b[1] > max[1] || b[3] < min[1] {
+			continue
+		}
+		if b[0] >= min[0] && b[2] <= max[0] && b[1] >= min[1] && b[3] <= max[1] {
+			// The node covers the leaf positions [c*childSpan, (c+1)*childSpan)
+			end := (c + 1) * childSpan
+			if end > t.len() {
+				end = t.len()
+			}
+			n += end - c*childSpan
+			continue
+		}
+		n += t.countNode(childLevel, c, childSpan, min, max)
+	}
+	return n
+}
+
+// nodeSummary summarizes the items under a node.
+type nodeSummary struct {
+	count int
+	// sumX and sumY are the sums of the item positions in Web Mercator tile
+	// coordinates at zoom 0, which scale by 2^z to other zooms.
+	sumX, sumY float64
+	minID      int32
+}
+
+func (s nodeSummary) add(o nodeSummary) nodeSummary {
+	return nodeSummary{count: s.count + o.count, sumX: s.sumX + o.sumX, sumY: s.sumY + o.sumY, minID: min(s.minID, o.minID)}
+}
+
+// summaries returns the summary of every node, computing them on first use.
+func (t *packedTree) summaries() []nodeSummary {
+	t.summaryOnce.Do(func() {
+		summary := make([]nodeSummary, packedNodeCount(t.len()))
+		childCount := t.len()
+		child := func(i int) nodeSummary {
+			x, y := mercatorXY(t.point(i), 0)
+			return nodeSummary{count: 1, sumX: x, sumY: y, minID: t.ids[i]}
+		}
+		for _, level := range t.levels {
+			for j := 0; j < level.size; j++ {
+				sum := nodeSummary{minID: math.MaxInt32}
+				for c := j * packedNodeSize; c < min((j+1)*packedNodeSize, childCount); c++ {
+					sum = sum.add(child(c))
+				}
+				summary[level.start+j] = sum
+			}
+
+			below := summary[level.start:]
+			childCount = level.size
+			child = func(i int) nodeSummary { return below[i] }
+		}
+		t.summary = summary
+	})
+	return t.summary
+}
+
+// summarize visits the items within [min, max]. Nodes entirely within it are
+// first offered to whole, and if it returns true aren't descended into. Every
+// other item is passed to item.
+func (t *packedTree) summarize(
+	min, max [2]float32,
+	whole func(nodeMin, nodeMax [2]float32, s nodeSummary) bool,
+	item func(id int32, point [2]float32),
+) {
+	if t.len() == 0 {
+		return
+	}
+	t.summarizeNode(len(t.levels), 0, t.summaries(), min, max, whole, item)
+}
+
+func (t *packedTree) summarizeNode(
+	level, j int,
+	summary []nodeSummary,
+	min, max [2]float32,
+	whole func(nodeMin, nodeMax [2]float32, s nodeSummary) bool,
+	item func(id int32, point [2]float32),
+) {
+	childLevel := level - 1
+	start, end := t.children(level, j)
+
+	if childLevel == 0 {
+		for c := start; c < end; c++ {
+			x, y := t.points[2*c], t.points[2*c+1]
+			if x >= min[0] && x <= max[0] && y >= min[1] && y <= max[1] {
+				item(t.ids[c], [2]float32{x, y})
+			}
+		}
+		return
+	}
+
+	offset := t.levels[childLevel-1].start
+	for c := start; c < end; c++ {
+		b := t.boxes[4*(offset+c) : 4*(offset+c)+4]
+		if b[0] > max[0] || b[2] < min[0] || b[1] > max[1] || b[3] < min[1] {
+			continue
+		}
+		if b[0] >= min[0] && b[2] <= max[0] && b[1] >= min[1] && b[3] <= max[1] &&
+			whole([2]float32{b[0], b[1]}, [2]float32{b[2], b[3]}, summary[offset+c]) {
+			continue
+		}
+		t.summarizeNode(childLevel, c, summary, min, max, whole, item)
+	}
+}
+
+// children returns the range of nodes on the level below that node j covers.
+func (t *packedTree) children(level, j int) (start, end int) {
+	start = j * packedNodeSize
+	end = start + packedNodeSize
+	if size := t.levelSize(level - 1); end > size {
+		end = size
+	}
+	return start, end
+}
+
+// nearby calls iter with every item in order of increasing great-circle
+// distance from target until iter returns false. Distances are as returned by
+// geoTarget.dist.
+func (t *packedTree) nearby(target [2]float32, iter func(id int32, point [2]float32, dist float64) bool) {
+	it := t.nearbyIter(target, 0)
+	for {
+		_, id, point, dist, ok := it.next()
+		if !ok || !iter(id, point, dist) {
+			return
+		}
+	}
+}
+
+// nearbyIter yields items in order of increasing great-circle distance from a
+// target, and items at the same distance in leaf order.
+type nearbyIter struct {
+	t       *packedTree
+	target  geoTarget
+	minDist float64
+	queue   nodeQueue
+}
+
+// nearbyIter starts iterating at items minDist from target, skipping nodes
+// that are entirely closer.
+func (t *packedTree) nearbyIter(target [2]float32, minDist float64) *nearbyIter {
+	it := &nearbyIter{t: t, target: newGeoTarget(target), minDist: minDist, queue: make(nodeQueue, 0, 4*packedNodeSize)}
+	if t.len() > 0 {
+		it.queue.push(queuedNode{level: int32(len(t.levels)), index: 0})
+	}
+	return it
+}
+
+func (it *nearbyIter) next() (pos int, id int32, point [2]float32, dist float64, ok bool) {
+	t := it.t
+	for len(it.queue) > 0 {
+		node := it.queue.pop()
+		if node.level == 0 {
+			return int(node.index), t.ids[node.index], t.point(int(node.index)), node.dist, true
+		}
+
+		childLevel := int(node.level) - 1
+		start, end := t.children(int(node.level), int(node.index))
+		for c := start; c < end; c++ {
+			var dist float64
+			if childLevel == 0 {
+				dist = it.target.dist(t.point(c))
+				if dist < it.minDist {
+					continue
+				}
+			} else {
+				cMin, cMax := t.box(childLevel, c)
+				if it.minDist > 0 && it.target.boxMaxDist(cMin, cMax) < it.minDist {
+					continue
+				}
+				dist = it.target.boxDist(cMin, cMax)
+			}
+			it.queue.push(queuedNode{
+				dist:  dist,
+				level: int32(childLevel),
+				index: int32(c),
+			})
+		}
+	}
+	return 0, 0, [2]float32{}, 0, false
+}
+
+type queuedNode struct {
+	dist  float64
+	level int32
+	index int32
+}
+
+// nodeQueue is a binary min-heap ordered by distance.
+type nodeQueue []queuedNode
+
+func (q *nodeQueue) push(n queuedNode) {
+	*q = append(*q, n)
+	h := *q
+	i := len(h) - 1
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h[i].less(h[parent]) {
+			break
+		}
+		h[i], h[parent] = h[parent], h[i]
+		i = parent
+	}
+}
+
+func (q *nodeQueue) pop() queuedNode {
+	h := *q
+	top := h[0]
+	last := len(h) - 1
+	h[0] = h[last]
+	h = h[:last]
+	i := 0
+	for {
+		smallest := i
+		if l := 2*i + 1; l < len(h) && h[l].less(h[smallest]) {
+			smallest = l
+		}
+		if r := 2*i + 2; r < len(h) && h[r].less(h[smallest]) {
+			smallest = r
+		}
+		if smallest == i {
+			break
+		}
+		h[i], h[smallest] = h[smallest], h[i]
+		i = smallest
+	}
+	*q = h
+	return top
+}
+
+// less orders by distance, expanding nodes before emitting items at the same
+// distance so that those items are emitted in leaf order. Cursors rely on
+// this order being total.
+func (n queuedNode) less(o queuedNode) bool {
+	if n.dist != o.dist {
+		return n.dist < o.dist
+	}
+	if n.level != o.level {
+		return n.level > o.level
+	}
+	return n.index < o.index
+}
@@ -0,0 +1,168 @@
+package geograph
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tidwall/gjson"
+	"time"
+)
+
+// Picture is a record from the dump, as written by the importer. Fields the
+// importer leaves null are left as their zero value.
+type Picture struct {
+	ID               int32  `json:"gridimage_id"`
+	UserID           int32  `json:"user_id"`
+	Realname         string `json:"realname"`
+	Title            string `json:"title"`
+	Comment          string `json:"comment"`
+	ModerationStatus string `json:"moderation_status"`
+	// ImageTaken is the date the picture was taken as YYYY-MM-DD, or empty
+	// if unknown.
+	ImageTaken string `json:"imagetaken"`
+
+	GridReference  string  `json:"grid_reference"`
+	ReferenceIndex int32   `json:"reference_index"`
+	Lat            float64 `json:"wgs84_lat"`
+	Lng            float64 `json:"wgs84_long"`
+	NatEastings    int64   `json:"nateastings"`
+	NatNorthings   int64   `json:"natnorthings"`
+	NatGRLen       string  `json:"natgrlen"`
+
+	ViewpointLat       float64 `json:"viewpoint_wgs84_lat"`
+	ViewpointLng       float64 `json:"viewpoint_wgs84_long"`
+	ViewpointEastings  int64   `json:"viewpoint_eastings"`
+	ViewpointNorthings int64   `json:"viewpoint_northings"`
+	ViewpointGRLen     string  `json:"viewpoint_grlen"`
+	// ViewDirection is the compass bearing the picture was taken facing, or
+	// -1 if unknown.
+	ViewDirection int32 `json:"view_direction"`
+	Use6Fig       int32 `json:"use6fig"`
+
+	Width          int32 `json:"width"`
+	Height         int32 `json:"height"`
+	OriginalWidth  int32 `json:"original_width"`
+	OriginalHeight int32 `json:"original_height"`
+
+	Tags []Tag `json:"tags"`
+
+	// MetersFromTarget is set on pictures returned by Near.
+	MetersFromTarget int32 `json:"meters_from_target,omitempty"`
+	// MetersAlongLine and MetersFromLine are set on pictures returned by
+	// AlongLine.
+	MetersAlongLine int32 `json:"meters_along_line,omitempty"`
+	MetersFromLine  int32 `json:"meters_from_line,omitempty"`
+	// SearchScore is set on pictures returned by Search.
+	SearchScore float64 `json:"search_score,omitempty"`
+
+	raw json.RawMessage
+}
+
+type Tag struct {
+	Prefix string `json:"prefix,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+var errInvalidRecord = errors.New("invalid record")
+
+// parsePicture decodes a record, keeping it for Raw.
+//
+// Columns are decoded leniently as the JSON type of a column depends on its
+// type in the source database: numbers are accepted as strings and as
+// fractions, strings as numbers, and values that can't be converted are left
+// as their zero value. A missing or null view_direction is -1.
+func parsePicture(record []byte) (*Picture, error) {
+	if !gjson.ValidBytes(record) {
+		return nil, errInvalidRecord
+	}
+	r := gjson.ParseBytes(record)
+	if !r.IsObject() {
+		return nil, errInvalidRecord
+	}
+	int32Of := func(key string) int32 { return int32(r.Get(key).Int()) }
+	viewDirection := int32(-1)
+	if v := r.Get("view_direction"); v.Exists() && v.Type != gjson.Null && v.String() != "" {
+		viewDirection = int32(v.Int())
+	}
+
+	p := &Picture{
+		ID:               int32Of("gridimage_id"),
+		UserID:           int32Of("user_id"),
+		Realname:         r.Get("realname").String(),
+		Title:            r.Get("title").String(),
+		Comment:          r.Get("comment").String(),
+		ModerationStatus: r.Get("moderation_status").String(),
+		ImageTaken:       r.Get("imagetaken").String(),
+
+		GridReference:  r.Get("grid_reference").String(),
+		ReferenceIndex: int32Of("reference_index"),
+		Lat:            r.Get("wgs84_lat").Float(),
+		Lng:            r.Get("wgs84_long").Float(),
+		NatEastings:    r.Get("nateastings").Int(),
+		NatNorthings:   r.Get("natnorthings").Int(),
+		NatGRLen:       r.Get("natgrlen").String(),
+
+		ViewpointLat:       r.Get("viewpoint_wgs84_lat").Float(),
+		ViewpointLng:       r.Get("viewpoint_wgs84_long").Float(),
+		ViewpointEastings:  r.Get("viewpoint_eastings").Int(),
+		ViewpointNorthings: r.Get("viewpoint_northings").Int(),
+		ViewpointGRLen:     r.Get("viewpoint_grlen").String(),
+		ViewDirection:      viewDirection,
+		Use6Fig:            int32Of("use6fig"),
+
+		Width:          int32Of("width"),
+		Height:         int32Of("height"),
+		OriginalWidth:  int32Of("original_width"),
+		OriginalHeight: int32Of("original_height"),
+
+		MetersFromTarget: int32Of("meters_from_target"),
+		MetersAlongLine:  int32Of("meters_along_line"),
+		MetersFromLine:   int32Of("meters_from_line"),
+		SearchScore:      r.Get("search_score").Float(),
+
+		raw: record,
+	}
+	if tags := r.Get("tags"); tags.IsArray() {
+		tags.ForEach(func(_, tag gjson.Result) bool {
+			p.Tags = append(p.Tags, Tag{Prefix: tag.Get("prefix").String(), Tag: tag.Get("tag").String()})
+			return true
+		})
+	}
+	return p, nil
+}
+
+// Raw returns the record as stored, including any columns not covered by
+// Picture.
+func (p *Picture) Raw() json.RawMessage {
+	return p.raw
+}
+
+// Subject returns the location of the subject of the picture.
+func (p *Picture) Subject() [2]float32 {
+	return Point(float32(p.Lng), float32(p.Lat))
+}
+
+// Viewpoint returns the location the picture was taken from, if known.
+func (p *Picture) Viewpoint() ([2]float32, bool) {
+	point := Point(float32(p.ViewpointLng), float32(p.ViewpointLat))
+	return point, !isZeroPoint(point)
+}
+
+// TakenAt parses ImageTaken.
+func (p *Picture) TakenAt() (time.Time, bool) {
+	t, err := time.Parse("2006-01-02", p.ImageTaken)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// HasViewDirection reports whether ViewDirection is known.
+func (p *Picture) HasViewDirection() bool {
+	return p.ViewDirection >= 0
+}
+
+// OriginalSize is the larger dimension of the original upload, or 0 if only
+// the standard size is available.
+func (p *Picture) OriginalSize() int32 {
+	return max(p.OriginalWidth, p.OriginalHeight)
+}
@@ -0,0 +1,64 @@
+package geograph
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParsePicture(t *testing.T) {
+	record := []byte(`{"gridimage_id": 1, "user_id": 131, "realname": "Test User", "title": "Woodland Footpath", "moderation_status": "accepted", "imagetaken": "2014-04-04", "grid_reference": "NN04646386", "reference_index": 1, "wgs84_lat": 57.28793, "wgs84_long": -6.696667, "nateastings": 326894, "natnorthings": 636944, "natgrlen": "10", "viewpoint_eastings": 0, "viewpoint_northings": 0, "viewpoint_grlen": "0", "view_direction": -1, "use6fig": 0, "width": 640, "height": 480, "original_width": 800, "original_height": 1024, "comment": null, "tags": [{"prefix": "top", "tag": "Rivers, Streams, Drainage"}, {"prefix": "", "tag": "bothy"}], "extra": true}`)
+
+	got, err := parsePicture(record)
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), got.ID)
+	assert.Equal(t, int32(131), got.UserID)
+	assert.Equal(t, "NN04646386", got.GridReference)
+	assert.Equal(t, "", got.Comment)
+	assert.Equal(t, []Tag{{Prefix: "top", Tag: "Rivers, Streams, Drainage"}, {Tag: "bothy"}}, got.Tags)
+	assert.Equal(t, Point(-6.696667, 57.28793), got.Subject())
+	assert.Equal(t, int32(1024), got.OriginalSize())
+	assert.False(t, got.HasViewDirection())
+	assert.JSONEq(t, string(record), string(got.Raw()))
+
+	_, ok := got.Viewpoint()
+	assert.False(t, ok)
+
+	taken, ok := got.TakenAt()
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2014, 4, 4, 0, 0, 0, 0, time.UTC), taken)
+}
+
+func TestParsePictureColumnTypes(t *testing.T) {
+	// The importer writes DECIMAL columns as fractions and VARCHAR and ENUM
+	// columns as strings, whichever field of Picture they end up in
+	record := []byte(`{"gridimage_id": 2, "user_id": "131", "title": 1984, "reference_index": 2.0, "wgs84_lat": "54.5", "wgs84_long": -6.5, "nateastings": 326894.0, "natnorthings": "636944", "natgrlen": 10, "view_direction": "45", "use6fig": null, "width": 640.0, "tags": null}`)
+
+	got, err := parsePicture(record)
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(2), got.ID)
+	assert.Equal(t, int32(131), got.UserID)
+	assert.Equal(t, "1984", got.Title)
+	assert.Equal(t, int32(2), got.ReferenceIndex)
+	assert.Equal(t, Point(-6.5, 54.5), got.Subject())
+	assert.Equal(t, int64(326894), got.NatEastings)
+	assert.Equal(t, int64(636944), got.NatNorthings)
+	assert.Equal(t, "10", got.NatGRLen)
+	assert.Equal(t, int32(45), got.ViewDirection)
+	assert.Equal(t, int32(0), got.Use6Fig)
+	assert.Equal(t, int32(640), got.Width)
+	assert.Nil(t, got.Tags)
+
+	for _, record := range []string{`{"gridimage_id": 3}`, `{"gridimage_id": 3, "view_direction": null}`} {
+		got, err := parsePicture([]byte(record))
+		require.NoError(t, err)
+		assert.Equal(t, int32(-1), got.ViewDirection, record)
+		assert.False(t, got.HasViewDirection(), record)
+	}
+
+	_, err = parsePicture([]byte(`{"gridimage_id": 2`))
+	assert.Error(t, err)
+}
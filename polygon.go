@@ -0,0 +1,235 @@
+package geograph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrInvalidPolygon = errors.New("invalid polygon")
+
+// Polygon is an exterior ring followed by any holes, as in GeoJSON. Rings
+// are implicitly closed.
+type Polygon [][][2]float32
+
+// MultiPolygon is the union of its polygons.
+type MultiPolygon []Polygon
+
+// WithinPolygon pages through the pictures inside area that match filter.
+// Candidates are selected by the bounding box of area and then tested exactly.
+// Candidates outside area count towards the pictures examined per page as for
+// Filter. Cursors are as for Within.
+func (s *Store) WithinPolygon(area MultiPolygon, index IndexType, maxItems int, cursor string, filter Filter) (bool, string, []*Picture, error) {
+	if err := area.validate(); err != nil {
+		return false, "", nil, err
+	}
+
+	version := s.Version()
+	query := queryHash(append(area.queryParams(index), filter.queryParams()...)...)
+	after, err := decodeCursor(cursor, cursorKindPolygon, query, version)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	f := s.newFilterer(filter)
+	accept := f.accept()
+	min, max := area.bounds()
+	page, err := s.index.withinFunc(min, max, index, maxItems, after, func(id int32, point [2]float32) (bool, bool) {
+		// Test the cheaper condition first
+		if !area.contains(point) {
+			f.examined++
+			return false, f.examined < maxFilterExamined
+		} else if accept == nil {
+			return true, true
+		}
+		return accept(id, point)
+	})
+	if err != nil {
+		return false, "", nil, err
+	} else if f.err != nil {
+		return false, "", nil, f.err
+	}
+
+	out := make([]*Picture, 0, len(page.items))
+	for _, id := range page.items {
+		value, err := f.get(id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return false, "", nil, err
+		}
+		out = append(out, value)
+	}
+
+	var next string
+	if page.hasNext {
+		next = encodeCursor(cursorKindPolygon, query, version, page.next)
+	}
+	return page.hasNext, next, out, nil
+}
+
+// BoxPolygon returns the box [min, max] as a MultiPolygon.
+func BoxPolygon(min, max [2]float32) MultiPolygon {
+	return MultiPolygon{{{min, Point(max[0], min[1]), max, Point(min[0], max[1])}}}
+}
+
+func (m MultiPolygon) validate() error {
+	if len(m) == 0 {
+		return fmt.Errorf("%w: no polygons", ErrInvalidPolygon)
+	}
+	for _, polygon := range m {
+		if len(polygon) == 0 {
+			return fmt.Errorf("%w: polygon has no exterior ring", ErrInvalidPolygon)
+		}
+		for _, ring := range polygon {
+			if len(ring) < 3 {
+				return fmt.Errorf("%w: ring must have at least three points", ErrInvalidPolygon)
+			}
+			for _, p := range ring {
+				if p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 ||
+					math.IsNaN(float64(p[0])) || math.IsNaN(float64(p[1])) {
+					return fmt.Errorf("%w: position out of range", ErrInvalidPolygon)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// queryParams identifies m in a queryHash.
+func (m MultiPolygon) queryParams(index IndexType) []any {
+	params := []any{cursorKindPolygon, int32(index), int32(len(m))}
+	for _, polygon := range m {
+		params = append(params, int32(len(polygon)))
+		for _, ring := range polygon {
+			params = append(params, int32(len(ring)), ring)
+		}
+	}
+	return params
+}
+
+func (m MultiPolygon) bounds() (min, max [2]float32) {
+	min = Point(180, 90)
+	max = Point(-180, -90)
+	for _, polygon := range m {
+		// Holes are inside the exterior ring
+		for _, p := range polygon[0] {
+			min = Point(float32(math.Min(float64(min[0]), float64(p[0]))), float32(math.Min(float64(min[1]), float64(p[1]))))
+			max = Point(float32(math.Max(float64(max[0]), float64(p[0]))), float32(math.Max(float64(max[1]), float64(p[1]))))
+		}
+	}
+	return min, max
+}
+
+// contains reports whether p is inside any of the polygons, treating edges as
+// lines of constant slope in lng/lat.
+func (m MultiPolygon) contains(p [2]float32) bool {
+	for _, polygon := range m {
+		if polygon.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (polygon Polygon) contains(p [2]float32) bool {
+	if !ringContains(polygon[0], p) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains is the even-odd rule, counting the edges crossed by a ray
+// heading east from p.
+func ringContains(ring [][2]float32, p [2]float32) bool {
+	x, y := float64(p[0]), float64(p[1])
+	inside := false
+	j := len(ring) - 1
+	for i := range ring {
+		xi, yi := float64(ring[i][0]), float64(ring[i][1])
+		xj, yj := float64(ring[j][0]), float64(ring[j][1])
+		if (yi > y) != (yj > y) && x < xi+(y-yi)*(xj-xi)/(yj-yi) {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+// ParseGeoJSONPolygon parses a GeoJSON Polygon or MultiPolygon geometry, or a
+// Feature with one as its geometry.
+func ParseGeoJSONPolygon(data []byte) (MultiPolygon, error) {
+	return parseGeoJSONPolygon(data, true)
+}
+
+// parseGeoJSONPolygon is ParseGeoJSONPolygon, accepting a Feature only if
+// allowFeature so that Features can't be nested.
+func parseGeoJSONPolygon(data []byte, allowFeature bool) (MultiPolygon, error) {
+	var doc struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPolygon, err)
+	}
+
+	var coordinates [][][][]float64
+	switch doc.Type {
+	case "Feature":
+		if !allowFeature {
+			return nil, fmt.Errorf("%w: Feature nested in a Feature", ErrInvalidPolygon)
+		}
+		return parseGeoJSONPolygon(doc.Geometry, false)
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(doc.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPolygon, err)
+		}
+		coordinates = [][][][]float64{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(doc.Coordinates, &coordinates); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPolygon, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: expected Polygon or MultiPolygon, got %q", ErrInvalidPolygon, doc.Type)
+	}
+
+	out := make(MultiPolygon, 0, len(coordinates))
+	for _, polygon := range coordinates {
+		rings := make(Polygon, 0, len(polygon))
+		for _, ring := range polygon {
+			points := make([][2]float32, 0, len(ring))
+			for _, c := range ring {
+				if len(c) < 2 {
+					return nil, fmt.Errorf("%w: position must have at least two values", ErrInvalidPolygon)
+				}
+				points = append(points, Point(float32(c[0]), float32(c[1])))
+			}
+			rings = append(rings, points)
+		}
+		out = append(out, rings)
+	}
+	if err := out.validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VertexCount is the total number of points in all the rings of m.
+func (m MultiPolygon) VertexCount() int {
+	var n int
+	for _, polygon := range m {
+		for _, ring := range polygon {
+			n += len(ring)
+		}
+	}
+	return n
+}
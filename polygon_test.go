@@ -0,0 +1,95 @@
+package geograph
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestWithinPolygon(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		testRecord(1, -3.5, 56.5), // inside
+		testRecord(2, -3.2, 56.2), // in the hole
+		testRecord(3, -2.5, 56.9), // in the bounding box only
+		testRecord(4, -3.8, 56.1), // inside
+		testRecord(5, 1.5, 51.5),  // in the second polygon
+		testRecord(6, 5, 50),      // outside
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	area, err := ParseGeoJSONPolygon([]byte(`{"type":"MultiPolygon","coordinates":[
+		[[[-4,56],[-2,56],[-4,57],[-4,56]],[[-3.3,56.1],[-3.1,56.1],[-3.1,56.3],[-3.3,56.3],[-3.3,56.1]]],
+		[[[1,51],[2,51],[2,52],[1,52],[1,51]]]
+	]}`))
+	require.NoError(t, err)
+
+	var ids []int32
+	cursor := ""
+	for {
+		hasNext, next, pictures, err := subject.WithinPolygon(area, SubjectIndex, 2, cursor, Filter{})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(pictures), 2)
+		for _, pic := range pictures {
+			ids = append(ids, pic.ID)
+		}
+		if !hasNext {
+			break
+		}
+		cursor = next
+	}
+	assert.ElementsMatch(t, []int32{1, 4, 5}, ids)
+
+	other := MultiPolygon{area[1]}
+	_, _, _, err = subject.WithinPolygon(other, SubjectIndex, 2, cursor, Filter{})
+	assert.ErrorIs(t, err, ErrInvalidCursor, "should reject a cursor for a different polygon")
+}
+
+func TestWithinPolygonExaminedLimit(t *testing.T) {
+	prevLimit := maxFilterExamined
+	maxFilterExamined = 5
+	t.Cleanup(func() { maxFilterExamined = prevLimit })
+
+	// Only the corner of the bounding box near (0, 0) is inside the triangle
+	var records []string
+	for i := range int32(30) {
+		records = append(records, testRecord(i+1, 0.9-float32(i)*0.001, 0.9))
+	}
+	records = append(records, testRecord(31, 0.1, 0.1), testRecord(32, 0.2, 0.1))
+	subject := openTestStore(t, writeTestDump(t, records...), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+	area := MultiPolygon{{{Point(0, 0), Point(1, 0), Point(0, 1), Point(0, 0)}}}
+
+	var got []int32
+	pages := 0
+	cursor := ""
+	for {
+		hasNext, next, pictures, err := subject.WithinPolygon(area, SubjectIndex, 10, cursor, Filter{})
+		require.NoError(t, err)
+		pages++
+		for _, pic := range pictures {
+			got = append(got, pic.ID)
+		}
+		if !hasNext {
+			break
+		}
+		cursor = next
+	}
+	assert.ElementsMatch(t, []int32{31, 32}, got)
+	assert.GreaterOrEqual(t, pages, 6, "should stop pages after examining the limit")
+}
+
+func TestParseGeoJSONPolygon(t *testing.T) {
+	got, err := ParseGeoJSONPolygon([]byte(`{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,1],[0,0]]]}}`))
+	require.NoError(t, err)
+	assert.Equal(t, MultiPolygon{{{Point(0, 0), Point(1, 0), Point(0, 1), Point(0, 0)}}}, got)
+	assert.Equal(t, 4, got.VertexCount())
+
+	_, err = ParseGeoJSONPolygon([]byte(`{"type":"Feature","geometry":{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,1],[0,0]]]}}}`))
+	assert.ErrorIs(t, err, ErrInvalidPolygon, "should reject nested Features")
+	_, err = ParseGeoJSONPolygon([]byte(`{"type":"LineString","coordinates":[[0,0],[1,1]]}`))
+	assert.ErrorIs(t, err, ErrInvalidPolygon)
+	_, err = ParseGeoJSONPolygon([]byte(`{"type":"Polygon","coordinates":[[[0,0],[1,0]]]}`))
+	assert.ErrorIs(t, err, ErrInvalidPolygon)
+	_, err = ParseGeoJSONPolygon([]byte(`{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,100]]]}`))
+	assert.ErrorIs(t, err, ErrInvalidPolygon)
+}
@@ -0,0 +1,356 @@
+package geograph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tidwall/sjson"
+	"hash/crc32"
+	"io"
+	"slices"
+	"time"
+)
+
+// A region pack is a self-contained extract of the pictures in an area for
+// use offline. It holds the records, with their image URLs and attribution
+// already added, and the subject and viewpoint trees so that it can be
+// queried like a store.
+//
+// Layout (little-endian):
+//
+//	magic "GGRP" | pack version u32 | header JSON length u32 | header JSON |
+//	index length u32 | index in the index file format (see indexfile.go) |
+//	record count u32 | records by ascending id: id i32 | length u32 | JSON |
+//	crc32c of everything before u32
+const regionPackVersion = 1
+
+// regionPackIndexVersion is the version in the header of the index section.
+// It is independent of storeFormatVersion so that existing packs stay
+// readable when the store format changes, and must be bumped with
+// regionPackVersion if the index file layout does.
+const regionPackIndexVersion = 5
+
+var regionPackMagic = [4]byte{'G', 'G', 'R', 'P'}
+
+var (
+	ErrInvalidRegionPack = errors.New("invalid region pack")
+	ErrRegionTooLarge    = errors.New("region has too many pictures")
+)
+
+// RegionPackOptions configures ExportRegion.
+type RegionPackOptions struct {
+	// ImageSecret is used to build the image URLs added to each record
+	ImageSecret []byte
+	// MaxPictures is the most pictures the pack may hold, if positive
+	MaxPictures int
+}
+
+// RegionPackHeader describes a region pack.
+type RegionPackHeader struct {
+	DatasetVersion string       `json:"dataset_version"`
+	Created        time.Time    `json:"created"`
+	Area           MultiPolygon `json:"area"`
+	Min            [2]float32   `json:"min"`
+	Max            [2]float32   `json:"max"`
+	Pictures       int          `json:"pictures"`
+	LicenceName    string       `json:"licence_name"`
+	LicenceURL     string       `json:"licence_url"`
+}
+
+// ExportRegion writes a region pack of the pictures whose subject or
+// viewpoint is inside area to w. Each record has src and attribution added as
+// by the API.
+//
+// Records are streamed to w, so nothing is written if the area is invalid or
+// has more than opts.MaxPictures pictures, but w may have been written to
+// when other errors are returned.
+func (s *Store) ExportRegion(w io.Writer, area MultiPolygon, opts RegionPackOptions) error {
+	if err := area.validate(); err != nil {
+		return err
+	}
+	version := s.Version()
+	min, max := area.bounds()
+
+	seen := make(map[int32]bool)
+	var ids []int32
+	for _, ty := range []IndexType{SubjectIndex, ViewpointIndex} {
+		s.index.each(min, max, ty, func(id int32, point [2]float32) bool {
+			if !seen[id] && area.contains(point) {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			return opts.MaxPictures <= 0 || len(ids) <= opts.MaxPictures
+		})
+	}
+	if opts.MaxPictures > 0 && len(ids) > opts.MaxPictures {
+		return fmt.Errorf("%w: more than %d", ErrRegionTooLarge, opts.MaxPictures)
+	}
+	slices.Sort(ids)
+
+	// Records are read from a snapshot so that they are the same when indexed
+	// and when written after the index
+	snap := s.db.NewSnapshot()
+	defer func() { _ = snap.Close() }()
+
+	var indexer regionIndexer
+	var included []int32
+	for _, id := range ids {
+		pic, err := getPicture(snap, id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return err
+		}
+		indexer.add(pic)
+		included = append(included, id)
+	}
+
+	var index bytes.Buffer
+	if err := encodeIndex(&index, indexer.build(), regionPackIndexVersion); err != nil {
+		return err
+	}
+
+	headerJSON, err := json.Marshal(RegionPackHeader{
+		DatasetVersion: version,
+		Created:        time.Now().UTC(),
+		Area:           area,
+		Min:            min,
+		Max:            max,
+		Pictures:       len(included),
+		LicenceName:    licenceName,
+		LicenceURL:     licenceURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(castagnoli)
+	out := io.MultiWriter(bw, crc)
+	write := func(fields ...any) error {
+		for _, v := range fields {
+			if err := binary.Write(out, binary.LittleEndian, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := write(regionPackMagic, uint32(regionPackVersion), uint32(len(headerJSON)), headerJSON,
+		uint32(index.Len()), index.Bytes(), uint32(len(included))); err != nil {
+		return err
+	}
+	for _, id := range included {
+		pic, err := getPicture(snap, id)
+		if err != nil {
+			return err
+		}
+		record, err := sjson.SetBytes(pic.Raw(), "src", GetImageSrc(opts.ImageSecret, pic, false))
+		if err != nil {
+			return err
+		}
+		record, err = sjson.SetBytes(record, "attribution", Attribution(pic))
+		if err != nil {
+			return err
+		}
+		if err := write(id, uint32(len(record)), record); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(bw, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// regionIndexer collects the subjects and viewpoints of pictures to index.
+type regionIndexer struct {
+	subjectIDs, viewpointIDs       []int32
+	subjectPoints, viewpointPoints []float32
+}
+
+func (x *regionIndexer) add(pic *Picture) {
+	if subject := pic.Subject(); !isZeroPoint(subject) {
+		x.subjectIDs = append(x.subjectIDs, pic.ID)
+		x.subjectPoints = append(x.subjectPoints, subject[0], subject[1])
+	}
+	if viewpoint, ok := pic.Viewpoint(); ok {
+		x.viewpointIDs = append(x.viewpointIDs, pic.ID)
+		x.viewpointPoints = append(x.viewpointPoints, viewpoint[0], viewpoint[1])
+	}
+}
+
+func (x *regionIndexer) build() *inMemoryIndex {
+	return newInMemoryIndex(bulkLoad(x.subjectIDs, x.subjectPoints), bulkLoad(x.viewpointIDs, x.viewpointPoints))
+}
+
+// RegionPack is a region pack read into memory.
+type RegionPack struct {
+	Header  RegionPackHeader
+	index   *inMemoryIndex
+	records map[int32][]byte
+}
+
+// ReadRegionPack reads a region pack written by ExportRegion.
+func ReadRegionPack(r io.Reader) (*RegionPack, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalidRegionPack)
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidRegionPack)
+	}
+	br := bytes.NewReader(body)
+
+	var header struct {
+		Magic   [4]byte
+		Version uint32
+	}
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+	}
+	if header.Magic != regionPackMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidRegionPack)
+	}
+	if header.Version != regionPackVersion {
+		return nil, fmt.Errorf("%w: unsupported pack version %d", ErrInvalidRegionPack, header.Version)
+	}
+
+	p := &RegionPack{records: make(map[int32][]byte)}
+
+	headerJSON, err := readRegionPackSection(br)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headerJSON, &p.Header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+	}
+
+	// The section is copied so that it is aligned for parseIndex
+	indexData, err := readRegionPackSection(br)
+	if err != nil {
+		return nil, err
+	}
+	p.index, err = parseIndex(indexData, regionPackIndexVersion)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+	}
+
+	var count uint32
+	if err := binary.Read(br, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+	}
+	for range count {
+		var id int32
+		if err := binary.Read(br, binary.LittleEndian, &id); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+		}
+		record, err := readRegionPackSection(br)
+		if err != nil {
+			return nil, err
+		}
+		p.records[id] = record
+	}
+	if br.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidRegionPack)
+	}
+	return p, nil
+}
+
+// readRegionPackSection reads a length-prefixed section into a new slice.
+func readRegionPackSection(r *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRegionPack, err)
+	}
+	if int64(n) > int64(r.Len()) {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalidRegionPack)
+	}
+	b := make([]byte, n)
+	_, _ = io.ReadFull(r, b)
+	return b, nil
+}
+
+// Get returns the picture with id, or ErrNotFound if it isn't in the pack.
+func (p *RegionPack) Get(id int32) (*Picture, error) {
+	record, ok := p.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return parsePicture(bytes.Clone(record))
+}
+
+// Within pages through the pictures in the pack in [min, max] as
+// Store.Within does.
+func (p *RegionPack) Within(min, max [2]float32, index IndexType, maxItems int, cursor string) (bool, string, []*Picture, error) {
+	query := queryHash(cursorKindWithin, int32(index), min, max)
+	after, err := decodeCursor(cursor, cursorKindWithin, query, p.Header.DatasetVersion)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	page, err := p.index.within(min, max, index, maxItems, after)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	out := make([]*Picture, 0, len(page.items))
+	for _, id := range page.items {
+		pic, err := p.Get(id)
+		if err != nil {
+			return false, "", nil, err
+		}
+		out = append(out, pic)
+	}
+
+	var next string
+	if page.hasNext {
+		next = encodeCursor(cursorKindWithin, query, p.Header.DatasetVersion, page.next)
+	}
+	return page.hasNext, next, out, nil
+}
+
+// Near pages through the pictures in the pack closest to target as
+// Store.Near does.
+func (p *RegionPack) Near(target [2]float32, index IndexType, maxItems int, cursor string, maxMeters float64) (bool, string, []*Picture, error) {
+	query := queryHash(cursorKindNear, int32(index), target, maxMeters)
+	after, err := decodeCursor(cursor, cursorKindNear, query, p.Header.DatasetVersion)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	page, err := p.index.near(target, index, maxItems, after, maxMeters)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	out := make([]*Picture, 0, len(page.items))
+	for i, id := range page.items {
+		pic, err := p.Get(id)
+		if err != nil {
+			return false, "", nil, err
+		}
+
+		pic.MetersFromTarget = haversineDistanceMeters(page.itemPoints[i], target)
+		pic.raw, err = sjson.SetBytes(pic.raw, "meters_from_target", pic.MetersFromTarget)
+		if err != nil {
+			return false, "", nil, err
+		}
+
+		out = append(out, pic)
+	}
+
+	var next string
+	if page.hasNext {
+		next = encodeCursor(cursorKindNear, query, p.Header.DatasetVersion, page.next)
+	}
+	return page.hasNext, next, out, nil
+}
@@ -0,0 +1,94 @@
+package geograph
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"os"
+	"testing"
+)
+
+func TestExportRegion(t *testing.T) {
+	viewpointOutside := `{"gridimage_id":4,"user_id":1,"realname":"Test User","title":"Picture 4","wgs84_long":-4.5,"wgs84_lat":57.5,"viewpoint_wgs84_long":-3.5,"viewpoint_wgs84_lat":56.5}`
+	metaFile := writeTestDump(t,
+		testRecord(1, -3.2, 55.9),
+		testRecord(2, -3.3, 56),
+		testRecord(3, -2, 52),
+		viewpointOutside)
+	store := openTestStore(t, metaFile, OpenOptions{})
+	t.Cleanup(func() { _ = store.Close() })
+
+	area := MultiPolygon{{{Point(-4, 55), Point(-3, 55), Point(-3, 57), Point(-4, 57)}}}
+	var buf bytes.Buffer
+	require.NoError(t, store.ExportRegion(&buf, area, RegionPackOptions{ImageSecret: []byte("secret")}))
+	data := buf.Bytes()
+
+	pack, err := ReadRegionPack(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, store.Version(), pack.Header.DatasetVersion)
+	assert.Equal(t, 3, pack.Header.Pictures)
+
+	pic, err := pack.Get(1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, gjson.GetBytes(pic.Raw(), "src.thumbnail").String())
+	assert.Equal(t, "Test User", gjson.GetBytes(pic.Raw(), "attribution.photographer").String())
+	_, err = pack.Get(3)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Picture 4 is included by its viewpoint but indexed at both points
+	_, _, got, err := pack.Within(Point(-5, 57), Point(-4, 58), SubjectIndex, 10, "")
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, int32(4), got[0].ID)
+
+	hasNext, cursor, got, err := pack.Near(Point(-3.2, 55.9), SubjectIndex, 1, "", 0)
+	require.NoError(t, err)
+	require.True(t, hasNext)
+	assert.Equal(t, int32(1), got[0].ID)
+	_, _, got, err = pack.Near(Point(-3.2, 55.9), SubjectIndex, 1, cursor, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), got[0].ID)
+	assert.Positive(t, got[0].MetersFromTarget)
+
+	t.Run("too large", func(t *testing.T) {
+		err := store.ExportRegion(&bytes.Buffer{}, area, RegionPackOptions{MaxPictures: 2})
+		assert.ErrorIs(t, err, ErrRegionTooLarge)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		empty := MultiPolygon{{{Point(10, 10), Point(11, 10), Point(11, 11)}}}
+		var buf bytes.Buffer
+		require.NoError(t, store.ExportRegion(&buf, empty, RegionPackOptions{}))
+		pack, err := ReadRegionPack(&buf)
+		require.NoError(t, err)
+		_, _, got, err := pack.Near(Point(10, 10), ViewpointIndex, 10, "", 0)
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		corrupt[len(corrupt)/2] ^= 0xff
+		_, err := ReadRegionPack(bytes.NewReader(corrupt))
+		assert.ErrorIs(t, err, ErrInvalidRegionPack)
+	})
+}
+
+func TestReadRegionPackV1(t *testing.T) {
+	// Written by the first version of ExportRegion, which packs must stay
+	// readable by whatever the store format version
+	data, err := os.ReadFile("testdata/region_v1.ggrp")
+	require.NoError(t, err)
+	pack, err := ReadRegionPack(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 2, pack.Header.Pictures)
+
+	_, _, got, err := pack.Within(Point(-4, 55), Point(-3, 57), SubjectIndex, 10, "")
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	pic, err := pack.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Picture 1", pic.Title)
+	assert.NotEmpty(t, gjson.GetBytes(pic.Raw(), "src.thumbnail").String())
+}
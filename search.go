@@ -0,0 +1,547 @@
+package geograph
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"github.com/tidwall/sjson"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// minSearchPrefixLen is the fewest letters a word ending in * may have.
+const minSearchPrefixLen = 3
+
+// Limits on the work done by a search.
+var (
+	// maxPrefixTerms is the most words a word ending in * may match. Queries
+	// with words matching more are rejected with ErrInvalidQuery.
+	maxPrefixTerms = 200
+	// maxSearchCandidates is the most pictures matching every clause that a
+	// search ranks.
+	maxSearchCandidates = 250_000
+)
+
+// searchCacheSize is the number of ranked searches kept so that paging
+// through one doesn't score every match again.
+const searchCacheSize = 8
+
+// BM25 parameters
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+type SearchOptions struct {
+	// If Bounded only pictures with their subject in [Min, Max] are returned.
+	Bounded  bool
+	Min, Max [2]float32
+	MaxItems int
+	// Cursor is as for Within.
+	Cursor string
+}
+
+// Search pages through the pictures whose title, tags or comment match query,
+// best match first.
+//
+// Every word of query must match. Words in double quotes must match as a
+// phrase, and a word ending in * matches any word starting with it. Matches
+// are ranked by BM25, with matches in the title counting for more than in the
+// tags and in the tags more than in the comment.
+//
+// A word ending in * must have at least minSearchPrefixLen letters. If more
+// than maxSearchCandidates pictures match, only those with the lowest ids are
+// ranked. Recent searches are kept ranked to serve later pages.
+func (s *Store) Search(query string, opts SearchOptions) (bool, string, []*Picture, error) {
+	if opts.MaxItems < 1 {
+		return false, "", nil, ErrInvalidPageSize
+	}
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	version := s.Version()
+	var bounded byte
+	if opts.Bounded {
+		bounded = 1
+	}
+	queryID := queryHash(cursorKindSearch, int32(len(query)), []byte(query), bounded, opts.Min, opts.Max)
+	after, err := decodeCursor(opts.Cursor, cursorKindSearch, queryID, version)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	key := searchKey{query: query, bounded: opts.Bounded, min: opts.Min, max: opts.Max, version: version}
+	hits, ok := s.searches.get(key)
+	if !ok {
+		hits, err = s.rankSearch(clauses, opts)
+		if err != nil {
+			return false, "", nil, err
+		}
+		s.searches.put(key, hits)
+	}
+
+	start := 0
+	if after != nil {
+		var found bool
+		start, found = slices.BinarySearchFunc(hits, searchHit{int32(after.pos), after.dist}, compareSearchHits)
+		if found {
+			start++
+		}
+	}
+	hasNext := len(hits)-start > opts.MaxItems
+	hits = hits[start:min(len(hits), start+opts.MaxItems)]
+
+	out := make([]*Picture, 0, len(hits))
+	for _, h := range hits {
+		pic, err := s.Get(h.id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return false, "", nil, err
+		}
+
+		pic.SearchScore = h.score
+		pic.raw, err = sjson.SetBytes(pic.raw, "search_score", pic.SearchScore)
+		if err != nil {
+			return false, "", nil, err
+		}
+		out = append(out, pic)
+	}
+
+	var next string
+	if hasNext {
+		last := hits[len(hits)-1]
+		next = encodeCursor(cursorKindSearch, queryID, version, indexCursor{pos: int(last.id), dist: last.score})
+	}
+	return hasNext, next, out, nil
+}
+
+// rankSearch scores the pictures matching every clause, best match first.
+//
+// The postings of the clause matching the fewest pictures are walked, and the
+// other clauses only looked up for the pictures it matches.
+func (s *Store) rankSearch(clauses []searchClause, opts SearchOptions) ([]searchHit, error) {
+	stats, err := s.textStats()
+	if err != nil {
+		return nil, err
+	}
+	avgTerms := math.Max(float64(stats.terms)/math.Max(float64(stats.records), 1), 1)
+
+	plans := make([]clausePlan, 0, len(clauses))
+	for _, clause := range clauses {
+		p, err := s.planClause(clause)
+		if err != nil {
+			return nil, err
+		}
+		if p.df == 0 {
+			return nil, nil
+		}
+		plans = append(plans, p)
+	}
+	slices.SortStableFunc(plans, func(a, b clausePlan) int { return cmp.Compare(a.df, b.df) })
+
+	score := func(p clausePlan, m clauseMatch) float64 {
+		df := float64(min(uint64(p.df), stats.records))
+		idf := math.Log(1 + (float64(stats.records)-df+0.5)/(df+0.5))
+		norm := 1 - searchB + searchB*float64(m.terms)/avgTerms
+		return idf * m.tf * (searchK1 + 1) / (m.tf + searchK1*norm)
+	}
+
+	// Small bounds are applied while walking so that the candidates are all
+	// within them
+	var inBounds map[int32]bool
+	if opts.Bounded && s.index.count(opts.Min, opts.Max, SubjectIndex) <= maxSearchCandidates {
+		inBounds = make(map[int32]bool)
+		s.index.each(opts.Min, opts.Max, SubjectIndex, func(id int32, _ [2]float32) bool {
+			inBounds[id] = true
+			return true
+		})
+	}
+
+	scores := make(map[int32]float64)
+	err = s.walkClause(plans[0], func(id int32, m clauseMatch) (bool, error) {
+		if inBounds != nil && !inBounds[id] {
+			return true, nil
+		}
+		total := score(plans[0], m)
+		for _, p := range plans[1:] {
+			pm, ok, err := s.probeClause(p, id)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			total += score(p, pm)
+		}
+		scores[id] = total
+		return len(scores) < maxSearchCandidates, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Bounded && inBounds == nil {
+		inBounds := make(map[int32]float64)
+		s.index.each(opts.Min, opts.Max, SubjectIndex, func(id int32, _ [2]float32) bool {
+			if score, ok := scores[id]; ok {
+				inBounds[id] = score
+			}
+			return true
+		})
+		scores = inBounds
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{id, score})
+	}
+	slices.SortFunc(hits, compareSearchHits)
+	return hits, nil
+}
+
+type searchHit struct {
+	id    int32
+	score float64
+}
+
+func compareSearchHits(a, b searchHit) int {
+	return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.id, b.id))
+}
+
+type searchKey struct {
+	query    string
+	bounded  bool
+	min, max [2]float32
+	version  string
+}
+
+// searchCache holds the most recently ranked searches.
+type searchCache struct {
+	mu      sync.Mutex
+	entries []searchCacheEntry
+}
+
+type searchCacheEntry struct {
+	key  searchKey
+	hits []searchHit
+}
+
+func (c *searchCache) get(key searchKey) ([]searchHit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries {
+		if entry.key == key {
+			return entry.hits, true
+		}
+	}
+	return nil, false
+}
+
+func (c *searchCache) put(key searchKey, hits []searchHit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) == searchCacheSize {
+		c.entries = slices.Delete(c.entries, 0, 1)
+	}
+	c.entries = append(c.entries, searchCacheEntry{key, hits})
+}
+
+// searchClause is a term or phrase that must match.
+type searchClause struct {
+	terms []string
+	// offsets are the positions of the terms relative to the first
+	offsets []uint32
+	// prefix is set if the only term matches any term it is a prefix of
+	prefix bool
+}
+
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	for i, segment := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			// Quoted
+			var phrase searchClause
+			var start uint32
+			tokenize(segment, func(pos uint32, term string) {
+				if len(phrase.terms) == 0 {
+					start = pos
+				}
+				phrase.terms = append(phrase.terms, term)
+				phrase.offsets = append(phrase.offsets, pos-start)
+			})
+			if len(phrase.terms) > 0 {
+				clauses = append(clauses, phrase)
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(segment) {
+			var terms []string
+			tokenize(word, func(_ uint32, term string) {
+				terms = append(terms, term)
+			})
+			for j, term := range terms {
+				prefix := j == len(terms)-1 && strings.HasSuffix(word, "*")
+				if prefix && utf8.RuneCountInString(term) < minSearchPrefixLen {
+					return nil, fmt.Errorf("%w: %q is too short to end in *", ErrInvalidQuery, term)
+				}
+				clauses = append(clauses, searchClause{
+					terms:   []string{term},
+					offsets: []uint32{0},
+					prefix:  prefix,
+				})
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("%w: no words to search for", ErrInvalidQuery)
+	}
+	return clauses, nil
+}
+
+type clauseMatch struct {
+	// tf is the weighted number of times the clause matched
+	tf    float64
+	terms uint32
+}
+
+// clausePlan is a clause with the number of pictures with each of its terms,
+// used to decide the order in which clauses are matched.
+type clausePlan struct {
+	searchClause
+	// words are the words a prefix clause matches
+	words []string
+	// counts are the number of pictures with each term, or with each word of
+	// a prefix clause
+	counts []int
+	// df is an upper bound on the number of pictures matching the clause
+	df int
+}
+
+func (s *Store) planClause(clause searchClause) (clausePlan, error) {
+	p := clausePlan{searchClause: clause}
+	if clause.prefix {
+		lower, upper := prefixBounds(termCountKey(clause.terms[0])...)
+		iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+		if err != nil {
+			return p, err
+		}
+		defer func() { _ = iter.Close() }()
+		for iter.First(); iter.Valid(); iter.Next() {
+			if len(p.words) == maxPrefixTerms {
+				return p, fmt.Errorf("%w: %s* matches too many words", ErrInvalidQuery, clause.terms[0])
+			}
+			count, err := decodeTermCount(iter.Value())
+			if err != nil {
+				return p, err
+			}
+			p.words = append(p.words, string(iter.Key()[1:]))
+			p.counts = append(p.counts, count)
+			p.df += count
+		}
+		return p, iter.Error()
+	}
+
+	p.df = math.MaxInt
+	for _, term := range clause.terms {
+		count, err := s.termCount(term)
+		if err != nil {
+			return p, err
+		}
+		p.counts = append(p.counts, count)
+		p.df = min(p.df, count)
+	}
+	return p, nil
+}
+
+// walkClause calls fn with each picture matching the clause, until fn returns
+// false or an error. Phrases are walked by the postings of their rarest term.
+func (s *Store) walkClause(p clausePlan, fn func(id int32, m clauseMatch) (bool, error)) error {
+	if p.prefix {
+		// The postings of each word are merged so that pictures are only
+		// visited once
+		postings, err := s.termPostings(p.terms[0], true)
+		if err != nil {
+			return err
+		}
+		ids := make([]int32, 0, len(postings))
+		for id := range postings {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, id := range ids {
+			posting := postings[id]
+			more, err := fn(id, clauseMatch{tf: posting.weight(), terms: posting.terms})
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rarest := p.terms[slices.Index(p.counts, slices.Min(p.counts))]
+	lower, upper := prefixBounds(termPrefix(rarest)...)
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = iter.Close() }()
+	for iter.First(); iter.Valid(); iter.Next() {
+		id := keyID(iter.Key())
+		var m clauseMatch
+		if len(p.terms) == 1 {
+			posting, err := decodeTermPosting(iter.Value())
+			if err != nil {
+				return err
+			}
+			m = clauseMatch{tf: posting.weight(), terms: posting.terms}
+		} else {
+			var ok bool
+			m, ok, err = s.probeClause(p, id)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		}
+		if more, err := fn(id, m); err != nil || !more {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// probeClause returns how the picture with id matches the clause, if it
+// does, reading only the postings of that picture.
+func (s *Store) probeClause(p clausePlan, id int32) (clauseMatch, bool, error) {
+	if len(p.terms) == 1 {
+		words := p.terms
+		if p.prefix {
+			words = p.words
+		}
+		var m clauseMatch
+		found := false
+		for _, word := range words {
+			posting, ok, err := s.termPosting(word, id)
+			if err != nil {
+				return clauseMatch{}, false, err
+			} else if ok {
+				found = true
+				m.tf += posting.weight()
+				m.terms = posting.terms
+			}
+		}
+		return m, found, nil
+	}
+
+	// Phrases match where every term is at its offset from the first
+	postings := make([]termPosting, len(p.terms))
+	for i, term := range p.terms {
+		posting, ok, err := s.termPosting(term, id)
+		if err != nil || !ok {
+			return clauseMatch{}, false, err
+		}
+		postings[i] = posting
+	}
+	first := postings[0]
+	var tf float64
+	for i := range first.positions {
+		if phraseAt(postings, first.positions[i], p.offsets) {
+			tf += textFieldWeights[first.field(i)]
+		}
+	}
+	return clauseMatch{tf: tf, terms: first.terms}, tf > 0, nil
+}
+
+// phraseAt reports whether each term of a phrase occurs at its offset from
+// start, in the same field.
+func phraseAt(postings []termPosting, start uint32, offsets []uint32) bool {
+	for i := 1; i < len(postings); i++ {
+		want := start + offsets[i]<<2
+		if _, found := slices.BinarySearch(postings[i].positions, want); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// termPostings returns the postings of term by record id. If prefix is set
+// the postings of every term starting with term are merged.
+func (s *Store) termPostings(term string, prefix bool) (map[int32]termPosting, error) {
+	keyPrefix := termPrefix(term)
+	if prefix {
+		keyPrefix = keyPrefix[:len(keyPrefix)-1]
+	}
+	lower, upper := prefixBounds(keyPrefix...)
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = iter.Close() }()
+
+	postings := make(map[int32]termPosting)
+	for iter.First(); iter.Valid(); iter.Next() {
+		posting, err := decodeTermPosting(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(iter.Key())
+		if prev, ok := postings[id]; ok {
+			posting.positions = append(prev.positions, posting.positions...)
+		}
+		postings[id] = posting
+	}
+	return postings, iter.Error()
+}
+
+// termPosting returns the posting of term for the picture with id, if it has
+// the term.
+func (s *Store) termPosting(term string, id int32) (termPosting, bool, error) {
+	value, closer, err := s.db.Get(termKey(term, id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return termPosting{}, false, nil
+	} else if err != nil {
+		return termPosting{}, false, err
+	}
+	posting, err := decodeTermPosting(value)
+	if err := closer.Close(); err != nil {
+		return termPosting{}, false, err
+	}
+	return posting, err == nil, err
+}
+
+// termCount returns the number of pictures with term.
+func (s *Store) termCount(term string) (int, error) {
+	value, closer, err := s.db.Get(termCountKey(term))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	count, err := decodeTermCount(value)
+	if err := closer.Close(); err != nil {
+		return 0, err
+	}
+	return count, err
+}
+
+func (s *Store) textStats() (textStats, error) {
+	value, closer, err := s.db.Get(textStatsKey)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return textStats{}, nil
+	} else if err != nil {
+		return textStats{}, err
+	}
+	stats, err := decodeTextStats(value)
+	if err := closer.Close(); err != nil {
+		return textStats{}, err
+	}
+	return stats, err
+}
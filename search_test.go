@@ -0,0 +1,123 @@
+package geograph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func searchTestRecord(id int32, lng, lat float32, title, comment string, tags ...string) string {
+	var tagValues []Tag
+	for _, tag := range tags {
+		tagValues = append(tagValues, Tag{Tag: tag})
+	}
+	titleJSON, _ := json.Marshal(title)
+	commentJSON, _ := json.Marshal(comment)
+	tagsJSON, _ := json.Marshal(tagValues)
+	return fmt.Sprintf(`{"gridimage_id":%d,"user_id":1,"realname":"Test User","title":%s,"comment":%s,"tags":%s,"wgs84_long":%f,"wgs84_lat":%f}`,
+		id, titleJSON, commentJSON, tagsJSON, lng, lat)
+}
+
+func TestSearch(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		searchTestRecord(1, -3.2, 55.9, "Trig point on Ben Macdui", "The summit of the Cairngorms."),
+		searchTestRecord(2, -3.3, 56, "Summit cairn", "A trig point is nearby.", "trig point"),
+		searchTestRecord(3, -3.4, 56.1, "Point of the ridge", "No trig here."),
+		searchTestRecord(4, 1, 51, "Corrour Bothy", "A bothy in the Lairig Ghru.", "bothy"),
+		searchTestRecord(5, 1.1, 51.1, "Bothies and bothying", ""),
+		searchTestRecord(6, -3.25, 55.95, "Trig", "Point"),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	search := func(query string, opts SearchOptions) []int32 {
+		t.Helper()
+		if opts.MaxItems == 0 {
+			opts.MaxItems = 100
+		}
+		_, _, pictures, err := subject.Search(query, opts)
+		require.NoError(t, err)
+		var ids []int32
+		for _, pic := range pictures {
+			assert.Positive(t, pic.SearchScore)
+			ids = append(ids, pic.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []int32{1, 2}, search(`"trig point"`, SearchOptions{}),
+		"should rank title matches above comments")
+	assert.ElementsMatch(t, []int32{1, 2, 3, 6}, search(`trig point`, SearchOptions{}))
+	assert.Equal(t, []int32{4}, search(`bothy`, SearchOptions{}))
+	assert.ElementsMatch(t, []int32{4, 5}, search(`BOTH*`, SearchOptions{}))
+	assert.Equal(t, []int32{1}, search(`"summit of the cairngorms"`, SearchOptions{}),
+		"should match phrases containing stopwords")
+	assert.Equal(t, []int32{1}, search(`macdui`, SearchOptions{}))
+	assert.Empty(t, search(`"point trig"`, SearchOptions{}))
+	assert.ElementsMatch(t, []int32{1, 6}, search(`trig point`, SearchOptions{
+		Bounded: true, Min: Point(-3.25, 55.8), Max: Point(-3.1, 56),
+	}))
+
+	_, _, _, err := subject.Search(`the "of"`, SearchOptions{MaxItems: 10})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+
+	// Paging returns the same order as a single page
+	all := search(`trig point`, SearchOptions{})
+	var paged []int32
+	cursor := ""
+	for {
+		hasNext, next, pictures, err := subject.Search(`trig point`, SearchOptions{MaxItems: 1, Cursor: cursor})
+		require.NoError(t, err)
+		for _, pic := range pictures {
+			paged = append(paged, pic.ID)
+		}
+		if !hasNext {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, all, paged)
+
+	// Deltas update the index
+	require.NoError(t, subject.ApplyDelta(&Delta{
+		Upserts: []json.RawMessage{json.RawMessage(searchTestRecord(4, 1, 51, "Corrour", ""))},
+	}))
+	assert.Empty(t, search(`bothy`, SearchOptions{}))
+}
+
+func TestSearchLimits(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		searchTestRecord(1, -3.2, 55.9, "Bothy road", ""),
+		searchTestRecord(2, -3.3, 56, "Bothies road", ""),
+		searchTestRecord(3, -3.4, 56.1, "Bothying road", ""),
+		searchTestRecord(4, -3.5, 56.2, "Farm road", ""),
+		searchTestRecord(5, -3.6, 56.3, "Shieling road", ""),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	_, _, _, err := subject.Search(`bo*`, SearchOptions{MaxItems: 10})
+	assert.ErrorIs(t, err, ErrInvalidQuery, "should reject short prefixes")
+
+	prevTerms, prevCandidates := maxPrefixTerms, maxSearchCandidates
+	t.Cleanup(func() { maxPrefixTerms, maxSearchCandidates = prevTerms, prevCandidates })
+
+	maxPrefixTerms = 2
+	_, _, _, err = subject.Search(`both*`, SearchOptions{MaxItems: 10})
+	assert.ErrorIs(t, err, ErrInvalidQuery, "should cap prefix expansion")
+	maxPrefixTerms = prevTerms
+
+	maxSearchCandidates = 2
+	_, _, got, err := subject.Search(`road`, SearchOptions{MaxItems: 10})
+	require.NoError(t, err, "should not reject common words")
+	assert.Len(t, got, 2, "should cap candidates")
+
+	_, _, got, err = subject.Search(`road shieling`, SearchOptions{MaxItems: 10})
+	require.NoError(t, err)
+	require.Len(t, got, 1, "should match from the rarest word")
+	assert.Equal(t, int32(5), got[0].ID)
+
+	_, _, got, err = subject.Search(`road both*`, SearchOptions{MaxItems: 10})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
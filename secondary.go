@@ -0,0 +1,142 @@
+package geograph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"github.com/dzfranklin/plantopo-geograph/gridref"
+	"strings"
+	"time"
+)
+
+var ErrInvalidGridRef = errors.New("invalid grid reference")
+
+// ByUser pages through the pictures contributed by userID in order of id.
+// Pass the cursor returned with a page to get the next page, or an empty
+// cursor for the first page. Unlike the cursors of spatial queries these stay
+// valid when the dataset changes.
+func (s *Store) ByUser(userID int32, maxItems int, cursor string) (bool, string, []*Picture, error) {
+	lower, upper := prefixBounds(userPrefix(userID)...)
+	return s.scanSecondary(cursorKindUser, queryHash(cursorKindUser, userID), lower, upper, maxItems, cursor)
+}
+
+// InGridSquare pages through the pictures in the myriad (such as "NT"),
+// hectad ("NT27") or grid square ("NT2573") ref, in order of id. Cursors are
+// as for ByUser.
+func (s *Store) InGridSquare(ref string, maxItems int, cursor string) (bool, string, []*Picture, error) {
+	r, err := gridref.Parse(ref)
+	if err != nil || r.Digits > 2 {
+		return false, "", nil, fmt.Errorf("%w: %q", ErrInvalidGridRef, ref)
+	}
+	ref = r.String()
+
+	lower, upper := prefixBounds(gridPrefix(ref)...)
+	query := queryHash(cursorKindGrid, int32(len(ref)), []byte(ref))
+	return s.scanSecondary(cursorKindGrid, query, lower, upper, maxItems, cursor)
+}
+
+// TakenBetween pages through the pictures taken on or after after and before
+// before, in order of date and then id. Either bound may be zero. Cursors are
+// as for ByUser.
+func (s *Store) TakenBetween(after, before time.Time, maxItems int, cursor string) (bool, string, []*Picture, error) {
+	lower, upper := prefixBounds(takenKeyPrefix)
+	if !after.IsZero() {
+		lower = append([]byte{takenKeyPrefix}, after.Format(time.DateOnly)...)
+	}
+	if !before.IsZero() {
+		upper = append([]byte{takenKeyPrefix}, before.Format(time.DateOnly)...)
+	}
+	query := queryHash(cursorKindTaken, after.Unix(), before.Unix())
+	return s.scanSecondary(cursorKindTaken, query, lower, upper, maxItems, cursor)
+}
+
+// scanSecondary pages through the ids at the end of the keys in [lower,
+// upper).
+func (s *Store) scanSecondary(kind byte, query uint32, lower, upper []byte, maxItems int, cursor string) (bool, string, []*Picture, error) {
+	if maxItems < 1 {
+		return false, "", nil, ErrInvalidPageSize
+	}
+	after, err := decodeKeyCursor(cursor, kind, query)
+	if err != nil {
+		return false, "", nil, err
+	}
+	if after != nil && (bytes.Compare(after, lower) < 0 || (upper != nil && bytes.Compare(after, upper) >= 0)) {
+		return false, "", nil, fmt.Errorf("%w: cursor is for a different query", ErrInvalidCursor)
+	}
+
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return false, "", nil, err
+	}
+	defer func() { _ = iter.Close() }()
+
+	if after == nil {
+		iter.First()
+	} else if iter.SeekGE(after) && bytes.Equal(iter.Key(), after) {
+		iter.Next()
+	}
+
+	out := make([]*Picture, 0, pageAlloc(maxItems))
+	hasMore := false
+	var last []byte
+	for ; iter.Valid(); iter.Next() {
+		// Stop if past max
+		if len(out) == maxItems {
+			hasMore = true
+			break
+		}
+
+		pic, err := s.Get(keyID(iter.Key()))
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the iterator was opened
+			continue
+		} else if err != nil {
+			return false, "", nil, err
+		}
+		out = append(out, pic)
+		last = append(last[:0], iter.Key()...)
+	}
+	if err := iter.Error(); err != nil {
+		return false, "", nil, err
+	}
+
+	var next string
+	if hasMore {
+		next = encodeKeyCursor(kind, query, last)
+	}
+	return hasMore, next, out, nil
+}
+
+// gridRefLevels returns the grid square, hectad and myriad of an OSGB or
+// Irish grid reference, omitting those more precise than ref. It returns nil
+// if ref isn't a grid reference.
+func gridRefLevels(ref string) []string {
+	r, err := gridref.Parse(ref)
+	if err != nil {
+		return nil
+	}
+	var levels []string
+	for digits := min(r.Digits, 2); digits >= 0; digits-- {
+		level, err := gridref.At(r.Grid, float64(r.Easting), float64(r.Northing), digits)
+		if err != nil {
+			return nil
+		}
+		levels = append(levels, level.String())
+	}
+	return levels
+}
+
+// isTakenDate reports whether date is a YYYY-MM-DD date with a known year. The
+// month and day may be 00 if unknown.
+func isTakenDate(date string) bool {
+	if len(date) != len(time.DateOnly) || date[4] != '-' || date[7] != '-' || strings.HasPrefix(date, "0000") {
+		return false
+	}
+	for i, c := range date {
+		if i != 4 && i != 7 && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package geograph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func secondaryTestRecord(id int32, userID int32, gridRef string, taken string) string {
+	return fmt.Sprintf(`{"gridimage_id":%d,"user_id":%d,"realname":"Test User","grid_reference":%q,"imagetaken":%q,"wgs84_long":-3.2,"wgs84_lat":55.9}`,
+		id, userID, gridRef, taken)
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		secondaryTestRecord(1, 10, "NT2573", "2010-05-01"),
+		secondaryTestRecord(2, 10, "NT2674", "2012-00-00"),
+		secondaryTestRecord(3, 11, "NT2573", "2011-01-01"),
+		secondaryTestRecord(4, 10, "NT3573", ""),
+		secondaryTestRecord(5, 12, "H1234", "0000-00-00"),
+		secondaryTestRecord(6, 10, "NS9999", "2010-05-01"),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	ids := func(query func(cursor string) (bool, string, []*Picture, error)) []int32 {
+		t.Helper()
+		var out []int32
+		cursor := ""
+		for {
+			hasNext, next, pictures, err := query(cursor)
+			require.NoError(t, err)
+			for _, pic := range pictures {
+				out = append(out, pic.ID)
+			}
+			if !hasNext {
+				return out
+			}
+			cursor = next
+		}
+	}
+	byUser := func(userID int32) []int32 {
+		return ids(func(cursor string) (bool, string, []*Picture, error) {
+			return subject.ByUser(userID, 2, cursor)
+		})
+	}
+	inGrid := func(ref string) []int32 {
+		return ids(func(cursor string) (bool, string, []*Picture, error) {
+			return subject.InGridSquare(ref, 2, cursor)
+		})
+	}
+	takenBetween := func(after, before time.Time) []int32 {
+		return ids(func(cursor string) (bool, string, []*Picture, error) {
+			return subject.TakenBetween(after, before, 2, cursor)
+		})
+	}
+	date := func(s string) time.Time {
+		v, err := time.Parse(time.DateOnly, s)
+		require.NoError(t, err)
+		return v
+	}
+
+	assert.Equal(t, []int32{1, 2, 4, 6}, byUser(10))
+	assert.Empty(t, byUser(13))
+
+	assert.Equal(t, []int32{1, 3}, inGrid("nt 2573"))
+	assert.Equal(t, []int32{1, 2, 3}, inGrid("NT27"))
+	assert.Equal(t, []int32{1, 2, 3, 4}, inGrid("NT"))
+	assert.Equal(t, []int32{5}, inGrid("H13"))
+	_, _, _, err := subject.InGridSquare("NT257734", 2, "")
+	assert.ErrorIs(t, err, ErrInvalidGridRef)
+
+	assert.Equal(t, []int32{1, 6, 3, 2}, takenBetween(time.Time{}, time.Time{}))
+	assert.Equal(t, []int32{1, 6, 3}, takenBetween(date("2010-05-01"), date("2011-12-31")))
+	assert.Equal(t, []int32{3, 2}, takenBetween(date("2010-05-02"), time.Time{}))
+
+	// Cursors are tied to the query
+	_, cursor, _, err := subject.ByUser(10, 1, "")
+	require.NoError(t, err)
+	_, _, _, err = subject.ByUser(11, 1, cursor)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	// Deltas update the secondary indexes
+	require.NoError(t, subject.ApplyDelta(&Delta{
+		Upserts: []json.RawMessage{json.RawMessage(secondaryTestRecord(2, 11, "NT2573", "2012-00-00"))},
+		Deletes: []int32{4},
+	}))
+	assert.Equal(t, []int32{1, 6}, byUser(10))
+	assert.Equal(t, []int32{2, 3}, byUser(11))
+	assert.Equal(t, []int32{1, 2, 3}, inGrid("NT2573"))
+	assert.Equal(t, []int32{1, 2, 3}, inGrid("NT"))
+
+	// and their cursors stay valid
+	_, _, pictures, err := subject.ByUser(10, 1, cursor)
+	require.NoError(t, err)
+	assert.Equal(t, int32(6), pictures[0].ID)
+}
+
+func TestGridRefLevels(t *testing.T) {
+	assert.Equal(t, []string{"NN0463", "NN06", "NN"}, gridRefLevels("NN04646386"))
+	assert.Equal(t, []string{"NT2573", "NT27", "NT"}, gridRefLevels("nt 25 73"))
+	assert.Equal(t, []string{"NT27", "NT"}, gridRefLevels("NT27"))
+	assert.Equal(t, []string{"H"}, gridRefLevels("H"))
+	assert.Nil(t, gridRefLevels("NT257"))
+	assert.Nil(t, gridRefLevels("1234"))
+	assert.Nil(t, gridRefLevels(""))
+	assert.Nil(t, gridRefLevels("IZ1234"), "should reject squares outside the grid")
+}
@@ -0,0 +1,376 @@
+package geograph
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// A snapshot is a single file holding everything in a dataset directory so
+// that a store can be loaded without decoding or compacting the source.
+//
+// Layout (little-endian):
+//
+//	magic "GGSN" | snapshot version u32 | manifest length u32 | manifest JSON
+//	entries: name length u16 | name | size u64 | contents | crc32 u32
+//	end: name length u16 = 0
+const snapshotVersion = 1
+
+var snapshotMagic = [4]byte{'G', 'G', 'S', 'N'}
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// WriteSnapshot writes a snapshot of the store to w that can be loaded with
+// OpenSnapshot.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	checkpointDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(checkpointDir) }()
+
+	// Hold off deltas so that the manifest identifies those in the checkpoint
+	m := s.manifest
+	checkpointDBDir := filepath.Join(checkpointDir, dbDir)
+	s.deltaMu.Lock()
+	err = s.db.Checkpoint(checkpointDBDir, pebble.WithFlushedWAL())
+	m.DeltaSeq, m.DeltaHash = s.deltaSeq.Load(), s.deltaHash
+	s.deltaMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	manifestJSON, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	header := []any{snapshotMagic, uint32(snapshotVersion), uint32(len(manifestJSON)), manifestJSON}
+	for _, v := range header {
+		if err := binary.Write(bw, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	dbEntries, err := os.ReadDir(checkpointDBDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dbEntries {
+		if entry.IsDir() {
+			continue
+		}
+		name := dbDir + "/" + entry.Name()
+		if err := writeSnapshotEntry(bw, name, filepath.Join(checkpointDBDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSnapshotEntry(bw, indexFile, filepath.Join(s.dir, indexFile)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, uint16(0)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeSnapshotEntry(w io.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(name))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, name); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(info.Size())); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, crc), f)
+	if err != nil {
+		return err
+	}
+	if n != info.Size() {
+		return fmt.Errorf("%s changed while writing snapshot", name)
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// OpenSnapshot opens a store from a snapshot written by WriteSnapshot. The
+// snapshot may be a local path or an http(s) URL.
+//
+// If opts.DataDir already holds the contents the snapshot was taken of it is
+// reopened without downloading or reading the rest of the snapshot.
+func OpenSnapshot(ctx context.Context, snapshotFile string, opts OpenOptions) (*Store, error) {
+	progress := opts.progress()
+
+	if opts.DataDir == "" {
+		progress(LoadProgress{Phase: PhaseDownloading})
+		src, r, m, err := openSnapshotSource(ctx, snapshotFile, opts, progress)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = src.Close() }()
+		slog.Info("opening snapshot", "snapshot", snapshotFile, "version", m.snapshotVersion())
+		progress = withDatasetVersion(progress, m.DatasetVersion)
+
+		scratchDir, err := os.MkdirTemp("", "")
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Using scratchDir " + scratchDir)
+
+		ds, err := openSnapshotDataset(r, scratchDir, m, progress)
+		if err != nil {
+			_ = os.RemoveAll(scratchDir)
+			return nil, err
+		}
+		ds.removeOnClose = true
+		return &Store{dataset: ds}, nil
+	}
+
+	m, err := peekSnapshotManifest(ctx, snapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("opening snapshot", "snapshot", snapshotFile, "version", m.snapshotVersion())
+	progress = withDatasetVersion(progress, m.DatasetVersion)
+
+	if err := os.MkdirAll(opts.DataDir, 0750); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(opts.DataDir, datasetDirPrefix+m.snapshotVersion())
+
+	store, err := openDataset(dir, func() (*dataset, error) {
+		if existing, ok := readManifest(dir); ok && existing.FormatVersion == m.FormatVersion &&
+			existing.snapshotVersion() == m.snapshotVersion() {
+			slog.Info("reopening existing store", "dir", dir)
+			ds, err := reopen(dir, m, progress)
+			if err != nil {
+				return nil, err
+			}
+			// Deltas applied since the snapshot was extracted make the
+			// directory differ from the snapshot
+			if ds.deltaSeq.Load() == m.DeltaSeq && ds.deltaHash == m.DeltaHash {
+				return ds, nil
+			}
+			slog.Info("existing store has diverged from snapshot", "dir", dir)
+			if err := ds.close(); err != nil {
+				return nil, err
+			}
+		}
+
+		progress(LoadProgress{Phase: PhaseDownloading})
+		src, r, downloaded, err := openSnapshotSource(ctx, snapshotFile, opts, progress)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = src.Close() }()
+		if downloaded.snapshotVersion() != m.snapshotVersion() {
+			return nil, fmt.Errorf("%s changed while opening it", snapshotFile)
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.Mkdir(dir, 0750); err != nil {
+			return nil, err
+		}
+		ds, err := openSnapshotDataset(r, dir, m, progress)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+		return ds, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruneDatasets(opts.DataDir, dir)
+	return store, nil
+}
+
+// openSnapshotSource opens or downloads a snapshot and reads its header,
+// returning a reader positioned at the first entry.
+func openSnapshotSource(
+	ctx context.Context,
+	snapshotFile string,
+	opts OpenOptions,
+	progress func(LoadProgress),
+) (io.Closer, io.Reader, manifest, error) {
+	src, err := openSource(ctx, snapshotFile, opts, progress)
+	if err != nil {
+		return nil, nil, manifest{}, err
+	}
+	r := bufio.NewReaderSize(src, 1<<20)
+	m, err := readSnapshotHeader(r)
+	if err != nil {
+		_ = src.Close()
+		return nil, nil, manifest{}, err
+	}
+	return src, r, m, nil
+}
+
+// peekSnapshotManifest reads the manifest of a snapshot without downloading
+// the rest of it.
+func peekSnapshotManifest(ctx context.Context, snapshotFile string) (manifest, error) {
+	var src io.ReadCloser
+	if isRemote(snapshotFile) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, snapshotFile, nil)
+		if err != nil {
+			return manifest{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return manifest{}, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return manifest{}, &HTTPStatusError{URL: snapshotFile, StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		src = resp.Body
+	} else {
+		f, err := os.Open(snapshotFile)
+		if err != nil {
+			return manifest{}, err
+		}
+		src = f
+	}
+	defer func() { _ = src.Close() }()
+	return readSnapshotHeader(bufio.NewReader(src))
+}
+
+func openSnapshotDataset(r io.Reader, dir string, m manifest, progress func(LoadProgress)) (*dataset, error) {
+	slog.Info("extracting snapshot", "dir", dir)
+	progress(LoadProgress{Phase: PhaseExtracting})
+	if err := extractSnapshot(r, dir); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(dir, m); err != nil {
+		return nil, err
+	}
+	return reopen(dir, m, progress)
+}
+
+func readSnapshotHeader(r io.Reader) (manifest, error) {
+	var header struct {
+		Magic       [4]byte
+		Version     uint32
+		ManifestLen uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return manifest{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if header.Magic != snapshotMagic {
+		return manifest{}, fmt.Errorf("%w: bad magic", ErrInvalidSnapshot)
+	}
+	if header.Version != snapshotVersion {
+		return manifest{}, fmt.Errorf("%w: unsupported snapshot version %d", ErrInvalidSnapshot, header.Version)
+	}
+
+	manifestJSON := make([]byte, header.ManifestLen)
+	if _, err := io.ReadFull(r, manifestJSON); err != nil {
+		return manifest{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	var m manifest
+	if err := json.Unmarshal(manifestJSON, &m); err != nil {
+		return manifest{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if m.DeltaHash != "" && len(m.DeltaHash) != 2*sha256.Size {
+		return manifest{}, fmt.Errorf("%w: invalid delta hash", ErrInvalidSnapshot)
+	}
+	if m.FormatVersion != storeFormatVersion {
+		return manifest{}, fmt.Errorf("%w: snapshot has store format %d but this build uses %d",
+			ErrInvalidSnapshot, m.FormatVersion, storeFormatVersion)
+	}
+	return m, nil
+}
+
+func extractSnapshot(r io.Reader, dir string) error {
+	if err := os.Mkdir(filepath.Join(dir, dbDir), 0750); err != nil {
+		return err
+	}
+
+	for {
+		var nameLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		if nameLen == 0 {
+			return nil
+		}
+
+		nameBytes := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, nameBytes); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		name := string(nameBytes)
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("%w: invalid entry name %q", ErrInvalidSnapshot, name)
+		}
+
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+
+		if err := extractSnapshotEntry(r, filepath.Join(dir, filepath.FromSlash(name)), int64(size)); err != nil {
+			return fmt.Errorf("extract %s: %w", name, err)
+		}
+	}
+}
+
+func extractSnapshotEntry(r io.Reader, path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(f, crc), r, size); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	var expected uint32
+	if err := binary.Read(r, binary.LittleEndian, &expected); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if crc.Sum32() != expected {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+	return nil
+}
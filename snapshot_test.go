@@ -0,0 +1,98 @@
+package geograph
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSnapshot(t *testing.T, snapshotFile string, opts OpenOptions) *Store {
+	t.Helper()
+	store, err := OpenSnapshot(context.Background(), snapshotFile, opts)
+	require.NoError(t, err)
+	return store
+}
+
+func TestSnapshot(t *testing.T) {
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56))
+	source := openTestStore(t, metaFile, OpenOptions{})
+	t.Cleanup(func() { _ = source.Close() })
+
+	snapshotFile := filepath.Join(t.TempDir(), "store.ggsnap")
+	f, err := os.Create(snapshotFile)
+	require.NoError(t, err)
+	require.NoError(t, source.WriteSnapshot(f))
+	require.NoError(t, f.Close())
+
+	t.Run("scratch", func(t *testing.T) {
+		subject := openTestSnapshot(t, snapshotFile, OpenOptions{})
+		defer func() { require.NoError(t, subject.Close()) }()
+
+		assert.Equal(t, source.Version(), subject.Version())
+		want, err := source.Get(2)
+		require.NoError(t, err)
+		got, err := subject.Get(2)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		_, _, page, err := subject.Near(Point(-3.3, 56), SubjectIndex, 1, "", 0, Filter{})
+		require.NoError(t, err)
+		assert.Len(t, page, 1)
+	})
+
+	t.Run("data dir", func(t *testing.T) {
+		dataDir := t.TempDir()
+
+		first := openTestSnapshot(t, snapshotFile, OpenOptions{DataDir: dataDir})
+		require.NoError(t, first.Close())
+
+		second := openTestSnapshot(t, snapshotFile, OpenOptions{DataDir: dataDir})
+		defer func() { require.NoError(t, second.Close()) }()
+		_, err := second.Get(1)
+		require.NoError(t, err)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		data, err := os.ReadFile(snapshotFile)
+		require.NoError(t, err)
+		data[len(data)-10] ^= 0xff
+		corruptFile := filepath.Join(t.TempDir(), "corrupt.ggsnap")
+		require.NoError(t, os.WriteFile(corruptFile, data, 0600))
+
+		_, err = OpenSnapshot(context.Background(), corruptFile, OpenOptions{})
+		assert.ErrorIs(t, err, ErrInvalidSnapshot)
+	})
+}
+
+func TestSnapshotWithDeltas(t *testing.T) {
+	prev := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56))
+	next := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(3, -3.4, 56.1))
+	source := openTestStore(t, prev, OpenOptions{})
+	t.Cleanup(func() { _ = source.Close() })
+
+	writeSnapshot := func(t *testing.T) string {
+		snapshotFile := filepath.Join(t.TempDir(), "store.ggsnap")
+		f, err := os.Create(snapshotFile)
+		require.NoError(t, err)
+		require.NoError(t, source.WriteSnapshot(f))
+		require.NoError(t, f.Close())
+		return snapshotFile
+	}
+
+	dataDir := t.TempDir()
+	base := openTestSnapshot(t, writeSnapshot(t), OpenOptions{DataDir: dataDir})
+	require.NoError(t, base.Close())
+
+	require.NoError(t, source.ApplyDelta(diffTestDumps(t, prev, next)))
+	subject := openTestSnapshot(t, writeSnapshot(t), OpenOptions{DataDir: dataDir})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	assert.Equal(t, source.Version(), subject.Version())
+	_, err := subject.Get(2)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = subject.Get(3)
+	assert.NoError(t, err)
+}
@@ -1,8 +1,10 @@
 package geograph
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/cockroachdb/pebble"
@@ -10,84 +12,174 @@ import (
 	"io"
 	"log/slog"
 	"math"
-	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNotFound = errors.New("not found")
 
 type Store struct {
-	index      *inMemoryIndex
-	db         *pebble.DB
-	scratchDir string
+	*dataset
+	closed atomic.Bool
 }
 
-type Tag struct {
-	Prefix string `json:"prefix,omitempty"`
-	Tag    string `json:"tag,omitempty"`
+// dataset is an open dataset directory, which may be shared by several
+// stores opened on the same DataDir.
+type dataset struct {
+	index         *inMemoryIndex
+	db            *pebble.DB
+	dir           string
+	removeOnClose bool
+	manifest      manifest
+	deltaMu       sync.Mutex
+	deltaSeq      atomic.Uint64
+	deltaHash     string // guarded by deltaMu
+	version       atomic.Pointer[string]
+	searches      searchCache
+	refs          int
 }
 
-func Open(metaFile string) *Store {
-	scratchDir, err := os.MkdirTemp("", "")
+// Open opens a store of the gzipped NDJSON dump metaFile, which may be a local
+// path or an http(s) URL.
+func Open(ctx context.Context, metaFile string, opts OpenOptions) (*Store, error) {
+	progress := opts.progress()
+
+	progress(LoadProgress{Phase: PhaseDownloading})
+	version, err := sourceVersion(ctx, metaFile)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	dsVersion := datasetVersion(version)
+	progress = withDatasetVersion(progress, dsVersion)
+
+	if opts.DataDir == "" {
+		scratchDir, err := os.MkdirTemp("", "")
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Using scratchDir " + scratchDir)
+
+		ds, err := build(ctx, scratchDir, metaFile, version, dsVersion, opts, progress)
+		if err != nil {
+			_ = os.RemoveAll(scratchDir)
+			return nil, err
+		}
+		ds.removeOnClose = true
+		return &Store{dataset: ds}, nil
 	}
-	slog.Info("Using scratchDir " + scratchDir)
 
-	var metaF io.ReadCloser
-	if strings.HasPrefix(metaFile, "https://") || strings.HasPrefix(metaFile, "http://") {
-		resp, err := http.Get(metaFile)
+	if err := os.MkdirAll(opts.DataDir, 0750); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(opts.DataDir, datasetDirPrefix+dsVersion)
+
+	if m, ok := readManifest(dir); ok && version != "" &&
+		m.FormatVersion == storeFormatVersion && m.SourceVersion == version {
+		store, err := openDataset(dir, func() (*dataset, error) {
+			slog.Info("reopening existing store", "dir", dir)
+			return reopen(dir, m, progress)
+		})
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		pruneDatasets(opts.DataDir, dir)
+		return store, nil
+	}
+
+	store, err := openDataset(dir, func() (*dataset, error) {
+		// Anything left in dir is from an interrupted build
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
 		}
-		metaF = resp.Body
-	} else {
-		var err error
-		metaF, err = os.Open(metaFile)
+		if err := os.Mkdir(dir, 0750); err != nil {
+			return nil, err
+		}
+		slog.Info("building store", "dir", dir)
+
+		ds, err := build(ctx, dir, metaFile, version, dsVersion, opts, progress)
 		if err != nil {
-			panic(err)
+			_ = os.RemoveAll(dir)
+			return nil, err
 		}
+		return ds, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruneDatasets(opts.DataDir, dir)
+	return store, nil
+}
+
+func build(
+	ctx context.Context,
+	dir string,
+	metaFile string,
+	version string,
+	dsVersion string,
+	opts OpenOptions,
+	progress func(LoadProgress),
+) (*dataset, error) {
+	metaF, err := openSource(ctx, metaFile, opts, progress)
+	if err != nil {
+		return nil, err
 	}
 	defer func() { _ = metaF.Close() }()
 
 	metaR, err := gzip.NewReader(metaF)
 	if err != nil {
-		panic(err)
+		return nil, &RecordError{Line: 1, Err: err}
 	}
-	metaD := json.NewDecoder(metaR)
+	lines := bufio.NewReaderSize(metaR, 1<<20)
 
 	dbOpts := new(pebble.Options)
 	dbOpts.ErrorIfExists = true
 	dbOpts.L0StopWritesThreshold = math.MaxInt32
 	dbOpts.DisableAutomaticCompactions = true
 
-	db, err := pebble.Open(scratchDir, dbOpts)
+	db, err := pebble.Open(filepath.Join(dir, dbDir), dbOpts)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	closeOnErr := func(err error) (*dataset, error) {
+		_ = db.Close()
+		return nil, err
 	}
 
 	indexData := indexContents{}
+	var textStats textStats
+	tags := make(tagCounts)
+	terms := make(termCounts)
+
+	// Records are written in batches as writing each key separately is slow
+	batch := db.NewBatch()
+	defer func() { _ = batch.Close() }()
 
+	progress(LoadProgress{Phase: PhaseWriting})
 	i := 0
-	for {
-		var record json.RawMessage
-		err := metaD.Decode(&record)
-		if errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
-			panic(err)
+	for line := 1; ; line++ {
+		if line%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return closeOnErr(err)
+			}
 		}
 
-		var data struct {
-			ID           int32   `json:"gridimage_id"`
-			SubjectLng   float32 `json:"wgs84_long"`
-			SubjectLat   float32 `json:"wgs84_lat"`
-			ViewpointLng float32 `json:"viewpoint_wgs84_long"`
-			ViewpointLat float32 `json:"viewpoint_wgs84_lat"`
+		record, err := lines.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(record) == 0 {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return closeOnErr(&RecordError{Line: line, Err: err})
 		}
-		if err := json.Unmarshal(record, &data); err != nil {
-			panic(err)
+		record = bytes.TrimSpace(record)
+		if len(record) == 0 {
+			continue
+		}
+
+		data, err := parseIndexedFields(record)
+		if err != nil {
+			return closeOnErr(&RecordError{Line: line, Err: err})
 		}
 		indexData.ID = append(indexData.ID, data.ID)
 		indexData.SubjectLng = append(indexData.SubjectLng, data.SubjectLng)
@@ -95,107 +187,301 @@ func Open(metaFile string) *Store {
 		indexData.ViewpointLng = append(indexData.ViewpointLng, data.ViewpointLng)
 		indexData.ViewpointLat = append(indexData.ViewpointLat, data.ViewpointLat)
 
-		if err := db.Set(idToKey(data.ID), record, &pebble.WriteOptions{Sync: false}); err != nil {
-			panic(err)
+		if err := batch.Set(recordKey(data.ID), record, nil); err != nil {
+			return closeOnErr(err)
 		}
+		for _, entry := range secondaryEntries(data) {
+			if err := batch.Set(entry.key, entry.value, nil); err != nil {
+				return closeOnErr(err)
+			}
+		}
+		textStats.add(data)
+		tags.add(data, 1)
+		terms.add(data, 1)
 
 		i++
+		if i%1000 == 0 {
+			if err := batch.Commit(pebble.NoSync); err != nil {
+				return closeOnErr(err)
+			}
+			batch.Reset()
+		}
 		if i%100_000 == 0 {
-			slog.Info("loading", "i", i)
+			progress(LoadProgress{Phase: PhaseWriting, Records: i})
+		}
+	}
+	if i == 0 {
+		return closeOnErr(errors.New("source has no records"))
+	}
+
+	if err := batch.Set(textStatsKey, textStats.encode(), nil); err != nil {
+		return closeOnErr(err)
+	}
+	for key, tc := range tags {
+		if err := batch.Set([]byte(key), tc.encode(), nil); err != nil {
+			return closeOnErr(err)
+		}
+	}
+	for term, count := range terms {
+		if err := batch.Set(termCountKey(term), encodeTermCount(count), nil); err != nil {
+			return closeOnErr(err)
 		}
 	}
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return closeOnErr(err)
+	}
+
+	progress(LoadProgress{Phase: PhaseCompacting, Records: i})
+	for _, prefix := range []byte{recordKeyPrefix, userKeyPrefix, gridKeyPrefix, takenKeyPrefix, termKeyPrefix, tagKeyPrefix, termCountKeyPrefix} {
+		compactStart, compactEnd := prefixBounds(prefix)
+		if err := db.Compact(compactStart, compactEnd, true); err != nil {
+			return closeOnErr(err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return closeOnErr(err)
+	}
+
+	progress(LoadProgress{Phase: PhaseIndexing, Records: i})
+	if err := writeIndex(filepath.Join(dir, indexFile), loadIndex(indexData)); err != nil {
+		return closeOnErr(err)
+	}
+	index, err := mapIndex(filepath.Join(dir, indexFile))
+	if err != nil {
+		return closeOnErr(err)
+	}
+
+	m := manifest{
+		FormatVersion:  storeFormatVersion,
+		DatasetVersion: dsVersion,
+		Source:         metaFile,
+		SourceVersion:  version,
+		Records:        i,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := writeManifest(dir, m); err != nil {
+		_ = index.close()
+		return closeOnErr(err)
+	}
+
+	slog.Info("store ready")
+
+	return &dataset{
+		index:    index,
+		db:       db,
+		dir:      dir,
+		manifest: m,
+		refs:     1,
+	}, nil
+}
+
+// reopen opens a complete dataset directory written by build.
+func reopen(dir string, m manifest, progress func(LoadProgress)) (*dataset, error) {
+	dbOpts := new(pebble.Options)
+	dbOpts.ErrorIfNotExists = true
+
+	db, err := pebble.Open(filepath.Join(dir, dbDir), dbOpts)
+	if err != nil {
+		return nil, err
+	}
 
-	slog.Info("compacting")
-	if err := db.Compact(idToKey(0), idToKey(math.MaxInt32), true); err != nil {
-		panic(err)
+	progress(LoadProgress{Phase: PhaseIndexing, Records: m.Records})
+	index, err := mapIndex(filepath.Join(dir, indexFile))
+	if err != nil {
+		_ = db.Close()
+		return nil, err
 	}
 
-	slog.Info("loading index")
-	index := loadIndex(indexData)
+	ds := &dataset{
+		index:    index,
+		db:       db,
+		dir:      dir,
+		manifest: m,
+		refs:     1,
+	}
+	if err := ds.loadDeltas(); err != nil {
+		_ = index.close()
+		_ = db.Close()
+		return nil, err
+	}
 
 	slog.Info("store ready")
 
-	return &Store{
-		index:      index,
-		db:         db,
-		scratchDir: scratchDir,
+	return ds, nil
+}
+
+type indexedFields struct {
+	ID           int32   `json:"gridimage_id"`
+	SubjectLng   float32 `json:"wgs84_long"`
+	SubjectLat   float32 `json:"wgs84_lat"`
+	ViewpointLng float32 `json:"viewpoint_wgs84_long"`
+	ViewpointLat float32 `json:"viewpoint_wgs84_lat"`
+
+	UserID        int32  `json:"user_id"`
+	GridReference string `json:"grid_reference"`
+	ImageTaken    string `json:"imagetaken"`
+	Title         string `json:"title"`
+	Comment       string `json:"comment"`
+	Tags          []Tag  `json:"tags"`
+}
+
+func parseIndexedFields(record []byte) (indexedFields, error) {
+	var data indexedFields
+	err := json.Unmarshal(record, &data)
+	return data, err
+}
+
+// Version identifies the dataset the store was built from and the deltas
+// applied to it. Stores built from the same source by the same version of this
+// package and with the same deltas applied share a version.
+func (s *Store) Version() string {
+	if version := s.version.Load(); version != nil {
+		return *version
 	}
+	return s.manifest.DatasetVersion
 }
 
+// Close closes the store. The dataset directory is closed once every store
+// sharing it has been closed. Closing a store again does nothing.
 func (s *Store) Close() error {
-	dbErr := s.db.Close()
-	rmScratchErr := os.RemoveAll(s.scratchDir)
+	if !s.closed.CompareAndSwap(false, true) {
+		// Already released its reference to the dataset
+		return nil
+	}
+	last, removeOnClose := releaseDataset(s.dataset)
+	if !last {
+		return nil
+	}
 
-	if dbErr != nil {
-		return dbErr
-	} else if rmScratchErr != nil {
-		return rmScratchErr
+	closeErr := s.close()
+
+	var rmErr error
+	if removeOnClose {
+		rmErr = os.RemoveAll(s.dir)
+	}
+
+	if closeErr != nil {
+		return closeErr
+	} else if rmErr != nil {
+		return rmErr
 	}
 
 	slog.Info("closed store")
 	return nil
 }
 
-func (s *Store) Within(min, max [2]float32, index IndexType, maxItems, cursor int) (bool, int, []string, error) {
-	page, err := s.index.within(min, max, index, maxItems, cursor)
+// close closes the database and index of a dataset no store refers to.
+func (ds *dataset) close() error {
+	dbErr := ds.db.Close()
+	indexErr := ds.index.close()
+	if dbErr != nil {
+		return dbErr
+	}
+	return indexErr
+}
+
+// Within pages through the pictures in [min, max] that match filter. Pass the
+// cursor returned with a page to get the next page, or an empty cursor for the
+// first page.
+func (s *Store) Within(min, max [2]float32, index IndexType, maxItems int, cursor string, filter Filter) (bool, string, []*Picture, error) {
+	// The version is read before the index so that a delta applied
+	// concurrently makes the returned cursor stale rather than wrong
+	version := s.Version()
+	query := queryHash(append([]any{cursorKindWithin, int32(index), min, max}, filter.queryParams()...)...)
+	after, err := decodeCursor(cursor, cursorKindWithin, query, version)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	f := s.newFilterer(filter)
+	page, err := s.index.withinFunc(min, max, index, maxItems, after, f.accept())
 	if err != nil {
-		return false, 0, nil, err
+		return false, "", nil, err
+	} else if f.err != nil {
+		return false, "", nil, f.err
 	}
 
-	out := make([]string, 0, len(page.items))
+	out := make([]*Picture, 0, len(page.items))
 	for _, id := range page.items {
-		value, err := s.Get(id)
-		if err != nil {
-			return false, 0, nil, err
+		value, err := f.get(id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return false, "", nil, err
 		}
 		out = append(out, value)
 	}
 
-	return page.hasNext, page.nextCursor, out, nil
+	var next string
+	if page.hasNext {
+		next = encodeCursor(cursorKindWithin, query, version, page.next)
+	}
+	return page.hasNext, next, out, nil
 }
 
-func (s *Store) Near(target [2]float32, index IndexType, maxItems, cursor int) (bool, int, []string, error) {
-	page, err := s.index.near(target, index, maxItems, cursor)
+// Near pages through the pictures closest to target that match filter,
+// nearest first. If maxMeters is positive pictures further away are excluded.
+// Cursors are as for Within.
+func (s *Store) Near(target [2]float32, index IndexType, maxItems int, cursor string, maxMeters float64, filter Filter) (bool, string, []*Picture, error) {
+	version := s.Version()
+	query := queryHash(append([]any{cursorKindNear, int32(index), target, maxMeters}, filter.queryParams()...)...)
+	after, err := decodeCursor(cursor, cursorKindNear, query, version)
+	if err != nil {
+		return false, "", nil, err
+	}
+
+	f := s.newFilterer(filter)
+	page, err := s.index.nearFunc(target, index, maxItems, after, maxMeters, f.accept())
 	if err != nil {
-		return false, 0, nil, err
+		return false, "", nil, err
+	} else if f.err != nil {
+		return false, "", nil, f.err
 	}
 
-	out := make([]string, 0, len(page.items))
+	out := make([]*Picture, 0, len(page.items))
 	for i, id := range page.items {
-		value, err := s.Get(id)
-		if err != nil {
-			return false, 0, nil, err
+		value, err := f.get(id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return false, "", nil, err
 		}
 
-		value, err = sjson.Set(value, "meters_from_target", haversineDistanceMeters(page.itemPoints[i], target))
+		value.MetersFromTarget = haversineDistanceMeters(page.itemPoints[i], target)
+		value.raw, err = sjson.SetBytes(value.raw, "meters_from_target", value.MetersFromTarget)
 		if err != nil {
-			return false, 0, nil, err
+			return false, "", nil, err
 		}
 
 		out = append(out, value)
 	}
 
-	return page.hasNext, page.nextCursor, out, nil
+	var next string
+	if page.hasNext {
+		next = encodeCursor(cursorKindNear, query, version, page.next)
+	}
+	return page.hasNext, next, out, nil
+}
+
+func (s *Store) Get(id int32) (*Picture, error) {
+	return getPicture(s.db, id)
 }
 
-func (s *Store) Get(id int32) (string, error) {
-	valueBytes, closer, err := s.db.Get(idToKey(id))
+// getPicture reads the picture with id from r.
+func getPicture(r pebble.Reader, id int32) (*Picture, error) {
+	valueBytes, closer, err := r.Get(recordKey(id))
 	if errors.Is(err, pebble.ErrNotFound) {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	} else if err != nil {
-		return "", err
+		return nil, err
 	}
-	value := string(valueBytes)
+	value, err := parsePicture(bytes.Clone(valueBytes))
 	if err := closer.Close(); err != nil {
-		return "", err
+		return nil, err
 	}
-	return value, nil
-}
-
-func idToKey(id int32) []byte {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, uint32(id))
-	return b
+	return value, err
 }
 
 func degreesToRadians(d float64) float64 {
@@ -216,5 +502,5 @@ func haversineDistanceMeters(p, q [2]float32) int32 {
 
 	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
 
-	return int32(math.Round(c * 6371e3))
+	return int32(math.Round(c * earthRadiusMeters))
 }
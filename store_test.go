@@ -1,10 +1,16 @@
 package geograph
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -41,14 +47,90 @@ func TestOpenFull(t *testing.T) {
 	// naive: 8m 1s
 	// one compaction: 3m 37s
 
-	subject := Open("./import/out/meta.ndjson.gz")
+	subject := openTestStore(t, "./import/out/meta.ndjson.gz", OpenOptions{})
 	err := subject.Close()
 	require.NoError(t, err)
 }
 
+func TestOpenDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56))
+
+	first := openTestStore(t, metaFile, OpenOptions{DataDir: dataDir})
+	require.NoError(t, first.Close())
+
+	second := openTestStore(t, metaFile, OpenOptions{DataDir: dataDir})
+	assert.Equal(t, first.Version(), second.Version())
+	assert.Equal(t, first.manifest.CreatedAt, second.manifest.CreatedAt, "should reuse existing store")
+	_, err := second.Get(2)
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+
+	metaFile = writeTestDump(t, testRecord(1, -3.2, 55.9))
+	third := openTestStore(t, metaFile, OpenOptions{DataDir: dataDir})
+	assert.NotEqual(t, first.Version(), third.Version())
+	_, err = third.Get(2)
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, third.Close())
+
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "should prune stale dataset")
+}
+
+func TestOpenDataDirWhileOpen(t *testing.T) {
+	dataDir := t.TempDir()
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9))
+
+	first := openTestStore(t, metaFile, OpenOptions{DataDir: dataDir})
+	second := openTestStore(t, metaFile, OpenOptions{DataDir: dataDir})
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close())
+	_, err := second.Get(1)
+	require.NoError(t, err, "should share the dataset with the first store even if closed twice")
+
+	newMetaFile := writeTestDump(t, testRecord(2, -3.2, 55.9))
+	third := openTestStore(t, newMetaFile, OpenOptions{DataDir: dataDir})
+	defer func() { require.NoError(t, third.Close()) }()
+	_, err = second.Get(1)
+	require.NoError(t, err, "should not remove a dataset still in use")
+
+	require.NoError(t, second.Close())
+	_, err = os.Stat(second.dir)
+	assert.ErrorIs(t, err, os.ErrNotExist, "should remove stale dataset once closed")
+}
+
+func TestOpenDataDirConcurrently(t *testing.T) {
+	dataDir := t.TempDir()
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9))
+
+	stores := make([]*Store, 4)
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, err := Open(context.Background(), metaFile, OpenOptions{DataDir: dataDir})
+			assert.NoError(t, err)
+			stores[i] = store
+		}()
+	}
+	wg.Wait()
+	require.NotContains(t, stores, (*Store)(nil))
+
+	for _, store := range stores {
+		assert.Same(t, stores[0].dataset, store.dataset)
+	}
+	for _, store := range stores {
+		_, err := store.Get(1)
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+	}
+}
+
 func sampleSubject(t *testing.T) *Store {
 	t.Helper()
-	subject := Open("./sample.ndjson.gz")
+	subject := openTestStore(t, "./sample.ndjson.gz", OpenOptions{})
 	t.Cleanup(func() {
 		if err := subject.Close(); err != nil {
 			t.Error(err)
@@ -57,7 +139,85 @@ func sampleSubject(t *testing.T) *Store {
 	return subject
 }
 
+func TestOpenErrors(t *testing.T) {
+	t.Run("bad record", func(t *testing.T) {
+		metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9), "", `{"gridimage_id":`, testRecord(2, -3.3, 56))
+		_, err := Open(context.Background(), metaFile, OpenOptions{})
+		var recordErr *RecordError
+		require.ErrorAs(t, err, &recordErr)
+		assert.Equal(t, 3, recordErr.Line)
+	})
+
+	t.Run("http status", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		_, err := Open(context.Background(), srv.URL+"/meta.ndjson.gz", OpenOptions{})
+		var statusErr *HTTPStatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		dataDir := t.TempDir()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9))
+		_, err := Open(ctx, metaFile, OpenOptions{DataDir: dataDir})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		entries, err := os.ReadDir(dataDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "should remove partial dataset")
+	})
+}
+
+func TestOpenProgress(t *testing.T) {
+	metaFile := writeTestDump(t, testRecord(1, -3.2, 55.9), testRecord(2, -3.3, 56))
+	var phases []LoadPhase
+	var records int
+	store, err := Open(context.Background(), metaFile, OpenOptions{
+		Progress: func(p LoadProgress) {
+			if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+				phases = append(phases, p.Phase)
+			}
+			records = p.Records
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	assert.Equal(t, []LoadPhase{PhaseDownloading, PhaseWriting, PhaseCompacting, PhaseIndexing}, phases)
+	assert.Equal(t, 2, records)
+}
+
+func openTestStore(t *testing.T, metaFile string, opts OpenOptions) *Store {
+	t.Helper()
+	store, err := Open(context.Background(), metaFile, opts)
+	require.NoError(t, err)
+	return store
+}
+
 func TestHaversine(t *testing.T) {
 	got := haversineDistanceMeters(Point(-0.1275, 51.507222), Point(-1.9025, 52.48))
 	assert.Equal(t, float64(163), math.Round(float64(got)/1000))
 }
+
+func testRecord(id int32, lng, lat float32) string {
+	return fmt.Sprintf(`{"gridimage_id":%d,"user_id":1,"realname":"Test User","title":"Picture %d","wgs84_long":%f,"wgs84_lat":%f}`,
+		id, id, lng, lat)
+}
+
+func writeTestDump(t *testing.T, records ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "meta.ndjson.gz")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	w := gzip.NewWriter(f)
+	for _, record := range records {
+		_, err := w.Write([]byte(record + "\n"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Close())
+	return path
+}
@@ -0,0 +1,259 @@
+package geograph
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"github.com/cockroachdb/pebble"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseTag parses a tag as written on Geograph, such as "top:Rivers" or
+// "bothy". A tag ending in a colon, such as "type:", has only a prefix.
+func ParseTag(s string) Tag {
+	prefix, tag, ok := strings.Cut(s, ":")
+	if !ok || prefix == "" || strings.ContainsAny(prefix, " ") {
+		return Tag{Tag: strings.TrimSpace(s)}
+	}
+	return Tag{Prefix: strings.TrimSpace(prefix), Tag: strings.TrimSpace(tag)}
+}
+
+func (t Tag) String() string {
+	if t.Prefix == "" {
+		return t.Tag
+	}
+	return t.Prefix + ":" + t.Tag
+}
+
+// TagCount is an entry of the tag dictionary.
+type TagCount struct {
+	Tag
+	// Count is the number of pictures with the tag.
+	Count int `json:"count"`
+}
+
+// AutocompleteTags returns up to limit of the most used tags starting with
+// q, ignoring case. If q has a prefix, such as "top:riv", only tags with that
+// prefix are returned. A limit below 1 returns no tags.
+//
+// Only the best limit tags are kept while reading the dictionary, so that
+// short queries matching many tags stay cheap.
+func (s *Store) AutocompleteTags(q string, limit int) ([]TagCount, error) {
+	if limit < 1 {
+		return nil, nil
+	}
+	want := ParseTag(q)
+	lower, upper := prefixBounds(append([]byte{tagKeyPrefix}, strings.ToLower(want.Tag)...)...)
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = iter.Close() }()
+
+	// out is kept sorted best first
+	out := make([]TagCount, 0, min(limit, 64))
+	for iter.First(); iter.Valid(); iter.Next() {
+		tc, err := decodeTagCount(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if want.Prefix != "" && !strings.EqualFold(tc.Prefix, want.Prefix) {
+			continue
+		}
+		if len(out) == limit && compareTagCounts(tc, out[limit-1]) >= 0 {
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(out, tc, compareTagCounts)
+		if len(out) == limit {
+			out = out[:limit-1]
+		}
+		out = slices.Insert(out, i, tc)
+	}
+	return out, iter.Error()
+}
+
+// compareTagCounts orders the most used tags first.
+func compareTagCounts(a, b TagCount) int {
+	return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.String(), b.String()))
+}
+
+// tagKey is a lower-cased tag followed by its lower-cased prefix, so that
+// tags can be looked up by the start of the tag whatever their prefix.
+func tagKey(t Tag) []byte {
+	b := append([]byte{tagKeyPrefix}, strings.ToLower(t.Tag)...)
+	b = append(b, 0)
+	return append(b, strings.ToLower(t.Prefix)...)
+}
+
+func (tc TagCount) encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(tc.Count))
+	b = append(b, tc.Prefix...)
+	b = append(b, 0)
+	return append(b, tc.Tag.Tag...)
+}
+
+func decodeTagCount(b []byte) (TagCount, error) {
+	if len(b) < 5 {
+		return TagCount{}, errors.New("invalid tag count")
+	}
+	prefix, tag, ok := bytes.Cut(b[4:], []byte{0})
+	if !ok {
+		return TagCount{}, errors.New("invalid tag count")
+	}
+	return TagCount{Tag: Tag{Prefix: string(prefix), Tag: string(tag)}, Count: int(binary.BigEndian.Uint32(b))}, nil
+}
+
+// tagCounts accumulates changes to the tag dictionary.
+type tagCounts map[string]*TagCount
+
+// add adds n to the count of each distinct tag of a record.
+func (c tagCounts) add(fields indexedFields, n int) {
+	seen := make(map[string]bool, len(fields.Tags))
+	for _, tag := range fields.Tags {
+		if tag.Tag == "" {
+			continue
+		}
+		key := string(tagKey(tag))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		tc, ok := c[key]
+		if !ok {
+			tc = &TagCount{Tag: tag}
+			c[key] = tc
+		}
+		tc.Count += n
+	}
+}
+
+// apply adds the changes to the counts stored in db.
+func (c tagCounts) apply(db *pebble.DB, batch *pebble.Batch) error {
+	for key, change := range c {
+		if change.Count == 0 {
+			continue
+		}
+
+		tc := TagCount{Tag: change.Tag}
+		value, closer, err := db.Get([]byte(key))
+		if err == nil {
+			tc, err = decodeTagCount(value)
+			if err := closer.Close(); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+		} else if !errors.Is(err, pebble.ErrNotFound) {
+			return err
+		}
+
+		tc.Count += change.Count
+		if tc.Count <= 0 {
+			err = batch.Delete([]byte(key), nil)
+		} else {
+			err = batch.Set([]byte(key), tc.encode(), nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FacetCount is a value of a facet and the number of pictures with it.
+type FacetCount struct {
+	Value string `json:"value"`
+	// Label is a display name for the value, if it isn't one itself.
+	Label string `json:"label,omitempty"`
+	Count int    `json:"count"`
+}
+
+type Facets struct {
+	// Pictures is the number of pictures counted.
+	Pictures int `json:"pictures"`
+	// Complete is false if there were more than maxFacetPictures pictures, in
+	// which case only the first were counted.
+	Complete     bool         `json:"complete"`
+	Tags         []FacetCount `json:"tags"`
+	Years        []FacetCount `json:"years"`
+	Contributors []FacetCount `json:"contributors"`
+}
+
+// maxFacetPictures limits how many pictures Facets reads, as each is read
+// from disk.
+const maxFacetPictures = 20_000
+
+// Facets counts the most common tags, years taken and contributors of the
+// pictures in [min, max], returning up to limit values of each. A limit below
+// 1 returns no values.
+func (s *Store) Facets(min, max [2]float32, index IndexType, limit int) (*Facets, error) {
+	tags := make(map[string]*FacetCount)
+	years := make(map[string]*FacetCount)
+	contributors := make(map[string]*FacetCount)
+	count := func(counts map[string]*FacetCount, value, label string) {
+		fc, ok := counts[value]
+		if !ok {
+			fc = &FacetCount{Value: value, Label: label}
+			counts[value] = fc
+		}
+		fc.Count++
+	}
+
+	out := &Facets{Complete: true}
+	var err error
+	s.index.each(min, max, index, func(id int32, _ [2]float32) bool {
+		if out.Pictures == maxFacetPictures {
+			out.Complete = false
+			return false
+		}
+
+		var pic *Picture
+		pic, err = s.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			err = nil
+			return true
+		} else if err != nil {
+			return false
+		}
+		out.Pictures++
+
+		seen := make(map[string]bool, len(pic.Tags))
+		for _, tag := range pic.Tags {
+			value := tag.String()
+			if !seen[value] {
+				seen[value] = true
+				count(tags, value, "")
+			}
+		}
+		if isTakenDate(pic.ImageTaken) {
+			count(years, pic.ImageTaken[:4], "")
+		}
+		count(contributors, strconv.Itoa(int(pic.UserID)), pic.Realname)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out.Tags = topFacetCounts(tags, limit)
+	out.Years = topFacetCounts(years, limit)
+	out.Contributors = topFacetCounts(contributors, limit)
+	return out, nil
+}
+
+func topFacetCounts(counts map[string]*FacetCount, limit int) []FacetCount {
+	out := make([]FacetCount, 0, len(counts))
+	for _, fc := range counts {
+		out = append(out, *fc)
+	}
+	slices.SortFunc(out, func(a, b FacetCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+	return out[:max(min(len(out), limit), 0)]
+}
@@ -0,0 +1,110 @@
+package geograph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func tagTestRecord(id int32, lng float32, userID int32, taken string, tags ...string) string {
+	var tagValues []Tag
+	for _, tag := range tags {
+		tagValues = append(tagValues, ParseTag(tag))
+	}
+	tagsJSON, _ := json.Marshal(tagValues)
+	return fmt.Sprintf(`{"gridimage_id":%d,"user_id":%d,"realname":"User %d","imagetaken":%q,"tags":%s,"wgs84_long":%f,"wgs84_lat":56}`,
+		id, userID, userID, taken, tagsJSON, lng)
+}
+
+func TestAutocompleteTagsShortQuery(t *testing.T) {
+	var records []string
+	for i := range int32(2_000) {
+		// Tag i is on i%7+1 pictures
+		for j := range i%7 + 1 {
+			records = append(records, tagTestRecord(i*7+j+1, -3+float32(j)*0.001, 1, "", fmt.Sprintf("tag %d", i)))
+		}
+	}
+	subject := openTestStore(t, writeTestDump(t, records...), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	got, err := subject.AutocompleteTags("t", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{
+		{Tag: Tag{Tag: "tag 1000"}, Count: 7},
+		{Tag: Tag{Tag: "tag 1007"}, Count: 7},
+		{Tag: Tag{Tag: "tag 1014"}, Count: 7},
+	}, got)
+
+	got, err = subject.AutocompleteTags("", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{
+		{Tag: Tag{Tag: "tag 1000"}, Count: 7},
+		{Tag: Tag{Tag: "tag 1007"}, Count: 7},
+	}, got)
+}
+
+func TestParseTag(t *testing.T) {
+	assert.Equal(t, Tag{Prefix: "top", Tag: "Rivers"}, ParseTag("top:Rivers"))
+	assert.Equal(t, Tag{Prefix: "type", Tag: ""}, ParseTag("type:"))
+	assert.Equal(t, Tag{Tag: "bothy"}, ParseTag("bothy"))
+	assert.Equal(t, Tag{Tag: "a b:c"}, ParseTag("a b:c"))
+	assert.Equal(t, "top:Rivers", ParseTag("top:Rivers").String())
+}
+
+func TestTags(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		tagTestRecord(1, -3.1, 1, "2010-01-01", "top:Rivers", "river bank", "bothy"),
+		tagTestRecord(2, -3.2, 1, "2010-06-01", "top:Rivers", "Bothy"),
+		tagTestRecord(3, -3.3, 2, "2012-00-00", "top:Roads", "type:Close look"),
+		tagTestRecord(4, 5, 3, "", "top:Rivers"),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	got, err := subject.AutocompleteTags("ri", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{
+		{Tag: Tag{Prefix: "top", Tag: "Rivers"}, Count: 3},
+		{Tag: Tag{Tag: "river bank"}, Count: 1},
+	}, got)
+
+	got, err = subject.AutocompleteTags("TOP:r", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{{Tag: Tag{Prefix: "top", Tag: "Rivers"}, Count: 3}}, got)
+
+	got, err = subject.AutocompleteTags("both", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{{Tag: Tag{Tag: "bothy"}, Count: 2}}, got, "should merge tags differing only in case")
+
+	got, err = subject.AutocompleteTags("ri", -1)
+	require.NoError(t, err)
+	assert.Empty(t, got, "should clamp a negative limit")
+
+	facets, err := subject.Facets(Point(-4, 55), Point(-3, 57), SubjectIndex, -1)
+	require.NoError(t, err)
+	assert.Empty(t, facets.Tags, "should clamp a negative limit")
+
+	facets, err = subject.Facets(Point(-4, 55), Point(-3, 57), SubjectIndex, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &Facets{
+		Pictures:     3,
+		Complete:     true,
+		Tags:         []FacetCount{{Value: "top:Rivers", Count: 2}, {Value: "Bothy", Count: 1}},
+		Years:        []FacetCount{{Value: "2010", Count: 2}, {Value: "2012", Count: 1}},
+		Contributors: []FacetCount{{Value: "1", Label: "User 1", Count: 2}, {Value: "2", Label: "User 2", Count: 1}},
+	}, facets)
+
+	// Deltas update the counts
+	require.NoError(t, subject.ApplyDelta(&Delta{
+		Upserts: []json.RawMessage{json.RawMessage(tagTestRecord(1, -3.1, 1, "2010-01-01", "top:Rivers"))},
+		Deletes: []int32{2},
+	}))
+	got, err = subject.AutocompleteTags("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TagCount{
+		{Tag: Tag{Prefix: "top", Tag: "Rivers"}, Count: 2},
+		{Tag: Tag{Prefix: "top", Tag: "Roads"}, Count: 1},
+		{Tag: Tag{Prefix: "type", Tag: "Close look"}, Count: 1},
+	}, got)
+}
@@ -0,0 +1,238 @@
+package geograph
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/cockroachdb/pebble"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Text is indexed for search as terms, which are lower-cased runs of letters
+// and digits. Each term of a record has a posting recording where in the
+// record it occurs.
+
+type textField uint32
+
+const (
+	titleField textField = iota
+	tagField
+	commentField
+)
+
+// Weights of a term occurring in each field when ranking.
+var textFieldWeights = [...]float64{titleField: 3, tagField: 2, commentField: 1}
+
+const maxTermLen = 64
+
+// stopwords are too common to be worth indexing. They still take up a
+// position so that phrases containing them match.
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "at": true, "by": true, "for": true,
+	"from": true, "in": true, "is": true, "it": true, "of": true, "on": true,
+	"or": true, "the": true, "to": true, "with": true,
+}
+
+// tokenize calls fn with each term of text and its position.
+func tokenize(text string, fn func(pos uint32, term string)) uint32 {
+	var pos uint32
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		term := strings.ToLower(word)
+		if len(term) <= maxTermLen && !stopwords[term] {
+			fn(pos, term)
+		}
+		pos++
+	}
+	return pos
+}
+
+// termPosting is where a term occurs in a record.
+type termPosting struct {
+	// terms is the number of terms in the record
+	terms uint32
+	// positions are position<<2 | field, sorted
+	positions []uint32
+}
+
+func (p termPosting) field(i int) textField {
+	return textField(p.positions[i] & 3)
+}
+
+func (p termPosting) position(i int) uint32 {
+	return p.positions[i] >> 2
+}
+
+// weight is the weighted number of times the term occurs.
+func (p termPosting) weight() float64 {
+	var w float64
+	for i := range p.positions {
+		w += textFieldWeights[p.field(i)]
+	}
+	return w
+}
+
+func (p termPosting) encode() []byte {
+	b := binary.AppendUvarint(nil, uint64(p.terms))
+	b = binary.AppendUvarint(b, uint64(len(p.positions)))
+	for _, pos := range p.positions {
+		b = binary.AppendUvarint(b, uint64(pos))
+	}
+	return b
+}
+
+var errInvalidPosting = errors.New("invalid posting")
+
+func decodeTermPosting(b []byte) (termPosting, error) {
+	var values []uint32
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return termPosting{}, errInvalidPosting
+		}
+		values = append(values, uint32(v))
+		b = b[n:]
+	}
+	if len(values) < 2 || int(values[1]) != len(values)-2 {
+		return termPosting{}, errInvalidPosting
+	}
+	return termPosting{terms: values[0], positions: values[2:]}, nil
+}
+
+// indexText returns the postings of each term in the title, tags and
+// comment of a record.
+func indexText(fields indexedFields) map[string]*termPosting {
+	postings := make(map[string]*termPosting)
+	var terms uint32
+	add := func(field textField, text string, start uint32) uint32 {
+		return tokenize(text, func(pos uint32, term string) {
+			posting, ok := postings[term]
+			if !ok {
+				posting = &termPosting{}
+				postings[term] = posting
+			}
+			posting.positions = append(posting.positions, (start+pos)<<2|uint32(field))
+			terms++
+		})
+	}
+
+	add(titleField, fields.Title, 0)
+	var tagPos uint32
+	for _, tag := range fields.Tags {
+		// Leave a gap so that phrases don't match across tags
+		tagPos += add(tagField, tag.Tag, tagPos) + 1
+	}
+	add(commentField, fields.Comment, 0)
+
+	for _, posting := range postings {
+		posting.terms = terms
+		slices.Sort(posting.positions)
+	}
+	return postings
+}
+
+// textStats are totals over every record indexed for search.
+type textStats struct {
+	records uint64
+	terms   uint64
+}
+
+func (s *textStats) add(fields indexedFields) {
+	s.records++
+	s.terms += countTerms(fields)
+}
+
+// remove undoes add for a record removed from the store.
+func (s *textStats) remove(fields indexedFields) {
+	s.records = max(s.records, 1) - 1
+	s.terms -= min(s.terms, countTerms(fields))
+}
+
+func countTerms(fields indexedFields) uint64 {
+	var n uint64
+	count := func(uint32, string) { n++ }
+	tokenize(fields.Title, count)
+	for _, tag := range fields.Tags {
+		tokenize(tag.Tag, count)
+	}
+	tokenize(fields.Comment, count)
+	return n
+}
+
+func (s textStats) encode() []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, s.records), s.terms)
+}
+
+func decodeTextStats(b []byte) (textStats, error) {
+	if len(b) != 16 {
+		return textStats{}, errors.New("invalid text stats")
+	}
+	return textStats{records: binary.BigEndian.Uint64(b), terms: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+// termCounts accumulates changes to the number of pictures with each term.
+type termCounts map[string]int
+
+// add adds n to the count of each distinct term of a record.
+func (c termCounts) add(fields indexedFields, n int) {
+	seen := make(map[string]bool)
+	count := func(_ uint32, term string) {
+		if !seen[term] {
+			seen[term] = true
+			c[term] += n
+		}
+	}
+	tokenize(fields.Title, count)
+	for _, tag := range fields.Tags {
+		tokenize(tag.Tag, count)
+	}
+	tokenize(fields.Comment, count)
+}
+
+// apply adds the changes to the counts stored in db.
+func (c termCounts) apply(db *pebble.DB, batch *pebble.Batch) error {
+	for term, change := range c {
+		if change == 0 {
+			continue
+		}
+
+		key := termCountKey(term)
+		count := 0
+		value, closer, err := db.Get(key)
+		if err == nil {
+			count, err = decodeTermCount(value)
+			if err := closer.Close(); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+		} else if !errors.Is(err, pebble.ErrNotFound) {
+			return err
+		}
+
+		count += change
+		if count <= 0 {
+			err = batch.Delete(key, nil)
+		} else {
+			err = batch.Set(key, encodeTermCount(count), nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeTermCount(count int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(count))
+}
+
+func decodeTermCount(b []byte) (int, error) {
+	if len(b) != 4 {
+		return 0, errors.New("invalid term count")
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
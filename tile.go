@@ -0,0 +1,111 @@
+package geograph
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrInvalidTile = errors.New("invalid tile")
+
+const (
+	// MaxTileZoom is the highest zoom tiles are served at. Clients overzoom
+	// past it.
+	MaxTileZoom = 18
+	// tileBuffer is how far past its edges a tile includes points, in tile
+	// coordinates, so that markers aren't cut off.
+	tileBuffer = 64
+	// tileClusterMaxZoom is the highest zoom at which nearby points are
+	// clustered.
+	tileClusterMaxZoom = 13
+	// tileClusterSize is the size of the cells points are clustered into, in
+	// tile coordinates.
+	tileClusterSize = 256
+	// maxTilePoints is the most points a tile above tileClusterMaxZoom shows
+	// individually before clustering them into smaller cells.
+	maxTilePoints = 2000
+)
+
+// Tile returns the Mapbox Vector Tile z/x/y with the layers "subject" and
+// "viewpoint" of picture locations.
+//
+// Pictures have the attributes id, title and thumbnail. At low zooms, and in
+// dense areas, nearby pictures are clustered into features with the attribute
+// cluster set, point_count of the number of pictures and id of the picture
+// with the lowest id. A cluster of one picture is shown as that picture.
+func (s *Store) Tile(z, x, y int, imageSecret []byte) ([]byte, error) {
+	if err := ValidateTile(z, x, y); err != nil {
+		return nil, err
+	}
+
+	var layers []*mvtLayer
+	for _, layer := range []struct {
+		name  string
+		index IndexType
+	}{{"subject", SubjectIndex}, {"viewpoint", ViewpointIndex}} {
+		l, err := s.tileLayer(layer.name, layer.index, z, x, y, imageSecret)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+	}
+	return encodeMVT(layers...), nil
+}
+
+// ValidateTile returns ErrInvalidTile unless z/x/y is a tile Tile serves.
+func ValidateTile(z, x, y int) error {
+	if z < 0 || z > MaxTileZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return fmt.Errorf("%w: %d/%d/%d", ErrInvalidTile, z, x, y)
+	}
+	return nil
+}
+
+func (s *Store) tileLayer(name string, index IndexType, z, x, y int, imageSecret []byte) (*mvtLayer, error) {
+	buffer := float64(tileBuffer) / mvtExtent
+	northWest := mercatorLngLat(float64(x)-buffer, float64(y)-buffer, z)
+	southEast := mercatorLngLat(float64(x+1)+buffer, float64(y+1)+buffer, z)
+	minPt := Point(float32(math.Max(float64(northWest[0]), -180)), southEast[1])
+	maxPt := Point(float32(math.Min(float64(southEast[0]), 180)), northWest[1])
+
+	// Points are clustered into cells, which are the size of a tile
+	// coordinate when not clustering
+	cellsPerTile := mvtExtent
+	if z <= tileClusterMaxZoom {
+		cellsPerTile = mvtExtent / tileClusterSize
+	} else if s.index.count(minPt, maxPt, index) > maxTilePoints {
+		cellsPerTile = mvtExtent / (tileClusterSize / 4)
+	}
+	var clusters []pointCluster
+	s.index.clusters(minPt, maxPt, index, z, cellsPerTile, func(c pointCluster) {
+		clusters = append(clusters, c)
+	})
+
+	l := newMVTLayer(name)
+	for _, c := range clusters {
+		tx := int32(math.Round((c.x - float64(x)) * mvtExtent))
+		ty := int32(math.Round((c.y - float64(y)) * mvtExtent))
+
+		if c.count > 1 {
+			l.addPoint(uint64(c.id), tx, ty, []mvtAttr{
+				{"cluster", true},
+				{"point_count", int64(c.count)},
+				{"id", int64(c.id)},
+			})
+			continue
+		}
+
+		pic, err := s.Get(c.id)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted by a delta applied since the index was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		l.addPoint(uint64(c.id), tx, ty, []mvtAttr{
+			{"id", int64(c.id)},
+			{"title", pic.Title},
+			{"thumbnail", GetImageSrc(imageSecret, pic, false).Thumbnail},
+		})
+	}
+	return l, nil
+}
@@ -0,0 +1,171 @@
+package geograph
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+// testFeature is a decoded MVT point feature.
+type testFeature struct {
+	x, y  int64
+	attrs map[string]any
+}
+
+// decodeTestTile decodes the point features of each layer of a tile.
+func decodeTestTile(t *testing.T, tile []byte) map[string][]testFeature {
+	t.Helper()
+	out := make(map[string][]testFeature)
+	for _, layerField := range decodeTestProto(t, tile) {
+		require.Equal(t, mvtTileLayers, layerField.num)
+
+		var name string
+		var keys []string
+		var values []any
+		var features [][]testProtoField
+		for _, f := range decodeTestProto(t, layerField.bytes) {
+			switch f.num {
+			case mvtLayerName:
+				name = string(f.bytes)
+			case mvtLayerKeys:
+				keys = append(keys, string(f.bytes))
+			case mvtLayerValues:
+				v := decodeTestProto(t, f.bytes)[0]
+				switch v.num {
+				case mvtValueString:
+					values = append(values, string(v.bytes))
+				case mvtValueInt:
+					values = append(values, int64(v.varint))
+				case mvtValueBool:
+					values = append(values, v.varint == 1)
+				}
+			case mvtLayerFeatures:
+				features = append(features, decodeTestProto(t, f.bytes))
+			case mvtLayerExtent:
+				require.Equal(t, uint64(mvtExtent), f.varint)
+			}
+		}
+
+		out[name] = []testFeature{}
+		for _, fields := range features {
+			feature := testFeature{attrs: make(map[string]any)}
+			for _, f := range fields {
+				switch f.num {
+				case mvtFeatureTags:
+					tags := decodeTestVarints(t, f.bytes)
+					for i := 0; i < len(tags); i += 2 {
+						feature.attrs[keys[tags[i]]] = values[tags[i+1]]
+					}
+				case mvtFeatureGeometry:
+					geometry := decodeTestVarints(t, f.bytes)
+					require.Len(t, geometry, 3)
+					require.Equal(t, uint64(mvtMoveTo|1<<3), geometry[0])
+					unzigzag := func(v uint64) int64 { return int64(v>>1) ^ -int64(v&1) }
+					feature.x, feature.y = unzigzag(geometry[1]), unzigzag(geometry[2])
+				}
+			}
+			out[name] = append(out[name], feature)
+		}
+	}
+	return out
+}
+
+type testProtoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+func decodeTestProto(t *testing.T, b []byte) []testProtoField {
+	t.Helper()
+	var out []testProtoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n)
+		b = b[n:]
+		f := testProtoField{num: int(key >> 3)}
+		v, n := binary.Uvarint(b)
+		require.Positive(t, n)
+		b = b[n:]
+		switch key & 7 {
+		case protoVarint:
+			f.varint = v
+		case protoBytes:
+			f.bytes = b[:v]
+			b = b[v:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func decodeTestVarints(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var out []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		require.Positive(t, n)
+		out = append(out, v)
+		b = b[n:]
+	}
+	return out
+}
+
+func TestTile(t *testing.T) {
+	subject := openTestStore(t, writeTestDump(t,
+		testRecord(1, -3.1855, 55.9535),
+		testRecord(2, -3.184, 55.953),
+		testRecord(3, -3.185, 55.9525),
+		testRecord(4, -0.12, 51.5),
+	), OpenOptions{})
+	defer func() { require.NoError(t, subject.Close()) }()
+
+	tileOf := func(p [2]float32, z int) (int, int) {
+		x, y := mercatorXY(p, z)
+		return int(math.Floor(x)), int(math.Floor(y))
+	}
+
+	// Zoomed in every picture is shown
+	x, y := tileOf(Point(-3.185, 55.953), 14)
+	data, err := subject.Tile(14, x, y, []byte("secret"))
+	require.NoError(t, err)
+	tile := decodeTestTile(t, data)
+	require.Len(t, tile["subject"], 3)
+	assert.Empty(t, tile["viewpoint"])
+	for _, f := range tile["subject"] {
+		assert.Contains(t, f.attrs, "title")
+		assert.Contains(t, f.attrs["thumbnail"], "_120x120.jpg")
+		assert.True(t, f.x >= -tileBuffer && f.x < mvtExtent+tileBuffer)
+	}
+
+	// Zoomed out nearby pictures are clustered
+	x, y = tileOf(Point(-3.185, 55.95), 5)
+	data, err = subject.Tile(5, x, y, nil)
+	require.NoError(t, err)
+	tile = decodeTestTile(t, data)
+	require.Len(t, tile["subject"], 1)
+	assert.Equal(t, map[string]any{"cluster": true, "point_count": int64(3), "id": int64(1)}, tile["subject"][0].attrs)
+
+	data, err = subject.Tile(0, 0, 0, nil)
+	require.NoError(t, err)
+	assert.Len(t, decodeTestTile(t, data)["subject"], 2)
+
+	_, err = subject.Tile(1, 2, 0, nil)
+	assert.ErrorIs(t, err, ErrInvalidTile)
+}
+
+func TestMercator(t *testing.T) {
+	for _, p := range [][2]float32{Point(0, 0), Point(-3.2, 55.9), Point(179, -80)} {
+		x, y := mercatorXY(p, 10)
+		got := mercatorLngLat(x, y, 10)
+		assert.InDelta(t, p[0], got[0], 1e-4)
+		assert.InDelta(t, p[1], got[1], 1e-4)
+	}
+	x, y := mercatorXY(Point(-180, maxMercatorLat), 3)
+	assert.InDelta(t, 0, x, 1e-6)
+	assert.InDelta(t, 0, y, 1e-6)
+}